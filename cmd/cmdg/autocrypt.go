@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+)
+
+const (
+	encryptedMultipartType = `encrypted; protocol="application/pgp-encrypted"`
+)
+
+var (
+	autocryptFlag   = flag.Bool("autocrypt", false, "Advertise own GPG key with Autocrypt headers, and learn peers' keys from theirs.")
+	autocryptMutual = flag.Bool("autocrypt_mutual", false, "Tell Autocrypt peers that we prefer encrypted mail.")
+)
+
+// ownAddress returns the email address of the logged in user.
+func ownAddress(ctx context.Context, conn *cmdg.CmdG) (string, error) {
+	p, err := conn.GetProfile(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get own email address")
+	}
+	return p.EmailAddress, nil
+}
+
+// autocryptHeader creates the Autocrypt header advertising our own key.
+func autocryptHeader(ctx context.Context, conn *cmdg.CmdG) (string, error) {
+	addr, err := ownAddress(ctx, conn)
+	if err != nil {
+		return "", err
+	}
+	key, err := cmdg.GPG.ExportKey(ctx, addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "exporting own key for %q", addr)
+	}
+	return cmdg.MakeAutocryptHeader(addr, key, *autocryptMutual), nil
+}
+
+// autocryptRecommendation returns the encryption recommendation for the message in the editor.
+func autocryptRecommendation(msg string) cmdg.Recommendation {
+	if cmdg.Autocrypt == nil {
+		return cmdg.RecommendDisable
+	}
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		return cmdg.RecommendDisable
+	}
+	addrs, err := recipientAddresses(m.Header)
+	if err != nil {
+		return cmdg.RecommendDisable
+	}
+	return cmdg.Autocrypt.Recommend(addrs, *autocryptMutual)
+}
+
+func recommendationString(r cmdg.Recommendation) string {
+	switch r {
+	case cmdg.RecommendEncrypt:
+		return "; Autocrypt recommends encrypting"
+	case cmdg.RecommendAvailable:
+		return "; all recipients have Autocrypt keys"
+	case cmdg.RecommendDiscourage:
+		return "; Autocrypt keys may be outdated"
+	}
+	return ""
+}
+
+// pgpEncrypt encrypts a prepared message to all recipients and self, returning a PGP/MIME entity.
+// Recipient keys are taken from Autocrypt state if known, otherwise from the GPG keyring.
+func pgpEncrypt(ctx context.Context, conn *cmdg.CmdG, prep *preparedMessage) (string, error) {
+	inner, err := cmdg.MakeEntity(prep.mp, prep.parts)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := recipientAddresses(prep.head)
+	if err != nil {
+		return "", err
+	}
+	self, err := ownAddress(ctx, conn)
+	if err != nil {
+		return "", err
+	}
+	recipients := []string{self}
+	var keys [][]byte
+	for _, a := range addrs {
+		if cmdg.Autocrypt != nil {
+			if k, err := cmdg.Autocrypt.Keys([]string{a}); err == nil {
+				keys = append(keys, k...)
+				continue
+			}
+		}
+		log.Infof("No Autocrypt key for %q, using keyring", a)
+		recipients = append(recipients, a)
+	}
+	enc, err := cmdg.GPG.Encrypt(ctx, inner, recipients, keys)
+	if err != nil {
+		return "", err
+	}
+	return cmdg.MakeEntity(encryptedMultipartType, []*cmdg.Part{
+		{
+			Header: map[string][]string{
+				"Content-Type":        {"application/pgp-encrypted"},
+				"Content-Description": {"PGP/MIME version identification"},
+			},
+			Contents: "Version: 1\r\n",
+		},
+		{
+			Header: map[string][]string{
+				"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+				"Content-Description": {"OpenPGP encrypted message"},
+				"Content-Disposition": {`inline; filename="encrypted.asc"`},
+			},
+			Contents: enc,
+		},
+	})
+}
+
+// addAutocryptHeader adds our Autocrypt header to outgoing mail, if enabled.
+func addAutocryptHeader(ctx context.Context, conn *cmdg.CmdG, head mail.Header) {
+	if !*autocryptFlag {
+		return
+	}
+	h, err := autocryptHeader(ctx, conn)
+	if err != nil {
+		log.Warningf("Not adding Autocrypt header: %v", err)
+		return
+	}
+	head[cmdg.AutocryptHeader] = []string{h}
+}
+
+func encryptionLabel(opts sendOptions, rec cmdg.Recommendation) string {
+	return fmt.Sprintf("Toggle GPG encryption (now %s%s)", onOff(opts.pgpEncrypt), recommendationString(rec))
+}
@@ -39,6 +39,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/display"
 	"github.com/ThomasHabets/cmdg/pkg/gpg"
 	"github.com/ThomasHabets/cmdg/pkg/input"
 )
@@ -60,17 +61,24 @@ var (
 	versionFlag     = flag.Bool("version", false, "Show version and exit.")
 	lynx            = flag.String("lynx", "lynx", "HTML render binary.")
 	enableSign      = flag.Bool("sign", false, "Send signed emails by default.")
+	composeFlag     = flag.Bool("compose", false, "Start by composing a new message, attaching files given as trailing args. Exits when done.")
 
 	conn *cmdg.CmdG
 
 	// Relative to configDir.
-	configFileName = "cmdg.conf"
+	configFileName    = "cmdg.conf"
+	smimeCertDirName  = "smime"
+	autocryptFileName = "autocrypt.json"
+	draftsDirName     = "drafts"
+	keymapFileName    = "keymap.conf"
+	themeFileName     = "theme.conf"
 
 	// Relative to $HOME.
 	defaultConfigDir = ".cmdg"
 
 	pagerBinary  string
 	visualBinary string
+	keymap       *input.Keymap
 
 	labelReloadTime = time.Minute
 
@@ -96,12 +104,24 @@ func loadSignature(ctx context.Context) error {
 	return nil
 }
 
-func run(ctx context.Context) error {
+func run(ctx context.Context, attachments []*file) error {
 	keys := input.New()
+	keys.SetKeymap(keymap)
+	keys.SetMouse(*mouseFlag)
 	if err := keys.Start(); err != nil {
 		return err
 	}
 
+	if err := recoverJournals(ctx, conn, keys); err != nil {
+		log.Errorf("Failed to recover unsent messages: %v", err)
+	}
+
+	if *composeFlag {
+		err := composeNew(ctx, conn, keys, attachments)
+		keys.Stop()
+		return err
+	}
+
 	v := NewMessageView(ctx, "INBOX", "", keys)
 
 	if err := v.Run(ctx); err != nil {
@@ -122,7 +142,16 @@ func main() {
 
 	log.Infof("cmdg %s", version)
 
-	if flag.NArg() != 0 {
+	var attachments []*file
+	if *composeFlag {
+		for _, fn := range flag.Args() {
+			f, err := newFile(fn)
+			if err != nil {
+				log.Fatalf("Can't attach: %v", err)
+			}
+			attachments = append(attachments, f)
+		}
+	} else if flag.NArg() != 0 {
 		log.Fatalf("Trailing args on cmdline: %q", flag.Args())
 	}
 
@@ -130,6 +159,24 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	{
+		var err error
+		messageListFormat, err = parseListFormat(*listFormatFlag)
+		if err != nil {
+			log.Fatalf("Bad -list_format: %v", err)
+		}
+		fn, mustExist := keymapFilePath()
+		keymap, err = loadKeymap(*keymapPreset, fn, mustExist)
+		if err != nil {
+			log.Fatalf("Loading keymap: %v", err)
+		}
+		fn, mustExist = themeFilePath()
+		display.ActiveTheme, err = loadTheme(*themeFlag, fn, mustExist)
+		if err != nil {
+			log.Fatalf("Loading theme: %v", err)
+		}
+	}
+
 	if *license {
 		fmt.Printf("%s\n", licenseText)
 		return
@@ -163,6 +210,15 @@ func main() {
 	}
 
 	cmdg.GPG = gpg.New(*gpgFlag)
+	cmdg.SMIMECertDir = path.Join(os.Getenv("HOME"), defaultConfigDir, smimeCertDirName)
+	draftsDir = path.Join(os.Getenv("HOME"), defaultConfigDir, draftsDirName)
+	if *autocryptFlag {
+		var err error
+		cmdg.Autocrypt, err = cmdg.LoadAutocrypt(path.Join(os.Getenv("HOME"), defaultConfigDir, autocryptFileName))
+		if err != nil {
+			log.Fatalf("Loading Autocrypt state: %v", err)
+		}
+	}
 
 	var err error
 	conn, err = cmdg.New(configFilePath())
@@ -240,7 +296,7 @@ func main() {
 		})
 	}
 
-	if err := run(ctx); err != nil {
+	if err := run(ctx, attachments); err != nil {
 		log.Fatal(err)
 	}
 }
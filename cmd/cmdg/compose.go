@@ -3,12 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/mail"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -18,6 +22,7 @@ import (
 
 	"github.com/ThomasHabets/cmdg/pkg/cmdg"
 	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/display"
 	"github.com/ThomasHabets/cmdg/pkg/input"
 )
 
@@ -25,30 +30,49 @@ const (
 	signedMultipartType = `signed; micalg=pgp-sha256; protocol="application/pgp-signature"`
 )
 
-func getInput(ctx context.Context, prefill string, keys *input.Input) (string, error) {
-	tmpf, err := ioutil.TempFile("", "cmdg-")
-	if err != nil {
-		return "", errors.Wrap(err, "creating tempfile")
-	}
-	defer func() {
-		if err := os.Remove(tmpf.Name()); err != nil {
-			// TODO: show in UI.
-			log.Errorf("Failed to remove temp compose file %q: %v", tmpf.Name(), err)
-		}
-	}()
-	if _, err := tmpf.Write([]byte(prefill)); err != nil {
-		tmpf.Close()
-		return "", errors.Wrapf(err, "prefilling compose file %q with %d bytes", tmpf.Name(), len(prefill))
+var (
+	smimeCert = flag.String("smime_cert", "", "S/MIME certificate (PEM) to sign outgoing mail with.")
+	smimeKey  = flag.String("smime_key", "", "S/MIME private key (PEM) to sign outgoing mail with.")
+	smimeSign = flag.Bool("smime_sign", false, "Send S/MIME signed emails by default. Requires -smime_cert and -smime_key.")
+	markdown  = flag.Bool("markdown", false, "Treat composed messages as Markdown by default, and send them with an HTML version.")
+)
+
+// sendOptions are per-message choices made in the compose dialog.
+type sendOptions struct {
+	smimeSign    bool
+	smimeEncrypt bool
+	pgpEncrypt   bool
+	markdown     bool
+
+	// contentTypes are user chosen content types for files
+	// attached with `Attach:` pseudo-headers, by path.
+	contentTypes map[string]string
+}
+
+func defaultSendOptions() sendOptions {
+	return sendOptions{
+		smimeSign:    *smimeSign,
+		markdown:     *markdown,
+		contentTypes: make(map[string]string),
 	}
-	if err := tmpf.Close(); err != nil {
-		return "", errors.Wrapf(err, "closing prefill file %q", tmpf.Name())
+}
+
+// check rejects combinations of options that can't be sent together.
+func (o sendOptions) check() error {
+	if o.pgpEncrypt && (o.smimeSign || o.smimeEncrypt) {
+		return fmt.Errorf("can't both GPG encrypt and S/MIME sign or encrypt the same message")
 	}
+	return nil
+}
 
+// editFile runs the editor on a file, and returns the new contents.
+func editFile(ctx context.Context, fn string, keys *input.Input) (string, error) {
 	// Stop UI.
 	keys.Stop()
 	defer keys.Start()
+	defer display.Invalidate()
 
-	cmd := exec.CommandContext(ctx, visualBinary, tmpf.Name())
+	cmd := exec.CommandContext(ctx, visualBinary, fn)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -60,28 +84,60 @@ func getInput(ctx context.Context, prefill string, keys *input.Input) (string, e
 	}
 
 	// Extract content.
-	b, err := ioutil.ReadFile(tmpf.Name())
+	b, err := ioutil.ReadFile(fn)
 	if err != nil {
-		return "", errors.Wrapf(err, "reading compose tempfile %q", tmpf.Name())
+		return "", errors.Wrapf(err, "reading compose file %q", fn)
 	}
 	return string(b), nil
 }
 
-func composeNew(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
-	toOpt, err := dialog.Selection(dialog.Strings2Options(conn.Contacts()), "To> ", true, keys)
+// isRecipient returns true if typed text can be used as a recipient.
+func isRecipient(s string) bool {
+	if strings.EqualFold(s, "me") {
+		return true
+	}
+	_, err := mail.ParseAddress(s)
+	return err == nil
+}
+
+// pickRecipients asks for recipients, suggesting contacts, and returns them comma separated.
+// Typed text is only used if it's an address, so that names can be searched for.
+// "me" is replaced with the own address.
+func pickRecipients(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, prompt string) (string, error) {
+	opts, err := dialog.MultiSelection(dialog.Strings2Options(conn.Contacts()), prompt, isRecipient, keys)
+	if err != nil {
+		return "", err
+	}
+	var ret []string
+	for _, o := range opts {
+		to := o.Key
+		if strings.EqualFold(to, "me") {
+			p, err := conn.GetProfile(ctx)
+			if err != nil {
+				return "", errors.Wrap(err, "failed to get own email address")
+			}
+			to = p.EmailAddress
+		}
+		if to != "" {
+			ret = append(ret, to)
+		}
+	}
+	return strings.Join(ret, ", "), nil
+}
+
+// composeNew composes a new message, optionally with some files already attached.
+func composeNew(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, attachments []*file) error {
+	to, err := pickRecipients(ctx, conn, keys, "To> ")
 	if err == dialog.ErrAborted {
 		return nil
 	} else if err != nil {
 		return err
 	}
-
-	to := toOpt.Key
-	if strings.EqualFold(to, "me") {
-		p, err := conn.GetProfile(ctx)
-		if err != nil {
-			return errors.Wrap(err, "failed to get own email address")
-		}
-		to = p.EmailAddress
+	cc, err := pickRecipients(ctx, conn, keys, "CC> ")
+	if err == dialog.ErrAborted {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
 	var sig string
@@ -90,12 +146,13 @@ func composeNew(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
 	}
 
 	prefill := fmt.Sprintf(`To: %s
-CC:
+CC: %s
 Subject:
 
-%s`, to, sig)
+%s`, to, cc, sig)
 
-	return compose(ctx, conn, keys, cmdg.NewThread, prefill)
+	_, err = compose(ctx, conn, keys, cmdg.NewThread, prefill, attachments, nil)
+	return err
 }
 
 func createSig(ctx context.Context, msg string) (string, error) {
@@ -120,12 +177,25 @@ type preparedMessage struct {
 }
 
 // take message text and attachments, and turn it into mail headers and parts
-func prepareMessage(ctx context.Context, msg string, attachments []*file) (*preparedMessage, error) {
-	head, part, err := cmdg.ParseUserMessage(msg)
+// If `opts.markdown` is set, then the text is also rendered as HTML.
+func prepareMessage(ctx context.Context, msg string, attachments []*file, opts sendOptions) (*preparedMessage, error) {
+	head, part, attach, err := cmdg.ParseUserMessage(msg)
 	if err != nil {
-		// TODO: ask to retry
+		// Should have been caught by validateMessage().
 		return nil, errors.Wrapf(err, "failed to parse that message")
 	}
+	more, err := expandAttachPatterns(attach, opts.contentTypes)
+	if err != nil {
+		return nil, err
+	}
+	attachments = append(append([]*file{}, attachments...), more...)
+
+	if opts.markdown {
+		part, err = cmdg.AlternativePart(part, cmdg.MarkdownToHTML(part.Contents))
+		if err != nil {
+			return nil, errors.Wrap(err, "rendering Markdown")
+		}
+	}
 
 	parts := []*cmdg.Part{part}
 	mp := "mixed"
@@ -148,14 +218,17 @@ func prepareMessage(ctx context.Context, msg string, attachments []*file) (*prep
 		}
 	}
 	for _, att := range attachments {
-		parts = append(parts, &cmdg.Part{
-			// TODO: set better content-type.
-			Header: map[string][]string{
-				"Content-Type":        {fmt.Sprintf("application/octet-stream; name=%q", att.name)},
-				"Content-Disposition": {fmt.Sprintf("attachment; filename=%q", att.name)},
-			},
-			Contents: string(att.content),
-		})
+		var p *cmdg.Part
+		var err error
+		if att.message {
+			p, err = cmdg.MessagePart(att.name, att.open)
+		} else {
+			p, err = cmdg.AttachmentPart(att.name, att.contentType, att.open)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "attaching %q", att.name)
+		}
+		parts = append(parts, p)
 	}
 	return &preparedMessage{
 		head:  head,
@@ -164,61 +237,209 @@ func prepareMessage(ctx context.Context, msg string, attachments []*file) (*prep
 	}, nil
 }
 
+// recipientAddresses returns the email addresses of all recipients of a message.
+func recipientAddresses(head mail.Header) ([]string, error) {
+	var ret []string
+	for _, h := range []string{"To", "CC", "BCC"} {
+		v := head.Get(h)
+		if v == "" {
+			continue
+		}
+		as, err := mail.ParseAddressList(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s header %q", h, v)
+		}
+		for _, a := range as {
+			ret = append(ret, a.Address)
+		}
+	}
+	return ret, nil
+}
+
+// smimeWrap applies S/MIME signing and/or encryption to a prepared message, returning the resulting entity.
+func smimeWrap(ctx context.Context, prep *preparedMessage, opts sendOptions) (string, error) {
+	entity, err := cmdg.MakeEntity(prep.mp, prep.parts)
+	if err != nil {
+		return "", err
+	}
+	if opts.smimeSign {
+		if *smimeCert == "" || *smimeKey == "" {
+			return "", fmt.Errorf("S/MIME signing requires -smime_cert and -smime_key")
+		}
+		entity, err = cmdg.SMIMESign(ctx, entity, *smimeCert, *smimeKey)
+		if err != nil {
+			return "", errors.Wrap(err, "S/MIME signing")
+		}
+	}
+	if opts.smimeEncrypt {
+		addrs, err := recipientAddresses(prep.head)
+		if err != nil {
+			return "", err
+		}
+		certs, err := cmdg.SMIMECertsFor(addrs)
+		if err != nil {
+			return "", err
+		}
+		if *smimeCert != "" {
+			// Also encrypt to self, so that sent mail stays readable.
+			certs = append(certs, *smimeCert)
+		}
+		entity, err = cmdg.SMIMEEncrypt(ctx, entity, certs)
+		if err != nil {
+			return "", errors.Wrap(err, "S/MIME encrypting")
+		}
+	}
+	return entity, nil
+}
+
 // take message text and attachments, and turn it into mail headers and parts
-func sendMessage(ctx context.Context, conn *cmdg.CmdG, msg string, threadID cmdg.ThreadID, attachments []*file) error {
-	prep, err := prepareMessage(ctx, msg, attachments)
+func sendMessage(ctx context.Context, conn *cmdg.CmdG, msg string, threadID cmdg.ThreadID, attachments []*file, opts sendOptions) error {
+	if err := opts.check(); err != nil {
+		return err
+	}
+	prep, err := prepareMessage(ctx, msg, attachments, opts)
 	if err != nil {
 		return errors.Wrap(err, "preparing message")
 	}
+	addAutocryptHeader(ctx, conn, prep.head)
+	if opts.pgpEncrypt {
+		entity, err := pgpEncrypt(ctx, conn, prep)
+		if err != nil {
+			return errors.Wrap(err, "encrypting")
+		}
+		return errors.Wrap(conn.SendEntity(ctx, threadID, prep.head, entity), "sending encrypted entity")
+	}
+	if opts.smimeSign || opts.smimeEncrypt {
+		entity, err := smimeWrap(ctx, prep, opts)
+		if err != nil {
+			return err
+		}
+		return errors.Wrap(conn.SendEntity(ctx, threadID, prep.head, entity), "sending S/MIME entity")
+	}
 	return errors.Wrap(conn.SendParts(ctx, threadID, prep.mp, prep.head, prep.parts), "sending parts")
 }
 
+// archiver archives the message being replied to, or its whole thread, after the reply is sent.
+// The returned op updates the message list to match.
+type archiver func(ctx context.Context, thread bool) (*MessageViewOp, error)
+
 // compose() is used for compose, replies, and forwards.
-func compose(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, threadID cmdg.ThreadID, msg string) error {
+//
+// If `archive` is not nil, then "send and archive" is offered.
+func compose(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, threadID cmdg.ThreadID, msg string, attachments []*file, archive archiver) (*MessageViewOp, error) {
+	j, err := newJournal()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating local copy of message")
+	}
+	return composeJournaled(ctx, conn, keys, j, threadID, msg, attachments, archive)
+}
+
+// composeJournaled composes a message, keeping it in the journal until it's sent, saved, or discarded.
+func composeJournaled(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, j *journal, threadID cmdg.ThreadID, msg string, attachments []*file, archive archiver) (*MessageViewOp, error) {
+	defer j.release()
 	doEdit := true
-	var attachments []*file
+	opts := defaultSendOptions()
+	encryptToggled := false
 	for {
 		var err error
 		if doEdit {
 			// Get message content.
-			msg, err = getInput(ctx, msg, keys)
+			msg, err = j.edit(ctx, msg, keys)
 			if err != nil {
-				return err
+				return nil, errors.Wrapf(err, "message kept in %q", j.fn)
 			}
 		}
+		if err := j.save(threadID, "", attachments); err != nil {
+			log.Errorf("Failed to save journal metadata: %v", err)
+		}
+		rec := autocryptRecommendation(msg)
+		if !encryptToggled {
+			// Don't let the recommendation override a choice of S/MIME.
+			opts.pgpEncrypt = rec == cmdg.RecommendEncrypt && !opts.smimeSign && !opts.smimeEncrypt
+		}
 
 		// Ask to send it.
-		sendQ := []dialog.Option{
-			{Key: "s", Label: "s — Send"},
-			{Key: "d", Label: "d — Save as draft"},
-			{Key: "a", Label: "a — Abort, discarding draft"},
-			{Key: "t", Label: "t — Attach file(s)"},
-			{Key: "r", Label: "r — Return to editor"},
+		type sendAction struct {
+			action, label string
+		}
+		actions := []sendAction{{"send", "Send"}}
+		if archive != nil {
+			actions = append(actions, []sendAction{
+				{"send-archive", "Send and archive message"},
+				{"send-archive-thread", "Send and archive whole thread"},
+			}...)
+		}
+		actions = append(actions, []sendAction{
+			{"draft", "Save as draft"},
+			{"abort", "Abort, discarding draft"},
+			{"attach", "Attach file(s)"},
+		}...)
+		headerFiles, err := headerAttachments(msg, opts.contentTypes)
+		if err != nil {
+			// Reported by validateMessage() when sending.
+			log.Warningf("Failed to expand %s headers: %v", cmdg.AttachHeader, err)
+		}
+		if n := len(attachments) + len(headerFiles); n > 0 {
+			actions = append(actions, sendAction{"content-type", fmt.Sprintf("Change content type of attachment (%d attached)", n)})
+		}
+		actions = append(actions, []sendAction{
+			{"edit", "Return to editor"},
+			{"smime-sign", fmt.Sprintf("Toggle S/MIME signing (now %s)", onOff(opts.smimeSign))},
+			{"smime-encrypt", fmt.Sprintf("Toggle S/MIME encryption (now %s)", onOff(opts.smimeEncrypt))},
+			{"encrypt", encryptionLabel(opts, rec)},
+			{"markdown", fmt.Sprintf("Toggle sending Markdown as HTML too (now %s)", onOff(opts.markdown))},
+		}...)
+		var sendQ []dialog.Option
+		for _, sa := range actions {
+			if o, ok := actionOption(keys, viewCompose, sa.action, sa.label); ok {
+				sendQ = append(sendQ, o)
+			}
 		}
 		// TODO: send signed.
-		// TODO: attach.
 
 		a, err := dialog.Question("Send message?", sendQ, keys)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		act := keys.Keymap().Action(viewCompose, a)
+		if a == "^C" {
+			act = "abort"
 		}
 
 		// Default to preparing to edit again.
 		doEdit = true
 
-		switch a {
-		case "r": // Return to editor.
+		switch act {
+		case "edit":
 			continue
-		case "^C", "a": // Abandon.
-			return nil
-		case "s", "S":
+		case "abort":
+			j.remove()
+			return nil, nil
+		case "send", "send-archive", "send-archive-thread":
+			if err := opts.check(); err != nil {
+				if err := dialog.Message("Can't send message", err.Error()+"\n\nTurn off GPG encryption or S/MIME.", keys); err != nil {
+					return nil, err
+				}
+				doEdit = false
+				continue
+			}
+			if p := validateMessage(msg, attachments, conn.Contacts()); !p.empty() {
+				send, err := confirmProblems(p, keys)
+				if err != nil {
+					return nil, err
+				}
+				if !send {
+					// Back to the editor, to fix it.
+					continue
+				}
+			}
 			for {
 				st := time.Now()
 
-				if err := sendMessage(ctx, conn, msg, threadID, attachments); err != nil {
+				if err := sendMessage(ctx, conn, msg, threadID, attachments, opts); err != nil {
 					log.Errorf("Failed to send: %v", err)
-					a, err := dialog.Question(fmt.Sprintf("Failed to send (%q). Save to local file?", err.Error()), []dialog.Option{
-						{Key: "y", Label: "Y — Yes, save to local file"},
+					a, err := dialog.Question(fmt.Sprintf("Failed to send (%q). Keep local copy?", err.Error()), []dialog.Option{
+						{Key: "y", Label: fmt.Sprintf("Y — Yes, keep in %s, to recover later", draftsDir)},
 						{Key: "n", Label: "N — No, discard completely"},
 						{Key: "t", Label: "t — Try again"},
 					}, keys)
@@ -226,45 +447,62 @@ func compose(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, threadID c
 						// No no no, we won't let you passively cancel this. You say y or n.
 					} else if err != nil {
 						// OK, I give up.
-						return err
+						return nil, err
 					}
 					switch a {
 					case "y":
-						f, err := ioutil.TempFile(".", "cmdg-draft-*.txt")
-						if err != nil {
-							return errors.Wrapf(err, "couldn't open local file")
-						}
-						if _, err := f.Write([]byte(msg)); err != nil {
-							f.Close()
-							return errors.Wrapf(err, "couldn't write to local file")
-						}
-						if err := f.Close(); err != nil {
-							return errors.Wrapf(err, "couldn't close local file")
-						}
-						return nil
+						// Journal is released, not removed, so it'll be offered for recovery on next start.
+						log.Infof("Keeping unsent message in %q", j.fn)
+						return nil, nil
 					case "n":
-						return nil
+						j.remove()
+						return nil, nil
 					case "t":
 						// Try again.
 					}
 				} else {
 					log.Infof("Took %v to send message", time.Since(st))
+					j.remove()
 					break
 				}
 			}
-			if a == "S" {
-				// TODO: also archive.
+			if act == "send" {
+				return nil, nil
+			}
+			op, err := archive(ctx, act == "send-archive-thread")
+			if err != nil {
+				return nil, errors.Wrap(err, "message sent, but archiving failed")
 			}
-			return nil
-		case "d":
+			return op, nil
+		case "draft":
 			st := time.Now()
 			if err := conn.MakeDraft(ctx, msg); err != nil {
-				// TODO: ask to save on local filesystem.
-				return err
+				return nil, errors.Wrapf(err, "saving draft failed; message kept in %q", j.fn)
 			}
 			log.Infof("Took %v to make draft", time.Since(st))
-			return nil
-		case "t":
+			j.remove()
+			return nil, nil
+		case "smime-sign":
+			opts.smimeSign = !opts.smimeSign
+			doEdit = false
+		case "smime-encrypt":
+			opts.smimeEncrypt = !opts.smimeEncrypt
+			doEdit = false
+		case "encrypt":
+			opts.pgpEncrypt = !opts.pgpEncrypt
+			encryptToggled = true
+			doEdit = false
+		case "markdown":
+			opts.markdown = !opts.markdown
+			doEdit = false
+		case "content-type":
+			if err := changeContentType(attachments, headerFiles, opts.contentTypes, keys); errors.Cause(err) == dialog.ErrAborted {
+				// User aborted.
+			} else if err != nil {
+				dialog.Message("Failed to change content type", err.Error(), keys)
+			}
+			doEdit = false
+		case "attach":
 			f, err := chooseFile(ctx, keys)
 			if errors.Cause(err) == dialog.ErrAborted {
 				doEdit = false
@@ -272,18 +510,147 @@ func compose(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, threadID c
 			}
 			if err != nil {
 				dialog.Message("Failed to attach", fmt.Sprintf("Failed to attach file: %v", err), keys)
+			} else {
+				attachments = append(attachments, f)
 			}
 			doEdit = false
-			attachments = append(attachments, f)
 		default:
-			return fmt.Errorf("can't happen! Got %q from compose question", a)
+			return nil, fmt.Errorf("can't happen! Got %q from compose question", a)
 		}
 	}
 }
 
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// file is an attachment. It's only read when the message is sent.
 type file struct {
-	name    string
-	content []byte
+	name        string
+	path        string // Empty if not a local file.
+	contentType string
+	open        func() (io.ReadCloser, error)
+
+	// Contents are known to be a whole email, and sent unencoded as message/rfc822.
+	message bool
+}
+
+func newFile(fn string) (*file, error) {
+	st, err := os.Stat(fn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "checking %q", fn)
+	}
+	if !st.Mode().IsRegular() {
+		return nil, fmt.Errorf("%q is not a regular file", fn)
+	}
+	ct, err := cmdg.DetectContentType(fn)
+	if err != nil {
+		return nil, err
+	}
+	return &file{
+		name:        path.Base(fn),
+		path:        fn,
+		contentType: ct,
+		open: func() (io.ReadCloser, error) {
+			return os.Open(fn)
+		},
+	}, nil
+}
+
+// expandAttachPatterns turns the values of `Attach:` pseudo-headers into files.
+// Each value is one filename or glob, and may start with ~.
+// Content types in `contentTypes` override the detected ones.
+func expandAttachPatterns(patterns []string, contentTypes map[string]string) ([]*file, error) {
+	var ret []*file
+	for _, pat := range patterns {
+		pat = expandHome(pat)
+		ms, err := filepath.Glob(pat)
+		if err != nil || len(ms) == 0 {
+			// Filenames may contain glob metacharacters.
+			if _, serr := os.Stat(pat); serr == nil {
+				ms, err = []string{pat}, nil
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad %s pattern %q", cmdg.AttachHeader, pat)
+		}
+		if len(ms) == 0 {
+			return nil, fmt.Errorf("%s: %q matches no files", cmdg.AttachHeader, pat)
+		}
+		isGlob := ms[0] != pat
+		for _, fn := range ms {
+			if isGlob {
+				// Let globs like ~/invoices/* skip directories.
+				if st, err := os.Stat(fn); err == nil && st.IsDir() {
+					continue
+				}
+			}
+			f, err := newFile(fn)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: %q", cmdg.AttachHeader, pat)
+			}
+			if ct, found := contentTypes[fn]; found {
+				f.contentType = ct
+			}
+			ret = append(ret, f)
+		}
+	}
+	return ret, nil
+}
+
+// commonContentTypes are offered when changing the content type of an attachment.
+var commonContentTypes = []string{
+	"application/octet-stream",
+	"application/pdf",
+	"application/zip",
+	"image/jpeg",
+	"image/png",
+	"text/plain",
+	"text/html",
+	"text/csv",
+}
+
+// headerAttachments returns the files attached with `Attach:` pseudo-headers.
+func headerAttachments(msg string, contentTypes map[string]string) ([]*file, error) {
+	_, _, attach, err := cmdg.ParseUserMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return expandAttachPatterns(attach, contentTypes)
+}
+
+// changeContentType lets the user override the detected content type of an attachment.
+// Choices for files from `Attach:` headers are stored in `contentTypes`, since those
+// files are found anew when the message is sent.
+func changeContentType(attachments, headerFiles []*file, contentTypes map[string]string, keys *input.Input) error {
+	all := append(append([]*file{}, attachments...), headerFiles...)
+	var names []string
+	for _, a := range all {
+		names = append(names, fmt.Sprintf("%s (%s)", a.name, a.contentType))
+	}
+	which, err := dialog.Selection(dialog.Strings2Options(names), "Attachment> ", false, keys)
+	if err != nil {
+		return err
+	}
+	a := all[which.KeyInt]
+	ct, err := dialog.Selection(dialog.Strings2Options(commonContentTypes), fmt.Sprintf("Content type for %s> ", a.name), true, keys)
+	if err != nil {
+		return err
+	}
+	if _, _, err := mime.ParseMediaType(ct.Key); err != nil {
+		return errors.Wrapf(err, "invalid content type %q", ct.Key)
+	}
+	if ct.Key != a.contentType {
+		a.message = false
+	}
+	a.contentType = ct.Key
+	if which.KeyInt >= len(attachments) {
+		contentTypes[a.path] = ct.Key
+	}
+	return nil
 }
 
 func chooseFile(ctx context.Context, keys *input.Input) (*file, error) {
@@ -344,12 +711,6 @@ func chooseFile(ctx context.Context, keys *input.Input) (*file, error) {
 			continue
 		}
 		// File chosen.
-		full := path.Join(startDir, fis[o.KeyInt].Name())
-		// TODO: attach a ReadCloser?
-		b, err := ioutil.ReadFile(full)
-		return &file{
-			name:    fis[o.KeyInt].Name(),
-			content: b,
-		}, nil
+		return newFile(path.Join(startDir, fis[o.KeyInt].Name()))
 	}
 }
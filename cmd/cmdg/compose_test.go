@@ -2,13 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
 	"net/url"
+	"os"
+	"path"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -17,8 +25,10 @@ import (
 )
 
 // http handler for gmail send message commands.
+// Messages are uploaded as media, after a JSON metadata part.
 type fakeSend struct {
-	msg string
+	msg      string
+	threadID string
 }
 
 func (fs *fakeSend) bad(w http.ResponseWriter, f string, args ...interface{}) {
@@ -31,33 +41,52 @@ func (fs *fakeSend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fs.bad(w, "bad method. got %q, want %q", got, want)
 		return
 	}
-	if got, want := r.URL.String(), "/gmail/v1/users/me/messages/send?alt=json&prettyPrint=false"; got != want {
+	if got, want := r.URL.String(), "/upload/gmail/v1/users/me/messages/send?alt=json&prettyPrint=false&uploadType=multipart"; got != want {
 		fs.bad(w, "bad URL. got %q, want %q", got, want)
 		return
 	}
-	if err := r.ParseForm(); err != nil {
-		fs.bad(w, "failed to parse form: %v", err)
+	mt, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		fs.bad(w, "failed to parse content type: %v", err)
+		return
+	}
+	if got, want := mt, "multipart/related"; got != want {
+		fs.bad(w, "bad content type. got %q, want %q", got, want)
 		return
 	}
-	content, err := ioutil.ReadAll(r.Body)
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	// Metadata.
+	p, err := mr.NextPart()
 	if err != nil {
-		fs.bad(w, "failed to read body: %v", err)
+		fs.bad(w, "failed to read metadata part: %v", err)
 		return
 	}
-	type data struct {
-		Raw string `json:"raw"`
+	var meta struct {
+		ThreadID string `json:"threadId"`
 	}
-	var d data
-	if err := json.Unmarshal(content, &d); err != nil {
+	if err := json.NewDecoder(p).Decode(&meta); err != nil {
 		fs.bad(w, "failed to parse json: %v", err)
 		return
 	}
-	raw, err := cmdg.MIMEDecode(d.Raw)
+
+	// Message.
+	p, err = mr.NextPart()
+	if err != nil {
+		fs.bad(w, "failed to read message part: %v", err)
+		return
+	}
+	if got, want := p.Header.Get("Content-Type"), "message/rfc822"; got != want {
+		fs.bad(w, "bad message content type. got %q, want %q", got, want)
+		return
+	}
+	raw, err := ioutil.ReadAll(p)
 	if err != nil {
-		fs.bad(w, "failed to base64 decode %q: %v", d.Raw, err)
+		fs.bad(w, "failed to read message: %v", err)
 		return
 	}
 	fs.msg = string(raw)
+	fs.threadID = meta.ThreadID
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, `{ "id": "12345" }`)
 }
@@ -139,6 +168,15 @@ Content-Type: text/plain; charset="UTF-8"
 
 World
 --[a-z0-9]+--`)),
+		},
+		{
+			name:     "In thread",
+			msg:      "To: foo@bar.com\nSubject: hello\n\nWorld",
+			threadID: "thread123",
+			matching: regexp.MustCompile(crnl(`MIME-Version: 1.0
+Subject: hello
+To: foo@bar.com
+`)),
 		},
 		{
 			name: "Simple with CC",
@@ -222,7 +260,7 @@ World
 
 	for _, test := range tests {
 		ctx := context.Background()
-		err := sendMessage(ctx, c, test.msg, test.threadID, test.attachments)
+		err := sendMessage(ctx, c, test.msg, test.threadID, test.attachments, sendOptions{})
 		if test.bad && err == nil {
 			t.Errorf("%s: Expected bad, but err==nil", test.name)
 			continue
@@ -234,5 +272,362 @@ World
 		if test.matching != nil && !test.matching.MatchString(fs.msg) {
 			t.Errorf("%s: Did not match regex\n%s\n---\n%s", test.name, test.matching, fs.msg)
 		}
+		if got, want := fs.threadID, string(test.threadID); got != want {
+			t.Errorf("%s: Sent in thread %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+func TestPrepareAttachment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name        string
+		contents    string
+		contentType string
+		disposition string
+	}{
+		{
+			name:        "report.pdf",
+			contents:    "%PDF-1.4 blah",
+			contentType: `application/pdf; name=report.pdf`,
+			disposition: `attachment; filename=report.pdf`,
+		},
+		{
+			name:        "noext",
+			contents:    "\x89PNG\x0d\x0a\x1a\x0a blah",
+			contentType: `image/png; name=noext`,
+			disposition: `attachment; filename=noext`,
+		},
+		{
+			name:        "smörgås.bin",
+			contents:    strings.Repeat("x", 100),
+			contentType: `application/octet-stream; name*=utf-8''sm%C3%B6rg%C3%A5s.bin`,
+			disposition: `attachment; filename*=utf-8''sm%C3%B6rg%C3%A5s.bin`,
+		},
+	} {
+		fn := path.Join(dir, test.name)
+		if err := ioutil.WriteFile(fn, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := newFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prep, err := prepareMessage(context.Background(), "To: foo@bar.com\nSubject: hello\n\nWorld", []*file{f}, sendOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got, want := len(prep.parts), 2; got != want {
+			t.Fatalf("%s: got %d parts, want %d", test.name, got, want)
+		}
+		p := prep.parts[1]
+		if got, want := p.Header.Get("Content-Type"), test.contentType; got != want {
+			t.Errorf("%s: Content-Type got %q, want %q", test.name, got, want)
+		}
+		if got, want := p.Header.Get("Content-Disposition"), test.disposition; got != want {
+			t.Errorf("%s: Content-Disposition got %q, want %q", test.name, got, want)
+		}
+
+		entity, err := cmdg.MakeEntity(prep.mp, prep.parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := mail.ReadMessage(strings.NewReader(entity))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr := multipart.NewReader(m.Body, params["boundary"])
+		if _, err := mr.NextPart(); err != nil {
+			t.Fatal(err)
+		}
+		ap, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, ap))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), test.contents; got != want {
+			t.Errorf("%s: contents got %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+func TestAttachHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, fn := range []string{"a.txt", "b.txt", "c.pdf", "report [draft].pdf", "what?.txt"} {
+		if err := ioutil.WriteFile(path.Join(dir, fn), []byte("hello"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(path.Join(dir, "d.txt"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		msg   string
+		opts  sendOptions
+		names []string
+		types []string
+		bad   bool
+	}{
+		{
+			msg:   "To: foo@bar.com\nSubject: hello\n\nWorld",
+			names: nil,
+		},
+		{
+			msg:   fmt.Sprintf("To: foo@bar.com\nAttach: %s/*.txt\nSubject: hello\n\nWorld", dir),
+			names: []string{"a.txt", "b.txt", "what?.txt"},
+		},
+		{
+			msg:   fmt.Sprintf("To: foo@bar.com\nAttach: %s/c.pdf\nAttach: %s/a.txt\nSubject: hello\n\nWorld", dir, dir),
+			names: []string{"c.pdf", "a.txt"},
+			types: []string{"application/pdf", "text/plain"},
+		},
+		{
+			msg:   fmt.Sprintf("To: foo@bar.com\nAttach: %s/report [draft].pdf\nSubject: hello\n\nWorld", dir),
+			names: []string{"report [draft].pdf"},
+		},
+		{
+			msg:   fmt.Sprintf("To: foo@bar.com\nAttach: %s/what?.txt\nSubject: hello\n\nWorld", dir),
+			names: []string{"what?.txt"},
+		},
+		{
+			msg: fmt.Sprintf("To: foo@bar.com\nAttach: %s/c.pdf\nAttach: %s/a.txt\nSubject: hello\n\nWorld", dir, dir),
+			opts: sendOptions{contentTypes: map[string]string{
+				path.Join(dir, "a.txt"): "text/csv",
+			}},
+			names: []string{"c.pdf", "a.txt"},
+			types: []string{"application/pdf", "text/csv"},
+		},
+		{
+			msg: fmt.Sprintf("To: foo@bar.com\nAttach: %s/nonexisting\nSubject: hello\n\nWorld", dir),
+			bad: true,
+		},
+		{
+			msg: fmt.Sprintf("To: foo@bar.com\nAttach: %s/[unclosed\nSubject: hello\n\nWorld", dir),
+			bad: true,
+		},
+	} {
+		prep, err := prepareMessage(context.Background(), test.msg, nil, test.opts)
+		if test.bad {
+			if err == nil {
+				t.Errorf("%q: expected error", test.msg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", test.msg, err)
+		}
+		if _, found := prep.head[cmdg.AttachHeader]; found {
+			t.Errorf("%q: %s header not removed", test.msg, cmdg.AttachHeader)
+		}
+		var names, types []string
+		for _, p := range prep.parts[1:] {
+			_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, params["filename"])
+			ct, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			types = append(types, ct)
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%q: got attachments %q, want %q", test.msg, names, test.names)
+		}
+		if test.types != nil && !reflect.DeepEqual(types, test.types) {
+			t.Errorf("%q: got content types %q, want %q", test.msg, types, test.types)
+		}
+	}
+}
+
+func TestForwardAsAttachment(t *testing.T) {
+	orig := "From: foo@bar.com\r\nSubject: Receipt\r\n\r\nHello\r\n"
+	prep, err := prepareMessage(context.Background(), "To: baz@bar.com\nSubject: Fwd: Receipt\n\nSee attached.", []*file{
+		{
+			name:        "Receipt.eml",
+			contentType: "message/rfc822",
+			open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(orig)), nil
+			},
+			message: true,
+		},
+	}, sendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity, err := cmdg.MakeEntity(prep.mp, prep.parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := regexp.MustCompile(crnl(`
+Content-Disposition: attachment; filename=Receipt.eml
+Content-Transfer-Encoding: 8bit
+Content-Type: message/rfc822; name=Receipt.eml
+
+From: foo@bar.com
+Subject: Receipt
+
+Hello
+`))
+	if !want.MatchString(entity) {
+		t.Errorf("Did not match regex\n%s\n---\n%s", want, entity)
+	}
+}
+
+func TestMessageTypeNotMessage(t *testing.T) {
+	// A file that the user says is message/rfc822 isn't trusted to be 8bit safe.
+	prep, err := prepareMessage(context.Background(), "To: baz@bar.com\nSubject: hello\n\nWorld", []*file{
+		{
+			name:        "data.eml",
+			contentType: "message/rfc822",
+			open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader("\x00\xff")), nil
+			},
+		},
+	}, sendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity, err := cmdg.MakeEntity(prep.mp, prep.parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := regexp.MustCompile(crnl(`
+Content-Disposition: attachment; filename=data.eml
+Content-Transfer-Encoding: base64
+Content-Type: message/rfc822; name=data.eml
+
+AP8=
+`))
+	if !want.MatchString(entity) {
+		t.Errorf("Did not match regex\n%s\n---\n%s", want, entity)
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	body := "Hi *there*.\n\n> Quoted <tag>\n> > deeper\n\n```\nif a < b {\n```\n\n- one\n- two\n\n-- \nsig"
+	prep, err := prepareMessage(context.Background(), "To: foo@bar.com\nSubject: hello\n\n"+body, nil, sendOptions{markdown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity, err := cmdg.MakeEntity(prep.mp, prep.parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(strings.NewReader(entity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alt, err := multipart.NewReader(m.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params, err := mime.ParseMediaType(alt.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mt, "multipart/alternative"; got != want {
+		t.Fatalf("Content-Type got %q, want %q", got, want)
+	}
+
+	ar := multipart.NewReader(alt, params["boundary"])
+	text, err := ar.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := text.Header.Get("Content-Type"), `text/plain; charset="UTF-8"`; got != want {
+		t.Errorf("Text Content-Type got %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadAll(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), body; got != want {
+		t.Errorf("Text got %q, want %q", got, want)
+	}
+
+	h, err := ar.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.Header.Get("Content-Type"), `text/html; charset="UTF-8"`; got != want {
+		t.Errorf("HTML Content-Type got %q, want %q", got, want)
+	}
+	// Quoted-printable is transparently decoded by multipart.Reader, but line endings are CRLF.
+	b, err = ioutil.ReadAll(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := strings.Replace(string(b), "\r\n", "\n", -1)
+	for _, want := range []string{
+		"<p>Hi <em>there</em>.</p>",
+		"<p>Quoted &lt;tag&gt;</p>\n<blockquote",
+		"<p>deeper</p>\n</blockquote>\n</blockquote>",
+		"<pre><code>if a &lt; b {</code></pre>",
+		"<ul>\n<li>one</li>\n<li>two</li>\n</ul>",
+		`<div class="signature">-- <br>` + "\nsig</div>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML does not contain %q:\n%s", want, html)
+		}
+	}
+}
+
+func TestSendOptionsCheck(t *testing.T) {
+	for _, test := range []struct {
+		opts sendOptions
+		bad  bool
+	}{
+		{sendOptions{}, false},
+		{sendOptions{pgpEncrypt: true}, false},
+		{sendOptions{smimeSign: true, smimeEncrypt: true}, false},
+		{sendOptions{pgpEncrypt: true, markdown: true}, false},
+		{sendOptions{pgpEncrypt: true, smimeSign: true}, true},
+		{sendOptions{pgpEncrypt: true, smimeEncrypt: true}, true},
+	} {
+		if err := test.opts.check(); (err != nil) != test.bad {
+			t.Errorf("%+v: got err %v, want bad=%v", test.opts, err, test.bad)
+		}
+	}
+}
+
+func TestIsRecipient(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want bool
+	}{
+		{"foo@bar.com", true},
+		{"Foo Bar <foo@bar.com>", true},
+		{"me", true},
+		{"Me", true},
+		{"", false},
+		{"John", false},
+		{"John Sm", false},
+	} {
+		if got := isRecipient(test.in); got != test.want {
+			t.Errorf("isRecipient(%q) = %v, want %v", test.in, got, test.want)
+		}
 	}
 }
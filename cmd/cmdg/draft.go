@@ -73,12 +73,25 @@ func continueDraft(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) erro
 	}
 
 	prefill := strings.Join(headers, "\n") + "\n\n" + contents
-	var msg string
 
+	// Keep the edits in the journal until they're saved or sent.
+	j, err := newJournal()
+	if err != nil {
+		return errors.Wrap(err, "creating local copy of draft")
+	}
+	defer j.release()
+	return editDraft(ctx, conn, keys, j, draft, cmdg.ThreadID(draft.Response.Message.ThreadId), prefill)
+}
+
+// editDraft lets the user edit a draft in the journal, until it's saved, sent, or discarded.
+func editDraft(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, j *journal, draft *cmdg.Draft, threadID cmdg.ThreadID, prefill string) error {
 	for {
-		msg, err = getInput(ctx, prefill, keys)
+		msg, err := j.edit(ctx, prefill, keys)
 		if err != nil {
-			return err
+			return errors.Wrapf(err, "draft kept in %q", j.fn)
+		}
+		if err := j.save(threadID, draft.ID, nil); err != nil {
+			log.Errorf("Failed to save journal metadata: %v", err)
 		}
 
 		// Ask to send it.
@@ -100,29 +113,47 @@ func continueDraft(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) erro
 			prefill = msg
 			continue
 		case "^C", draftKeyAbort: // Abandon.
+			j.remove()
 			return nil
 		case draftKeyDelete:
 			if err := draft.Delete(ctx); err != nil {
-				return errors.Wrap(err, "deleting draft")
+				return errors.Wrapf(err, "deleting draft; edits kept in %q", j.fn)
 			}
+			j.remove()
 			return nil
-		case draftKeyDraft:
-			head, part, err := cmdg.ParseUserMessage(msg)
+		case draftKeyDraft, draftKeySend:
+			if a == draftKeySend {
+				if p := validateMessage(msg, nil, conn.Contacts()); !p.empty() {
+					send, err := confirmProblems(p, keys)
+					if err != nil {
+						return errors.Wrapf(err, "draft kept in %q", j.fn)
+					}
+					if !send {
+						// Back to the editor, to fix it.
+						prefill = msg
+						continue
+					}
+				}
+			}
+			head, part, _, err := cmdg.ParseUserMessage(msg)
 			if err != nil {
-				// TODO: ask to retry
-				return errors.Wrapf(err, "failed to parse that message")
+				if err := dialog.Message("Can't parse message", err.Error()+"\n\nPress [enter] to return to the editor", keys); err != nil {
+					return errors.Wrapf(err, "draft kept in %q", j.fn)
+				}
+				prefill = msg
+				continue
 			}
 
+			// Save the edits first, so that they're what's sent.
 			if err := draft.UpdateParts(ctx, head, []*cmdg.Part{part}); err != nil {
-				// TODO: allow option to save to local file.
-				return errors.Wrap(err, "updating draft")
+				return errors.Wrapf(err, "updating draft; edits kept in %q", j.fn)
 			}
-			return nil
-		case draftKeySend:
-			if err := draft.Send(ctx); err != nil {
-				// TODO: allow option to save to local file.
-				return errors.Wrap(err, "sending draft")
+			if a == draftKeySend {
+				if err := draft.Send(ctx); err != nil {
+					return errors.Wrapf(err, "sending draft; edits kept in %q", j.fn)
+				}
 			}
+			j.remove()
 			return nil
 		}
 	}
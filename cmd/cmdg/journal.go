@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+const (
+	journalTextExt = ".txt"
+	journalMetaExt = ".json"
+)
+
+var (
+	// Directory where messages being composed are kept until sent or saved.
+	// Set at startup.
+	draftsDir string
+)
+
+// journal is a local copy of a message being composed, kept until it's
+// sent or saved as a draft, so that it survives crashes and lost connections.
+//
+// The metadata file is locked while the message is being composed, so
+// that other cmdg instances can tell which journals are orphaned.
+type journal struct {
+	fn   string
+	meta string
+	lock *os.File
+}
+
+type journalMeta struct {
+	ThreadID cmdg.ThreadID
+	// DraftID is set when editing an existing Gmail draft.
+	DraftID     string
+	Attachments []string
+	Created     time.Time
+}
+
+// lockJournal opens and locks the metadata file. Fails if another process has it locked.
+func lockJournal(meta string) (*os.File, error) {
+	f, err := os.OpenFile(meta, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %q", meta)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "locking %q", meta)
+	}
+	return f, nil
+}
+
+func newJournal() (*journal, error) {
+	if err := os.MkdirAll(draftsDir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "creating drafts directory %q", draftsDir)
+	}
+	f, err := ioutil.TempFile(draftsDir, time.Now().Format("20060102-150405")+"-*"+journalTextExt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating journal in %q", draftsDir)
+	}
+	if err := f.Close(); err != nil {
+		return nil, errors.Wrapf(err, "closing %q", f.Name())
+	}
+	j := &journal{
+		fn:   f.Name(),
+		meta: strings.TrimSuffix(f.Name(), journalTextExt) + journalMetaExt,
+	}
+	j.lock, err = lockJournal(j.meta)
+	if err != nil {
+		os.Remove(j.fn)
+		return nil, err
+	}
+	return j, nil
+}
+
+// save writes the metadata of the message. draftID is empty for new messages.
+func (j *journal) save(threadID cmdg.ThreadID, draftID string, attachments []*file) error {
+	m := journalMeta{
+		ThreadID: threadID,
+		DraftID:  draftID,
+		Created:  time.Now(),
+	}
+	for _, a := range attachments {
+		if a.path == "" {
+			log.Warningf("Attachment %q is not a local file, and won't be recoverable from the journal", a.name)
+			continue
+		}
+		m.Attachments = append(m.Attachments, a.path)
+	}
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+	// Write through the locked file, so the lock stays valid.
+	if err := j.lock.Truncate(0); err != nil {
+		return errors.Wrapf(err, "truncating %q", j.meta)
+	}
+	if _, err := j.lock.WriteAt(b, 0); err != nil {
+		return errors.Wrapf(err, "writing %q", j.meta)
+	}
+	return j.lock.Sync()
+}
+
+// load reads the message and metadata.
+func (j *journal) load() (string, *journalMeta, error) {
+	b, err := ioutil.ReadFile(j.fn)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "reading %q", j.fn)
+	}
+	mb, err := ioutil.ReadFile(j.meta)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "reading %q", j.meta)
+	}
+	var m journalMeta
+	if len(mb) > 0 {
+		if err := json.Unmarshal(mb, &m); err != nil {
+			return "", nil, errors.Wrapf(err, "parsing %q", j.meta)
+		}
+	}
+	return string(b), &m, nil
+}
+
+// edit writes the message to the journal, and lets the user edit it there.
+func (j *journal) edit(ctx context.Context, msg string, keys *input.Input) (string, error) {
+	if err := ioutil.WriteFile(j.fn, []byte(msg), 0600); err != nil {
+		return "", errors.Wrapf(err, "writing journal %q", j.fn)
+	}
+	return editFile(ctx, j.fn, keys)
+}
+
+// remove deletes the journal, after the message is sent, saved, or discarded.
+func (j *journal) remove() {
+	for _, fn := range []string{j.fn, j.meta} {
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to remove journal file %q: %v", fn, err)
+		}
+	}
+	j.release()
+}
+
+// release unlocks the journal, leaving it on disk.
+func (j *journal) release() {
+	if j.lock == nil {
+		return
+	}
+	if err := j.lock.Close(); err != nil {
+		log.Errorf("Failed to close journal %q: %v", j.meta, err)
+	}
+	j.lock = nil
+}
+
+// orphanedJournals returns journals not in use by any running cmdg. They are returned locked.
+// Metadata left without a message is deleted.
+func orphanedJournals() ([]*journal, error) {
+	ms, err := filepath.Glob(filepath.Join(draftsDir, "*"+journalMetaExt))
+	if err != nil {
+		return nil, err
+	}
+	var ret []*journal
+	for _, meta := range ms {
+		l, err := lockJournal(meta)
+		if err != nil {
+			log.Infof("Journal %q in use: %v", meta, err)
+			continue
+		}
+		j := &journal{
+			fn:   strings.TrimSuffix(meta, journalMetaExt) + journalTextExt,
+			meta: meta,
+			lock: l,
+		}
+		if _, err := os.Stat(j.fn); os.IsNotExist(err) {
+			log.Infof("Removing journal metadata %q without message", meta)
+			j.remove()
+			continue
+		}
+		ret = append(ret, j)
+	}
+	return ret, nil
+}
+
+// recoverJournals offers to recover messages that were being composed when cmdg last died.
+func recoverJournals(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
+	js, err := orphanedJournals()
+	if err != nil {
+		return err
+	}
+	if len(js) == 0 {
+		return nil
+	}
+	defer func() {
+		for _, j := range js {
+			j.release()
+		}
+	}()
+	a, err := dialog.Question(fmt.Sprintf("Found %d unsent message(s) from earlier sessions in %s", len(js), draftsDir), []dialog.Option{
+		{Key: "r", Label: "r — Recover them, one at a time"},
+		{Key: "l", Label: "l — Later; keep them for next time"},
+		{Key: "D", Label: "D — Delete them"},
+	}, keys)
+	if err != nil {
+		return err
+	}
+	switch a {
+	case "r":
+		for _, j := range js {
+			msg, meta, err := j.load()
+			if err != nil {
+				log.Errorf("Failed to load journal: %v", err)
+				continue
+			}
+			var atts []*file
+			for _, fn := range meta.Attachments {
+				f, err := newFile(fn)
+				if err != nil {
+					log.Errorf("Failed to re-attach %q: %v", fn, err)
+					continue
+				}
+				atts = append(atts, f)
+			}
+			if meta.DraftID != "" {
+				if err := editDraft(ctx, conn, keys, j, cmdg.NewDraft(conn, meta.DraftID), meta.ThreadID, msg); err != nil {
+					log.Errorf("Failed to edit recovered draft %q: %v", j.fn, err)
+				}
+				continue
+			}
+			if _, err := composeJournaled(ctx, conn, keys, j, meta.ThreadID, msg, atts, nil); err != nil {
+				log.Errorf("Failed to compose recovered message %q: %v", j.fn, err)
+			}
+		}
+	case "D":
+		for _, j := range js {
+			j.remove()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	draftsDir = dir
+	defer func() { draftsDir = "" }()
+
+	j, err := newJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(j.fn, []byte("To: foo@bar.com\n\nhello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.save("thread1", "draft1", []*file{{name: "a.pdf", path: "/tmp/a.pdf"}, {name: "fwd.eml"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// In use, so not orphaned.
+	js, err := orphanedJournals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(js) != 0 {
+		t.Fatalf("Got %d orphaned journals while in use, want 0", len(js))
+	}
+
+	// Released, so orphaned.
+	j.release()
+	js, err = orphanedJournals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(js) != 1 {
+		t.Fatalf("Got %d orphaned journals, want 1", len(js))
+	}
+	msg, meta, err := js[0].load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg, "To: foo@bar.com\n\nhello"; got != want {
+		t.Errorf("Got message %q, want %q", got, want)
+	}
+	if got, want := meta.ThreadID, cmdg.ThreadID("thread1"); got != want {
+		t.Errorf("Got thread %q, want %q", got, want)
+	}
+	if got, want := meta.DraftID, "draft1"; got != want {
+		t.Errorf("Got draft %q, want %q", got, want)
+	}
+	if got, want := meta.Attachments, []string{"/tmp/a.pdf"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got attachments %q, want %q", got, want)
+	}
+
+	// Removed.
+	js[0].remove()
+	js, err = orphanedJournals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(js) != 0 {
+		t.Fatalf("Got %d orphaned journals after removal, want 0", len(js))
+	}
+
+	// Metadata without message is cleaned up.
+	meta2 := path.Join(dir, "20200101-000000-1"+journalMetaExt)
+	if err := ioutil.WriteFile(meta2, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	js, err = orphanedJournals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(js) != 0 {
+		t.Fatalf("Got %d orphaned journals for metadata without message, want 0", len(js))
+	}
+	if _, err := os.Stat(meta2); !os.IsNotExist(err) {
+		t.Errorf("Metadata without message not removed: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+// Keymap views.
+const (
+	viewMessageList = "list"
+	viewMessage     = "message"
+	viewAttachments = "attachments"
+	viewCompose     = "compose"
+
+	// mouseHandled is the action for mouse events that don't map to a keymap action.
+	mouseHandled = "<mouse>"
+)
+
+var (
+	keymapPreset = flag.String("keymap", "default", "Key binding preset: "+strings.Join(keymapPresetNames(), ", ")+". Adjusted by -keymap_file.")
+	mouseFlag    = flag.Bool("mouse", false, "Enable mouse. Click to select, double click to open, and use the wheel to scroll.")
+	keymapFile   = flag.String("keymap_file", "", "File with key bindings, applied on top of the preset. Default is ~/"+path.Join(defaultConfigDir, keymapFileName))
+
+	// Actions in each view, in the order they're shown in help texts, with their default keys.
+	viewBindings = map[string][]input.Binding{
+		viewMessageList: {
+			{Action: "help", Help: "Help", Keys: []string{"?", input.F1}},
+			{Action: "open", Help: "Open message", Keys: []string{input.Enter}},
+			{Action: "mark-next", Help: "Mark message and advance", Keys: []string{" ", "x"}},
+			{Action: "mark-prev", Help: "Mark message and step up", Keys: []string{"X"}},
+			{Action: "archive", Help: "Archive marked messages", Keys: []string{"e"}},
+			{Action: "trash", Help: "Move marked messages to trash", Keys: []string{"d"}},
+			{Action: "label", Help: "Label marked messages", Keys: []string{"l"}},
+			{Action: "unlabel", Help: "Unlabel marked messages", Keys: []string{"L"}},
+			{Action: "star", Help: "Toggle starred on hilighted message", Keys: []string{"*"}},
+			{Action: "compose", Help: "Compose new message", Keys: []string{"c"}},
+			{Action: "continue-draft", Help: "Continue message from draft", Keys: []string{"C"}},
+			{Action: "next", Help: "Next message", Keys: []string{"N", "n", input.CtrlN, "j", input.Down}},
+			{Action: "prev", Help: "Previous message", Keys: []string{"P", "p", input.CtrlP, "k", input.Up}},
+			{Action: "first", Help: "First message", Keys: []string{input.Home}},
+			{Action: "last", Help: "Last loaded message", Keys: []string{input.End}},
+			{Action: "reload", Help: "Reload current view", Keys: []string{"r", input.CtrlR}},
+			{Action: "goto-label", Help: "Go to label", Keys: []string{"g"}},
+			{Action: "inbox", Help: "Go to inbox", Keys: []string{"1"}},
+			{Action: "search", Help: "Search", Keys: []string{"s", input.CtrlS}},
+			{Action: "quit", Help: "Quit", Keys: []string{"q"}},
+			{Action: "redraw", Help: "Refresh screen", Keys: []string{input.CtrlL}},
+		},
+		viewMessage: {
+			{Action: "help", Help: "Help", Keys: []string{"?", input.F1}},
+			{Action: "label", Help: "Add label", Keys: []string{"l"}},
+			{Action: "unlabel", Help: "Remove label", Keys: []string{"L"}},
+			{Action: "star", Help: `Toggle "starred"`, Keys: []string{"*"}},
+			{Action: "close", Help: "Exit message", Keys: []string{"u"}},
+			{Action: "mark-unread", Help: "Mark unread", Keys: []string{"U"}},
+			{Action: "scroll-down", Help: "Scroll down", Keys: []string{"n", input.Down}},
+			{Action: "page-down", Help: "Page down", Keys: []string{" ", input.CtrlV, input.PgDown}},
+			{Action: "page-up", Help: "Page up", Keys: []string{input.Backspace, input.CtrlH, input.PgUp, "Meta-v"}},
+			{Action: "scroll-up", Help: "Scroll up", Keys: []string{"p", input.Up}},
+			{Action: "top", Help: "Go to top", Keys: []string{input.Home}},
+			{Action: "bottom", Help: "Go to bottom", Keys: []string{input.End}},
+			{Action: "wrap", Help: "Toggle wrapping long lines, or scrolling sideways", Keys: []string{"w"}},
+			{Action: "scroll-left", Help: "Scroll left, if not wrapping", Keys: []string{input.Left}},
+			{Action: "scroll-right", Help: "Scroll right, if not wrapping", Keys: []string{input.Right}},
+			{Action: "prev-message", Help: "Previous message", Keys: []string{input.CtrlP}},
+			{Action: "next-message", Help: "Next message", Keys: []string{input.CtrlN}},
+			{Action: "forward", Help: "Forward message", Keys: []string{"f"}},
+			{Action: "forward-as", Help: "Forward with attachments, or as attachment", Keys: []string{"F"}},
+			{Action: "reply", Help: "Reply; can archive the message or thread once sent", Keys: []string{"r"}},
+			{Action: "select", Help: "Start/end selection at top line, or clear it. Replies quote only the selection", Keys: []string{"v"}},
+			{Action: "search", Help: "Search within message", Keys: []string{"s", input.CtrlS}},
+			{Action: "reply-all", Help: "Reply all; can archive the message or thread once sent", Keys: []string{"a"}},
+			{Action: "archive", Help: "Archive", Keys: []string{"e"}},
+			{Action: "attachments", Help: "Browse attachments (if any)", Keys: []string{"t"}},
+			{Action: "html", Help: "Force HTML view", Keys: []string{"H"}},
+			{Action: "raw", Help: "Show raw message source", Keys: []string{`\`}},
+			{Action: "pipe", Help: "Pipe to command", Keys: []string{"|"}},
+			{Action: "reload", Help: "Reload message", Keys: []string{input.CtrlR}},
+			{Action: "quit", Help: "Quit", Keys: []string{"q"}},
+		},
+		viewAttachments: {
+			{Action: "mark", Help: "mark", Keys: []string{" ", "x"}},
+			{Action: "mark-all", Help: "mark all", Keys: []string{"*"}},
+			{Action: "save", Help: "save", Keys: []string{"s"}},
+			{Action: "save-all", Help: "save all", Keys: []string{"S"}},
+			{Action: "open", Help: "open", Keys: []string{"o", input.Enter}},
+			{Action: "back", Help: "back", Keys: []string{"q", "<", input.CtrlC}},
+			{Action: "next", Help: "next", Keys: []string{"n", "j", input.CtrlN, input.Down}},
+			{Action: "prev", Help: "previous", Keys: []string{"p", "k", input.CtrlP, input.Up}},
+		},
+		viewCompose: {
+			{Action: "send", Help: "Send", Keys: []string{"s"}},
+			{Action: "send-archive", Help: "Send and archive message", Keys: []string{"S"}},
+			{Action: "send-archive-thread", Help: "Send and archive whole thread", Keys: []string{"T"}},
+			{Action: "draft", Help: "Save as draft", Keys: []string{"d"}},
+			{Action: "abort", Help: "Abort, discarding draft", Keys: []string{"a"}},
+			{Action: "attach", Help: "Attach file(s)", Keys: []string{"t"}},
+			{Action: "content-type", Help: "Change content type of attachment", Keys: []string{"c"}},
+			{Action: "edit", Help: "Return to editor", Keys: []string{"r"}},
+			{Action: "smime-sign", Help: "Toggle S/MIME signing", Keys: []string{"m"}},
+			{Action: "smime-encrypt", Help: "Toggle S/MIME encryption", Keys: []string{"M"}},
+			{Action: "encrypt", Help: "Toggle GPG encryption", Keys: []string{"E"}},
+			{Action: "markdown", Help: "Toggle sending Markdown as HTML too", Keys: []string{"H"}},
+		},
+		dialog.SelectionView: dialog.SelectionBindings,
+	}
+
+	// keymapPresets are changes to the default bindings. An empty action unbinds the key.
+	keymapPresets = map[string][]presetBinding{
+		"default": nil,
+		"vi": {
+			{viewMessageList, "G", "last"},
+			{viewMessageList, "/", "search"},
+			{viewMessage, "j", "scroll-down"},
+			{viewMessage, "k", "scroll-up"},
+			{viewMessage, input.CtrlF, "page-down"},
+			{viewMessage, input.CtrlB, "page-up"},
+			{viewMessage, "g", "top"},
+			{viewMessage, "G", "bottom"},
+			{viewMessage, "/", "search"},
+		},
+		"emacs": {
+			{viewMessageList, "Meta-<", "first"},
+			{viewMessageList, "Meta->", "last"},
+			{viewMessage, input.CtrlN, "scroll-down"},
+			{viewMessage, input.CtrlP, "scroll-up"},
+			{viewMessage, "Meta-n", "next-message"},
+			{viewMessage, "Meta-p", "prev-message"},
+			{viewMessage, "Meta-<", "top"},
+			{viewMessage, "Meta->", "bottom"},
+			{viewAttachments, input.CtrlG, "back"},
+			{dialog.SelectionView, input.CtrlG, "abort"},
+		},
+	}
+)
+
+type presetBinding struct {
+	view, key, action string
+}
+
+func keymapPresetNames() []string {
+	var ret []string
+	for n := range keymapPresets {
+		ret = append(ret, n)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// loadKeymap builds the keymap from defaults, the chosen preset, and the keymap file.
+func loadKeymap(preset, fn string, mustExist bool) (*input.Keymap, error) {
+	pbs, ok := keymapPresets[preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown keymap preset %q, valid presets are %s", preset, strings.Join(keymapPresetNames(), ", "))
+	}
+	k := input.NewKeymap()
+	for view, bs := range viewBindings {
+		k.BindAll(view, bs)
+	}
+	for _, b := range pbs {
+		if b.action == "" {
+			k.Unbind(b.view, b.key)
+		} else {
+			k.Bind(b.view, b.key, b.action)
+		}
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) && !mustExist {
+		return k, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "opening keymap file %q", fn)
+	}
+	defer f.Close()
+	if err := k.Load(f, viewBindings); err != nil {
+		return nil, errors.Wrapf(err, "keymap file %q", fn)
+	}
+	return k, nil
+}
+
+// keymapFilePath returns the keymap file to load, and if it's required to exist.
+func keymapFilePath() (string, bool) {
+	if *keymapFile != "" {
+		return *keymapFile, true
+	}
+	return path.Join(os.Getenv("HOME"), defaultConfigDir, keymapFileName), false
+}
+
+// viewHelp returns the help text for a view, generated from the active key bindings.
+func viewHelp(keys *input.Input, view string) string {
+	return keys.Keymap().Help(view, viewBindings[view]) + "\n\nPress [enter] to exit\n"
+}
+
+// keyLabel returns the name of the first key bound to the action, or "" if unbound.
+func keyLabel(keys *input.Input, view, action string) string {
+	ks := keys.Keymap().Keys(view, action)
+	if len(ks) == 0 {
+		return ""
+	}
+	return input.KeyName(ks[0])
+}
+
+// actionOption creates a dialog option for the action, using the first key bound to it.
+// Returns false if no key is bound.
+func actionOption(keys *input.Input, view, action, label string) (dialog.Option, bool) {
+	ks := keys.Keymap().Keys(view, action)
+	if len(ks) == 0 {
+		return dialog.Option{}, false
+	}
+	return dialog.Option{
+		Key:   ks[0],
+		Label: fmt.Sprintf("%s — %s", input.KeyName(ks[0]), label),
+	}, true
+}
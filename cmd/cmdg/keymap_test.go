@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+func TestKeymapPresets(t *testing.T) {
+	for name, pbs := range keymapPresets {
+		for _, b := range pbs {
+			found := b.action == ""
+			for _, vb := range viewBindings[b.view] {
+				if vb.Action == b.action {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Preset %q binds %q to unknown action %q in view %q", name, input.KeyName(b.key), b.action, b.view)
+			}
+		}
+		if _, err := loadKeymap(name, "/nonexistent", false); err != nil {
+			t.Errorf("Loading preset %q: %v", name, err)
+		}
+	}
+	if _, err := loadKeymap("nonexistent", "/nonexistent", false); err == nil {
+		t.Errorf("Loading unknown preset succeeded")
+	}
+	if _, err := loadKeymap("default", "/nonexistent", true); err == nil {
+		t.Errorf("Loading missing required keymap file succeeded")
+	}
+}
+
+func TestLoadKeymapFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-keymap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "keymap.conf")
+	if err := ioutil.WriteFile(fn, []byte("bind list z archive\nunbind message n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := loadKeymap("vi", fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		view, key, want string
+	}{
+		{viewMessageList, "z", "archive"},
+		{viewMessageList, "e", "archive"},
+		{viewMessageList, "G", "last"},
+		{viewMessage, "n", ""},
+		{viewMessage, "j", "scroll-down"},
+	} {
+		if got := k.Action(test.view, test.key); got != test.want {
+			t.Errorf("%s %q: got %q, want %q", test.view, test.key, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	runewidth "github.com/mattn/go-runewidth"
+)
+
+const (
+	// Same layout as before the format was configurable.
+	defaultListFormat = "%C%M%U%S%6.6d | %20.20F | %s%?L? | %L?"
+)
+
+var (
+	listFormatFlag = flag.String("list_format", defaultListFormat, "Format of lines in the message list. %[-][width][.max]X is field X, %?X?text? is text if field X is not blank, %% is %. Fields:\n"+listFormatHelp())
+
+	// Parsed from -list_format at startup.
+	messageListFormat listFormat
+
+	// Shown until the message has loaded.
+	loadingListFormat = listFormat{
+		{field: 'C', max: -1},
+		{field: 'M', max: -1},
+		{field: 'U', max: -1},
+		{field: 'S', max: -1},
+		{literal: "Loading…"},
+	}
+)
+
+// listFormatFields are the fields that can be used in the message list format.
+var listFormatFields = map[byte]string{
+	'C': "cursor ('*' on the current message)",
+	'M': "marked ('X' if marked)",
+	'U': "unread ('>' if unread)",
+	'S': "starred ('*' if starred)",
+	'd': "date; time if today, month and day if this year, else year",
+	'D': "date and time, e.g. 2020-05-14 10:11",
+	'r': "age, e.g. 5m, 3h, 2d",
+	'{': "date in Go time layout, e.g. %{Jan 2 15:04}",
+	'F': "sender name, or address if no name",
+	'A': "sender address",
+	't': "first recipient name or address, with … if there are more",
+	's': "subject",
+	'n': "number of listed messages in the thread, if more than one",
+	'a': "'@' if the message probably has attachments",
+	'z': "size estimate, e.g. 12.3 KiB",
+	'l': "label names",
+	'L': "label colors; shortened if the line doesn't fit",
+}
+
+// listFormatItem is a literal, a field, or a conditional.
+type listFormatItem struct {
+	literal string
+
+	field byte
+	arg   string // Layout for '{'.
+	left  bool   // Left align, instead of right.
+	width int    // Minimum width.
+	max   int    // Max width, or -1 for no limit.
+
+	// For `%?X?...?`, `cond` is rendered only if field X is not blank.
+	isCond bool
+	cond   listFormat
+}
+
+// listFormat is a parsed message list format, similar to mutt's index_format.
+type listFormat []listFormatItem
+
+// parseListFormat parses a format string like "%-20F %s".
+//
+// Each field is written %[-][width][.max]X, where X is the field.
+// %?X?text? shows `text` only if field X is not blank. %% is a percent sign.
+func parseListFormat(s string) (listFormat, error) {
+	f, rest, err := parseListFormatUntil(s, false)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q in list format", rest)
+	}
+	return f, nil
+}
+
+// parseListFormatUntil parses until the end, or until '?' if in a conditional.
+func parseListFormatUntil(s string, inCond bool) (listFormat, string, error) {
+	var ret listFormat
+	lit := ""
+	flush := func() {
+		if lit != "" {
+			ret = append(ret, listFormatItem{literal: lit})
+			lit = ""
+		}
+	}
+	for len(s) > 0 {
+		if inCond && s[0] == '?' {
+			flush()
+			return ret, s, nil
+		}
+		if s[0] != '%' {
+			lit += s[:1]
+			s = s[1:]
+			continue
+		}
+		s = s[1:]
+		if s == "" {
+			return nil, "", fmt.Errorf("list format ends with '%%'")
+		}
+		if s[0] == '%' {
+			lit += "%"
+			s = s[1:]
+			continue
+		}
+		flush()
+
+		if s[0] == '?' {
+			if inCond {
+				return nil, "", fmt.Errorf("nested conditionals not supported in list format")
+			}
+			if len(s) < 3 || s[2] != '?' {
+				return nil, "", fmt.Errorf("list format conditional should be %%?X?text?")
+			}
+			field := s[1]
+			if _, ok := listFormatFields[field]; !ok || field == '{' {
+				return nil, "", fmt.Errorf("unknown list format field %%%c", field)
+			}
+			cond, rest, err := parseListFormatUntil(s[3:], true)
+			if err != nil {
+				return nil, "", err
+			}
+			if rest == "" {
+				return nil, "", fmt.Errorf("unterminated list format conditional %%?%c?", field)
+			}
+			ret = append(ret, listFormatItem{field: field, isCond: true, cond: cond, max: -1})
+			s = rest[1:]
+			continue
+		}
+
+		it := listFormatItem{max: -1}
+		if s[0] == '-' {
+			it.left = true
+			s = s[1:]
+		}
+		var n int
+		n, s = parseListFormatNumber(s)
+		if n > 0 {
+			it.width = n
+		}
+		if strings.HasPrefix(s, ".") {
+			it.max, s = parseListFormatNumber(s[1:])
+			if it.max < 0 {
+				return nil, "", fmt.Errorf("list format: missing max width after '.'")
+			}
+		}
+		if s == "" {
+			return nil, "", fmt.Errorf("list format ends in the middle of a field")
+		}
+		it.field = s[0]
+		if _, ok := listFormatFields[it.field]; !ok {
+			return nil, "", fmt.Errorf("unknown list format field %%%c", it.field)
+		}
+		s = s[1:]
+		if it.field == '{' {
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return nil, "", fmt.Errorf("unterminated %%{ in list format")
+			}
+			it.arg = s[:end]
+			s = s[end+1:]
+		}
+		ret = append(ret, it)
+	}
+	if inCond {
+		return nil, "", nil
+	}
+	flush()
+	return ret, "", nil
+}
+
+// parseListFormatNumber parses leading digits, returning -1 if there are none.
+func parseListFormatNumber(s string) (int, string) {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	if n == 0 {
+		return -1, s
+	}
+	v, err := strconv.Atoi(s[:n])
+	if err != nil {
+		// Only digits, so it must be huge.
+		return -1, s
+	}
+	return v, s[n:]
+}
+
+// render expands the format. `get` returns the value of a field.
+func (f listFormat) render(get func(field byte, arg string) (string, error)) (string, error) {
+	var b strings.Builder
+	for _, it := range f {
+		if it.field == 0 {
+			b.WriteString(it.literal)
+			continue
+		}
+		v, err := get(it.field, it.arg)
+		if err != nil {
+			return "", err
+		}
+		if it.isCond {
+			if strings.TrimSpace(v) != "" {
+				s, err := it.cond.render(get)
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(s)
+			}
+			continue
+		}
+		if it.max >= 0 {
+			v = runewidth.Truncate(v, it.max, "")
+		}
+		if it.left {
+			v = runewidth.FillRight(v, it.width)
+		} else {
+			v = runewidth.FillLeft(v, it.width)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+// listFormatHelp describes the fields, for the -list_format flag.
+func listFormatHelp() string {
+	var ret []string
+	for _, c := range "CMUSdDr{FAtsnazlL" {
+		ret = append(ret, fmt.Sprintf("%%%c: %s", c, listFormatFields[byte(c)]))
+	}
+	return strings.Join(ret, "\n")
+}
+
+// shortAddress returns the name or address of the first address in the list.
+func shortAddress(s string) string {
+	as, err := mail.ParseAddressList(s)
+	if err != nil || len(as) == 0 {
+		return s
+	}
+	ret := as[0].Name
+	if ret == "" {
+		ret = as[0].Address
+	}
+	if len(as) > 1 {
+		ret += ", …"
+	}
+	return ret
+}
+
+// shortAge formats the time since `t` in the largest fitting unit.
+func shortAge(t time.Time, now time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d/time.Hour))
+	case d < 14*24*time.Hour:
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	case d < 365*24*time.Hour:
+		return fmt.Sprintf("%dw", int(d/(7*24*time.Hour)))
+	}
+	return fmt.Sprintf("%dy", int(d/(365*24*time.Hour)))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListFormat(t *testing.T) {
+	fields := map[byte]string{
+		'C': "*",
+		'M': " ",
+		'd': "Jan 02",
+		'F': "Some Body",
+		's': "Hello",
+		'L': "",
+		'l': "work, later",
+		'n': "3",
+	}
+	get := func(field byte, arg string) (string, error) {
+		if field == '{' {
+			return "layout:" + arg, nil
+		}
+		return fields[field], nil
+	}
+	for _, test := range []struct {
+		format string
+		out    string
+	}{
+		{defaultListFormat, "* Jan 02 |            Some Body | Hello"},
+		{"%-12F|", "Some Body   |"},
+		{"%12F|", "   Some Body|"},
+		{"%.4F|%-6.2s|", "Some|He    |"},
+		{"%s%?n? (%n)?%?L? [%L]?", "Hello (3)"},
+		{"%?M?marked?%?C?current?", "current"},
+		{"100%% %{Jan 2}", "100% layout:Jan 2"},
+		{"%s — %l", "Hello — work, later"},
+	} {
+		f, err := parseListFormat(test.format)
+		if err != nil {
+			t.Errorf("%q: %v", test.format, err)
+			continue
+		}
+		got, err := f.render(get)
+		if err != nil {
+			t.Errorf("%q: %v", test.format, err)
+			continue
+		}
+		if got != test.out {
+			t.Errorf("%q: got %q, want %q", test.format, got, test.out)
+		}
+	}
+}
+
+func TestListFormatErrors(t *testing.T) {
+	for _, format := range []string{
+		"%",
+		"%Q",
+		"%-",
+		"%5.",
+		"%.x",
+		"%{Jan",
+		"%?s?subject",
+		"%?s",
+		"%?s?%?n??",
+		"%?{?x?",
+	} {
+		if _, err := parseListFormat(format); err == nil {
+			t.Errorf("%q: expected error", format)
+		}
+	}
+}
+
+func TestShortAge(t *testing.T) {
+	now := time.Date(2020, 5, 14, 10, 11, 12, 0, time.UTC)
+	for _, test := range []struct {
+		d   time.Duration
+		out string
+	}{
+		{10 * time.Second, "now"},
+		{5 * time.Minute, "5m"},
+		{3 * time.Hour, "3h"},
+		{50 * time.Hour, "2d"},
+		{30 * 24 * time.Hour, "4w"},
+		{800 * 24 * time.Hour, "2y"},
+	} {
+		if got := shortAge(now.Add(-test.d), now); got != test.out {
+			t.Errorf("%v: got %q, want %q", test.d, got, test.out)
+		}
+	}
+}
@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/ThomasHabets/cmdg/pkg/cmdg"
 	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/display"
 	"github.com/ThomasHabets/cmdg/pkg/input"
 )
 
@@ -23,6 +30,13 @@ var (
 	replyPrefixes   = regexp.MustCompile(`(?i)^(Re|Sv|Aw): `)
 	forwardPrefixes = regexp.MustCompile(`(?i)^(Fwd): `)
 	removeCharsRE   = regexp.MustCompile(`\r`)
+
+	replyAttribution = flag.String("reply_attribution", "On %D, %F said:", "Line introducing the quote in replies. %D is date, %F is From, %N is sender name, %A is sender address, %S is subject.")
+	replyQuoteDepth  = flag.Int("reply_quote_depth", 2, "In replies, collapse quotes nested deeper than this. 0 to never collapse.")
+	replyWidth       = flag.Int("reply_width", 72, "Width to wrap quoted format=flowed paragraphs to.")
+
+	// Characters not to use in the filename of a forwarded message.
+	unsafeFilenameRE = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]+`)
 )
 
 func replyQuoted(s string) string {
@@ -34,24 +48,156 @@ func replyQuoted(s string) string {
 	return strings.Join(ret, "\n")
 }
 
+// normalizeNewlines turns CRLF and lone CR line endings into LF.
+func normalizeNewlines(s string) string {
+	return removeCharsRE.ReplaceAllString(strings.Replace(s, "\r\n", "\n", -1), "\n")
+}
+
+// stripSignature removes the signature block, if any.
+// Line endings must already be normalized.
+func stripSignature(s string) string {
+	lines := strings.Split(s, "\n")
+	for n := len(lines) - 1; n >= 0; n-- {
+		if lines[n] == "-- " {
+			return strings.TrimRight(strings.Join(lines[:n], "\n"), "\n")
+		}
+	}
+	return s
+}
+
+// quoteDepth returns how many levels of quoting a line has, and the line without them.
+func quoteDepth(l string) (int, string) {
+	depth := 0
+	rest := l
+	for {
+		t := strings.TrimLeft(rest, " ")
+		if !strings.HasPrefix(t, ">") {
+			return depth, rest
+		}
+		depth++
+		rest = strings.TrimPrefix(t[1:], " ")
+	}
+}
+
+// collapseQuotes replaces runs of lines quoted deeper than `maxDepth` with a single marker line.
+func collapseQuotes(s string, maxDepth int) string {
+	if maxDepth <= 0 {
+		return s
+	}
+	var ret []string
+	collapsed := false
+	for _, l := range strings.Split(s, "\n") {
+		if d, _ := quoteDepth(l); d > maxDepth {
+			if !collapsed {
+				ret = append(ret, strings.Repeat("> ", maxDepth+1)+"[…]")
+				collapsed = true
+			}
+			continue
+		}
+		collapsed = false
+		ret = append(ret, l)
+	}
+	return strings.Join(ret, "\n")
+}
+
+// wrapQuoted wraps lines to `width` on word boundaries, keeping their quote prefix.
+// Used for format=flowed paragraphs, which have been joined into one line.
+func wrapQuoted(s string, width int) string {
+	var ret []string
+	for _, l := range strings.Split(s, "\n") {
+		depth, rest := quoteDepth(l)
+		prefix := strings.Repeat("> ", depth)
+		// Leave room for the quote we're about to add.
+		w := width - len(prefix) - 2
+		cur := ""
+		for _, word := range strings.Split(rest, " ") {
+			if cur != "" && display.StringWidth(cur)+1+display.StringWidth(word) > w {
+				ret = append(ret, prefix+cur)
+				cur = word
+				continue
+			}
+			if cur == "" {
+				cur = word
+			} else {
+				cur += " " + word
+			}
+		}
+		ret = append(ret, strings.TrimRight(prefix+cur, spaces))
+	}
+	return strings.Join(ret, "\n")
+}
+
+// quoteForReply turns the body into the quoted part of a reply.
+func quoteForReply(body string, flowed bool) string {
+	body = normalizeNewlines(body)
+	body = stripSignature(body)
+	body = collapseQuotes(body, *replyQuoteDepth)
+	if flowed {
+		body = wrapQuoted(body, *replyWidth)
+	}
+	return replyQuoted(body)
+}
+
+// attribution formats the line introducing the quote.
+//   %D: date
+//   %F: From header
+//   %N: name of sender, or address if no name
+//   %A: address of sender
+//   %S: subject
+//   %%: a percent sign
+func attribution(format string, date time.Time, from, subject string) string {
+	name, addr := from, from
+	if a, err := mail.ParseAddress(from); err == nil {
+		addr = a.Address
+		name = a.Name
+		if name == "" {
+			name = a.Address
+		}
+	}
+	var ret []string
+	for n := 0; n < len(format); n++ {
+		if format[n] != '%' || n == len(format)-1 {
+			ret = append(ret, format[n:n+1])
+			continue
+		}
+		n++
+		switch format[n] {
+		case 'D':
+			ret = append(ret, date.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+		case 'F':
+			ret = append(ret, from)
+		case 'N':
+			ret = append(ret, name)
+		case 'A':
+			ret = append(ret, addr)
+		case 'S':
+			ret = append(ret, subject)
+		case '%':
+			ret = append(ret, "%")
+		default:
+			ret = append(ret, format[n-1:n+1])
+		}
+	}
+	return strings.Join(ret, "")
+}
+
 // Args:
 //   msg: Message to reply or forward.
-func replyOrForward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to, cc, subjPrefix string, rmPrefix *regexp.Regexp, msg *cmdg.Message) error {
-	b, err := msg.GetUnpatchedBody(ctx)
-	if err != nil {
-		return err
-	}
+//   quoted: Already quoted body of the message.
+//   attachments: Files to attach.
+//   archive: If not nil, offer to archive after sending.
+func replyOrForward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to, cc, subjPrefix string, rmPrefix *regexp.Regexp, msg *cmdg.Message, quoted string, attachments []*file, archive archiver) (*MessageViewOp, error) {
 	subj, err := msg.GetHeader(ctx, "Subject")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	date, err := msg.GetTime(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	orig, err := msg.GetHeader(ctx, "From")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	headers := []string{
 		fmt.Sprintf("To: %s", to),
@@ -62,8 +208,8 @@ func replyOrForward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to,
 
 	headers = append(headers, fmt.Sprintf("Subject: %s%s", subjPrefix, rmPrefix.ReplaceAllString(subj, "")))
 	body := []string{
-		fmt.Sprintf("On %s, %s said:", date.Format("Mon, 2 Jan 2006 15:04:05 -0700"), orig),
-		replyQuoted(b),
+		attribution(*replyAttribution, date, orig, subj),
+		quoted,
 	}
 	if signature != "" {
 		body = append(body, "\n--\n"+signature+"\n")
@@ -71,45 +217,222 @@ func replyOrForward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to,
 
 	threadID, err := msg.ThreadID(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	prefill := strings.Join(headers, "\n") + "\n\n" + strings.Join(body, "\n")
-	return compose(ctx, conn, keys, threadID, prefill)
+	return compose(ctx, conn, keys, threadID, prefill, attachments, archive)
+}
+
+// replyArchiver archives the message replied to, or its thread.
+func replyArchiver(conn *cmdg.CmdG, msg *cmdg.Message) archiver {
+	return func(ctx context.Context, thread bool) (*MessageViewOp, error) {
+		if !thread {
+			if err := msg.RemoveLabelID(ctx, cmdg.Inbox); err != nil {
+				return nil, err
+			}
+			return OpRemoveCurrent(nil), nil
+		}
+		threadID, err := msg.ThreadID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.ArchiveThread(ctx, threadID); err != nil {
+			return nil, errors.Wrapf(err, "archiving thread %q", threadID)
+		}
+		msg.RemoveLabelIDLocal(cmdg.Inbox)
+		return OpRemoveThread(threadID, nil), nil
+	}
+}
+
+// replyBody returns the quoted text for a reply. If `selection` is
+// not empty, then only that is quoted.
+func replyBody(ctx context.Context, msg *cmdg.Message, selection string) (string, error) {
+	if selection != "" {
+		return replyQuoted(selection), nil
+	}
+	b, flowed, err := msg.GetQuotableBody(ctx)
+	if err != nil {
+		return "", err
+	}
+	return quoteForReply(b, flowed), nil
 }
 
-func reply(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg.Message) error {
+func reply(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg.Message, selection string) (*MessageViewOp, error) {
 	to, err := msg.GetReplyTo(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	quoted, err := replyBody(ctx, msg, selection)
+	if err != nil {
+		return nil, err
 	}
-	return replyOrForward(ctx, conn, keys, to, "", replyPrefix, replyPrefixes, msg)
+	return replyOrForward(ctx, conn, keys, to, "", replyPrefix, replyPrefixes, msg, quoted, nil, replyArchiver(conn, msg))
 }
 
-func replyAll(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg.Message) error {
+func replyAll(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg.Message, selection string) (*MessageViewOp, error) {
 	to, cc, err := msg.GetReplyToAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	quoted, err := replyBody(ctx, msg, selection)
+	if err != nil {
+		return nil, err
+	}
+	return replyOrForward(ctx, conn, keys, to, cc, replyPrefix, replyPrefixes, msg, quoted, nil, replyArchiver(conn, msg))
+}
+
+// forwardMode is how to include the original message when forwarding.
+type forwardMode int
+
+const (
+	// Quote the text body.
+	forwardInline forwardMode = iota
+
+	// Quote the text body, and attach the original's attachments.
+	forwardWithAttachments
+
+	// Attach the whole original message as message/rfc822.
+	forwardAsAttachment
+)
+
+// chooseForwardMode asks the user how to forward a message.
+func chooseForwardMode(keys *input.Input) (forwardMode, error) {
+	a, err := dialog.Question("Forward how?", []dialog.Option{
+		{Key: "f", Label: "f — Inline"},
+		{Key: "t", Label: "t — Inline, with original attachments"},
+		{Key: "m", Label: "m — As attachment (whole original message)"},
+	}, keys)
+	if err != nil {
+		return 0, err
+	}
+	switch a {
+	case "f":
+		return forwardInline, nil
+	case "t":
+		return forwardWithAttachments, nil
+	case "m":
+		return forwardAsAttachment, nil
+	}
+	return 0, dialog.ErrAborted
+}
+
+// forwardedAttachments returns the original message's attachments, to be downloaded when sending.
+// Attachments that were decrypted are only included if the user agrees to forward them in cleartext.
+func forwardedAttachments(ctx context.Context, msg *cmdg.Message, keys *input.Input) ([]*file, error) {
+	as, err := msg.Attachments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := 0
+	for _, a := range as {
+		if a.IsDecrypted() {
+			decrypted++
+		}
+	}
+	keepDecrypted := false
+	if decrypted > 0 {
+		a, err := dialog.Question(fmt.Sprintf("%d attachment(s) were decrypted. Forward them unencrypted?", decrypted), []dialog.Option{
+			{Key: "y", Label: "y — Yes, forward in cleartext unless encrypted when sending"},
+			{Key: "n", Label: "n — No, leave them out"},
+		}, keys)
+		if err != nil {
+			return nil, err
+		}
+		keepDecrypted = a == "y"
+	}
+	var ret []*file
+	for _, a := range as {
+		a := a
+		if a.IsDecrypted() && !keepDecrypted {
+			log.Infof("Not forwarding decrypted attachment %q", a.Part.Filename)
+			continue
+		}
+		ct := a.Part.MimeType
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		ret = append(ret, &file{
+			name:        attachmentFilename(a.Part.Filename),
+			contentType: ct,
+			open: func() (io.ReadCloser, error) {
+				r, w := io.Pipe()
+				go func() {
+					w.CloseWithError(a.DownloadTo(ctx, w, nil))
+				}()
+				return r, nil
+			},
+			message: strings.EqualFold(ct, "message/rfc822"),
+		})
+	}
+	return ret, nil
+}
+
+// forwardAttachment forwards the original message, unchanged, as an attachment.
+func forwardAttachment(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to string, msg *cmdg.Message) error {
+	raw, err := msg.Raw(ctx)
+	if err != nil {
+		return err
+	}
+	subj, err := msg.GetHeader(ctx, "Subject")
 	if err != nil {
 		return err
 	}
-	return replyOrForward(ctx, conn, keys, to, cc, replyPrefix, replyPrefixes, msg)
+	name := strings.TrimSpace(unsafeFilenameRE.ReplaceAllString(subj, "_"))
+	if name == "" {
+		name = "forwarded"
+	}
+	headers := []string{
+		fmt.Sprintf("To: %s", to),
+		fmt.Sprintf("Subject: %s%s", forwardPrefix, forwardPrefixes.ReplaceAllString(subj, "")),
+	}
+	var body string
+	if signature != "" {
+		body = "\n--\n" + signature + "\n"
+	}
+	threadID, err := msg.ThreadID(ctx)
+	if err != nil {
+		return err
+	}
+	prefill := strings.Join(headers, "\n") + "\n\n" + body
+	_, err = compose(ctx, conn, keys, threadID, prefill, []*file{
+		{
+			name:        name + ".eml",
+			contentType: "message/rfc822",
+			open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(raw)), nil
+			},
+			message: true,
+		},
+	}, nil)
+	return err
 }
 
-func forward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg.Message) error {
-	// Get recipient
-	toOpt, err := dialog.Selection(dialog.Strings2Options(conn.Contacts()), "To> ", true, keys)
+func forward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg.Message, mode forwardMode) error {
+	// Get recipients.
+	to, err := pickRecipients(ctx, conn, keys, "To> ")
 	if err == dialog.ErrAborted {
 		return nil
 	} else if err != nil {
 		return err
 	}
-	to := toOpt.Key
-	if strings.EqualFold(to, "me") {
-		p, err := conn.GetProfile(ctx)
-		if err != nil {
-			return errors.Wrap(err, "failed to get own email address")
+
+	if mode == forwardAsAttachment {
+		return forwardAttachment(ctx, conn, keys, to, msg)
+	}
+	var as []*file
+	if mode == forwardWithAttachments {
+		as, err = forwardedAttachments(ctx, msg, keys)
+		if err == dialog.ErrAborted {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "getting attachments to forward")
 		}
-		to = p.EmailAddress
 	}
-
-	return replyOrForward(ctx, conn, keys, to, "", forwardPrefix, forwardPrefixes, msg)
+	b, err := msg.GetUnpatchedBody(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = replyOrForward(ctx, conn, keys, to, "", forwardPrefix, forwardPrefixes, msg, replyQuoted(b), as, nil)
+	return err
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+)
+
+func TestQuoteForReply(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		in     string
+		flowed bool
+		delsp  bool
+		out    string
+	}{
+		{
+			name: "Simple",
+			in:   "Hello\n\nWorld",
+			out:  "> Hello\n>\n> World",
+		},
+		{
+			name: "Signature",
+			in:   "Hello\r\n\r\n-- \r\nSome Body\r\nsomebody@example.com",
+			out:  "> Hello",
+		},
+		{
+			name: "CRLF without signature",
+			in:   "Hello\r\n\r\nWorld\r\n",
+			out:  "> Hello\n>\n> World\n>",
+		},
+		{
+			name: "Lone CR",
+			in:   "Hello\rWorld",
+			out:  "> Hello\n> World",
+		},
+		{
+			name: "Last signature separator wins",
+			in:   "a\n--\nb\n-- \nsig",
+			out:  "> a\n> --\n> b",
+		},
+		{
+			name: "Nested quotes",
+			in:   "Yes\n> Really?\n> > I think so\n> > > Is it?\n> > > > Question\n> Hmm\nOK",
+			out:  "> Yes\n> > Really?\n> > > I think so\n> > > > […]\n> > Hmm\n> OK",
+		},
+		{
+			name:   "Flowed",
+			in:     "This is a long \r\nparagraph that \r\nflows.\r\n\r\n> Quoted \r\n> too.\r\n \r\nFrom the start.\r\n-- \r\nsig",
+			flowed: true,
+			out:    "> This is a long paragraph that flows.\n>\n> > Quoted too.\n>\n> From the start.",
+		},
+		{
+			name:   "Flowed delsp",
+			in:     "Compound\r\nword \r\nsplit.",
+			flowed: true,
+			delsp:  true,
+			out:    "> Compound\n> wordsplit.",
+		},
+		{
+			name:   "Flowed wrap",
+			in:     "aaaa bbbb cccc dddd eeee ffff gggg hhhh iiii jjjj kkkk llll mmmm \r\nnnnn oooo pppp",
+			flowed: true,
+			out:    "> aaaa bbbb cccc dddd eeee ffff gggg hhhh iiii jjjj kkkk llll mmmm nnnn\n> oooo pppp",
+		},
+	} {
+		in := test.in
+		if test.flowed {
+			in = cmdg.DecodeFlowed(in, test.delsp)
+		}
+		if got, want := quoteForReply(in, test.flowed), test.out; got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, want)
+		}
+	}
+}
+
+func TestStripSignature(t *testing.T) {
+	for _, test := range []struct {
+		in, out string
+	}{
+		{"Hello\nWorld", "Hello\nWorld"},
+		{"Hello\n\n-- \nsig", "Hello"},
+		{"Hello\n--\nnot a sig", "Hello\n--\nnot a sig"},
+		{"diff\n--\n-- \nsig", "diff\n--"},
+		{"Hello\n--- \nnot a sig", "Hello\n--- \nnot a sig"},
+	} {
+		for _, in := range []string{test.in, strings.Replace(test.in, "\n", "\r\n", -1)} {
+			if got, want := stripSignature(normalizeNewlines(in)), test.out; got != want {
+				t.Errorf("stripSignature(%q) = %q, want %q", in, got, want)
+			}
+		}
+	}
+}
+
+func TestAttribution(t *testing.T) {
+	date := time.Date(2020, 5, 14, 10, 11, 12, 0, time.UTC)
+	for _, test := range []struct {
+		format string
+		from   string
+		out    string
+	}{
+		{"On %D, %F said:", `"Some Body" <some@example.com>`, `On Thu, 14 May 2020 10:11:12 +0000, "Some Body" <some@example.com> said:`},
+		{"%N wrote:", `"Some Body" <some@example.com>`, "Some Body wrote:"},
+		{"%N wrote:", `some@example.com`, "some@example.com wrote:"},
+		{"%A re %S, 100%%%", `Some Body <some@example.com>`, "some@example.com re hello, 100%%"},
+		{"%X", `some@example.com`, "%X"},
+	} {
+		if got, want := attribution(test.format, date, test.from, "hello"), test.out; got != want {
+			t.Errorf("%q: got %q, want %q", test.format, got, want)
+		}
+	}
+}
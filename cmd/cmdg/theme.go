@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThomasHabets/cmdg/pkg/display"
+)
+
+var (
+	themeFlag     = flag.String("theme", "", "Color theme: "+strings.Join(display.ThemeNames(), ", ")+". Default is nocolor if $NO_COLOR is set, else dark. Adjusted by -theme_file.")
+	themeFileFlag = flag.String("theme_file", "", "File with theme colors, applied on top of the theme. Default is ~/"+path.Join(defaultConfigDir, themeFileName))
+)
+
+// loadTheme returns a copy of the named built-in theme, changed according to the theme file.
+func loadTheme(name, fn string, mustExist bool) (*display.Theme, error) {
+	if name == "" {
+		name = "dark"
+		if os.Getenv("NO_COLOR") != "" {
+			name = "nocolor"
+		}
+	}
+	base, ok := display.Themes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown theme %q, valid themes are %s", name, strings.Join(display.ThemeNames(), ", "))
+	}
+	t := base.Copy()
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) && !mustExist {
+		return t, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "opening theme file %q", fn)
+	}
+	defer f.Close()
+	if err := t.Load(f); err != nil {
+		return nil, errors.Wrapf(err, "theme file %q", fn)
+	}
+	return t, nil
+}
+
+// themeFilePath returns the theme file to load, and if it's required to exist.
+func themeFilePath() (string, bool) {
+	if *themeFileFlag != "" {
+		return *themeFileFlag, true
+	}
+	return path.Join(os.Getenv("HOME"), defaultConfigDir, themeFileName), false
+}
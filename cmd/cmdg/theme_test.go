@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ThomasHabets/cmdg/pkg/display"
+)
+
+func TestLoadThemeNoColor(t *testing.T) {
+	old, had := os.LookupEnv("NO_COLOR")
+	defer func() {
+		if had {
+			os.Setenv("NO_COLOR", old)
+		} else {
+			os.Unsetenv("NO_COLOR")
+		}
+	}()
+
+	os.Setenv("NO_COLOR", "1")
+	th, err := loadTheme("", "/nonexistent", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.Error != display.Themes["nocolor"].Error || th.LabelColors {
+		t.Errorf("NO_COLOR set, but didn't get the nocolor theme")
+	}
+
+	// Explicitly chosen theme wins.
+	th, err = loadTheme("light", "/nonexistent", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.Starred != display.Themes["light"].Starred {
+		t.Errorf("Explicit theme not used with NO_COLOR set")
+	}
+
+	os.Unsetenv("NO_COLOR")
+	th, err = loadTheme("", "/nonexistent", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.Starred != display.Themes["dark"].Starred {
+		t.Errorf("Didn't get the dark theme by default")
+	}
+
+	if _, err := loadTheme("nonexistent", "/nonexistent", false); err == nil {
+		t.Errorf("Loading unknown theme succeeded")
+	}
+}
+
+func TestQuoteLevel(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"hello", 0},
+		{"> hello", 1},
+		{">> hello", 2},
+		{"> > > hello", 3},
+		{"\033[1m> hello", 1},
+		{"hello > world", 0},
+	} {
+		if got := quoteLevel(test.in); got != test.want {
+			t.Errorf("quoteLevel(%q) = %d, want %d", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+const (
+	// Max number of contacts to suggest for an invalid address.
+	maxSuggestions = 3
+)
+
+var (
+	// Mentions of attachments in the body.
+	attachmentMentionRE = regexp.MustCompile(`(?i)\b(attached|attachments?|enclosed)\b`)
+)
+
+// composeProblems are problems found with a message before sending it.
+type composeProblems struct {
+	// Errors make the message impossible to send.
+	errors []string
+
+	// Warnings are probably mistakes, but the user can choose to send anyway.
+	warnings []string
+}
+
+func (p *composeProblems) empty() bool {
+	return len(p.errors) == 0 && len(p.warnings) == 0
+}
+
+func (p *composeProblems) String() string {
+	var ret []string
+	for _, e := range p.errors {
+		ret = append(ret, "Error: "+e)
+	}
+	for _, w := range p.warnings {
+		ret = append(ret, "Warning: "+w)
+	}
+	return strings.Join(ret, "\n")
+}
+
+// suggestContacts returns contacts that look like what the user meant.
+func suggestContacts(s string, contacts []string) []string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return nil
+	}
+	var ret []string
+	for _, c := range contacts {
+		if c == "me" {
+			continue
+		}
+		if strings.Contains(strings.ToLower(c), s) {
+			ret = append(ret, c)
+			if len(ret) == maxSuggestions {
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// validateAddresses checks an address header, one address at a time so
+// that the problem can be pointed out.
+func validateAddresses(h, v string, contacts []string) ([]*mail.Address, []string) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	if as, err := mail.ParseAddressList(v); err == nil {
+		return as, nil
+	}
+	var as []*mail.Address
+	var problems []string
+	for _, e := range strings.Split(v, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		a, err := mail.ParseAddress(e)
+		if err == nil {
+			as = append(as, a)
+			continue
+		}
+		p := fmt.Sprintf("%s: %q is not a valid address", h, e)
+		if strings.EqualFold(e, "me") {
+			p = fmt.Sprintf("%s: %q only works in the recipient dialog; write out your own address", h, e)
+		} else if s := suggestContacts(e, contacts); len(s) > 0 {
+			p += fmt.Sprintf(". Did you mean %s?", strings.Join(s, " or "))
+		}
+		problems = append(problems, p)
+	}
+	return as, problems
+}
+
+// unquotedBody returns the lines of the body the user wrote, skipping quotes and signature.
+func unquotedBody(body string) string {
+	var ret []string
+	for _, l := range strings.Split(body, "\n") {
+		l = strings.TrimRight(l, "\r")
+		if l == "-- " {
+			break
+		}
+		if strings.HasPrefix(l, ">") {
+			continue
+		}
+		ret = append(ret, l)
+	}
+	return strings.Join(ret, "\n")
+}
+
+// validateMessage checks the message the user wrote, before trying to send it.
+func validateMessage(msg string, attachments []*file, contacts []string) *composeProblems {
+	ret := &composeProblems{}
+	head, part, attach, err := cmdg.ParseUserMessage(msg)
+	if err != nil {
+		ret.errors = append(ret.errors, fmt.Sprintf("Can't parse message: %v", err))
+		return ret
+	}
+
+	nrcpt := 0
+	for _, h := range []string{"To", "CC", "BCC", "Reply-To"} {
+		as, problems := validateAddresses(h, head.Get(h), contacts)
+		ret.errors = append(ret.errors, problems...)
+		if h != "Reply-To" {
+			nrcpt += len(as) + len(problems)
+		}
+	}
+	if nrcpt == 0 {
+		ret.errors = append(ret.errors, "No recipients")
+	}
+	if strings.TrimSpace(head.Get("Subject")) == "" {
+		ret.warnings = append(ret.warnings, "Subject is empty")
+	}
+
+	more, err := expandAttachPatterns(attach, nil)
+	if err != nil {
+		ret.errors = append(ret.errors, err.Error())
+	}
+	if len(attachments)+len(more) == 0 {
+		if w := attachmentMentionRE.FindString(unquotedBody(part.Contents)); w != "" {
+			ret.warnings = append(ret.warnings, fmt.Sprintf("Message says %q, but nothing is attached", w))
+		}
+	}
+	return ret
+}
+
+// confirmProblems shows the problems with a message, and returns true if the user wants to send anyway.
+func confirmProblems(p *composeProblems, keys *input.Input) (bool, error) {
+	log.Infof("Problems with message to send: %s", p)
+	if len(p.errors) > 0 {
+		if err := dialog.Message("Can't send message", p.String()+"\n\nPress [enter] to return to the editor", keys); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	a, err := dialog.Question(strings.Join(p.warnings, "; "), []dialog.Option{
+		{Key: "e", Label: "e — Return to editor"},
+		{Key: "s", Label: "s — Send anyway"},
+	}, keys)
+	if err != nil {
+		return false, err
+	}
+	return a == "s", nil
+}
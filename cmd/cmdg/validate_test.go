@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateMessage(t *testing.T) {
+	contacts := []string{"me", "Bob Smith <bob@example.com>", "alice@example.com"}
+	att := []*file{{name: "foo.pdf"}}
+	for _, test := range []struct {
+		name        string
+		msg         string
+		attachments []*file
+		errors      []string
+		warnings    []string
+	}{
+		{
+			name: "OK",
+			msg:  "To: bob@example.com\nSubject: hello\n\nWorld",
+		},
+		{
+			name:     "Empty subject",
+			msg:      "To: bob@example.com\nSubject:\n\nWorld",
+			warnings: []string{"Subject is empty"},
+		},
+		{
+			name:   "No recipients",
+			msg:    "To:\nCC:\nSubject: hello\n\nWorld",
+			errors: []string{"No recipients"},
+		},
+		{
+			name:   "Bad address with suggestion",
+			msg:    "To: alice@example.com, bob\nSubject: hello\n\nWorld",
+			errors: []string{`To: "bob" is not a valid address. Did you mean Bob Smith <bob@example.com>?`},
+		},
+		{
+			name:   "Bad CC",
+			msg:    "To: alice@example.com\nCC: nobody\nSubject: hello\n\nWorld",
+			errors: []string{`CC: "nobody" is not a valid address`},
+		},
+		{
+			name:   "Me",
+			msg:    "To: me\nSubject: hello\n\nWorld",
+			errors: []string{`To: "me" only works in the recipient dialog; write out your own address`},
+		},
+		{
+			name:     "Attachment mentioned",
+			msg:      "To: bob@example.com\nSubject: hello\n\nSee attached file.",
+			warnings: []string{`Message says "attached", but nothing is attached`},
+		},
+		{
+			name:        "Attachment mentioned and attached",
+			msg:         "To: bob@example.com\nSubject: hello\n\nSee attached file.",
+			attachments: att,
+		},
+		{
+			name: "Attachment mentioned only in quote",
+			msg:  "To: bob@example.com\nSubject: hello\n\nThanks!\n> See attachment.",
+		},
+		{
+			name: "Attachment mentioned only in signature",
+			msg:  "To: bob@example.com\nSubject: hello\n\nThanks!\n-- \nAttachments are scanned.",
+		},
+		{
+			name:     "Attachment mentioned after a bare --",
+			msg:      "To: bob@example.com\nSubject: hello\n\nRun it with\n--\nand see attached log.",
+			warnings: []string{`Message says "attached", but nothing is attached`},
+		},
+		{
+			name:   "Attach header matching nothing",
+			msg:    "To: bob@example.com\nAttach: /nonexistent/*.pdf\nSubject: hello\n\nWorld",
+			errors: []string{`Attach: "/nonexistent/*.pdf" matches no files`},
+		},
+	} {
+		p := validateMessage(test.msg, test.attachments, contacts)
+		if got, want := p.errors, test.errors; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: errors got %q, want %q", test.name, got, want)
+		}
+		if got, want := p.warnings, test.warnings; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: warnings got %q, want %q", test.name, got, want)
+		}
+	}
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,93 +17,384 @@ import (
 
 	"github.com/ThomasHabets/cmdg/pkg/cmdg"
 	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/display"
 	"github.com/ThomasHabets/cmdg/pkg/input"
 )
 
 var (
-	openBinary = flag.String("open", "xdg-open", "Command to open attachments with.")
-	openWait   = flag.Bool("open_wait", false, "Wait after opening attachment. If using X, then makes sense to say no.")
+	openBinary    = flag.String("open", "xdg-open", "Command to open attachments with.")
+	openWait      = flag.Bool("open_wait", false, "Wait after opening attachment. If using X, then makes sense to say no.")
+	attachmentDir = flag.String("attachment_dir", ".", "Default directory to save attachments in.")
+
+	// Last directory attachments were saved in. Defaults to -attachment_dir.
+	saveDir string
+)
+
+const (
+	// How often to update download progress.
+	progressInterval = 100 * time.Millisecond
+
+	// Collision policies when saving.
+	collisionAsk       = ""
+	collisionOverwrite = "o"
+	collisionRename    = "r"
+	collisionSkip      = "s"
 )
 
+type attachmentBrowser struct {
+	keys   *input.Input
+	screen *display.Screen
+	as     []*cmdg.Attachment
+	marked map[int]bool
+	cur    int
+	status string
+}
+
+// listAttachments is the attachment browser.
 func listAttachments(ctx context.Context, keys *input.Input, msg *cmdg.Message) error {
 	as, err := msg.Attachments(ctx)
 	if err != nil {
 		return err
 	}
-	ass := make([]string, len(as), len(as))
-	for n, a := range as {
-		ass[n] = a.Part.Filename
-	}
-	which, err := dialog.Selection(dialog.Strings2Options(ass), "Attachment> ", false, keys)
+	screen, err := display.NewScreen()
 	if err != nil {
 		return err
 	}
+	b := &attachmentBrowser{
+		keys:   keys,
+		screen: screen,
+		as:     as,
+		marked: make(map[int]bool),
+	}
+	for {
+		// Also catches resizes while a dialog was showing.
+		if b.screen.SizeChanged() {
+			if b.screen, err = display.NewScreen(); err != nil {
+				return err
+			}
+		}
+		b.draw()
+		key, resized := keys.KeyOrResize()
+		if resized {
+			continue
+		}
+		b.status = ""
+		var err error
+		switch keys.Keymap().Action(viewAttachments, key) {
+		case "back":
+			return nil
+		case "next":
+			if b.cur < len(b.as)-1 {
+				b.cur++
+			}
+		case "prev":
+			if b.cur > 0 {
+				b.cur--
+			}
+		case "mark":
+			b.marked[b.cur] = !b.marked[b.cur]
+			if b.cur < len(b.as)-1 {
+				b.cur++
+			}
+		case "mark-all":
+			all := len(b.markedAttachments()) != len(b.as)
+			for n := range b.as {
+				b.marked[n] = all
+			}
+		case "open":
+			err = b.open(ctx, b.as[b.cur])
+		case "save":
+			sel := b.markedAttachments()
+			if len(sel) == 0 {
+				sel = []*cmdg.Attachment{b.as[b.cur]}
+			}
+			err = b.save(ctx, sel)
+		case "save-all":
+			err = b.save(ctx, b.as)
+		}
+		if errors.Cause(err) == dialog.ErrAborted {
+			log.Infof("Attachment action aborted")
+		} else if err != nil {
+			showError(b.screen, keys, err.Error())
+		}
+	}
+}
 
-	chosen := as[which.KeyInt]
+func (b *attachmentBrowser) markedAttachments() []*cmdg.Attachment {
+	var ret []*cmdg.Attachment
+	for n, a := range b.as {
+		if b.marked[n] {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
 
-	for {
-		sendQ := []dialog.Option{
-			{Key: "s", Label: "s — Save"},
-			{Key: "o", Label: "o — Open"},
-			{Key: "a", Label: "a — Abort"},
+// keyHelp returns the header summary of the keys, from the active bindings.
+func (b *attachmentBrowser) keyHelp() string {
+	var ret []string
+	for _, bnd := range viewBindings[viewAttachments] {
+		if bnd.Action == "next" || bnd.Action == "prev" {
+			continue
+		}
+		if k := keyLabel(b.keys, viewAttachments, bnd.Action); k != "" {
+			ret = append(ret, fmt.Sprintf("%s: %s", k, bnd.Help))
+		}
+	}
+	return strings.Join(ret, ", ")
+}
+
+func (b *attachmentBrowser) draw() {
+	b.screen.Clear()
+	b.screen.Printlnf(0, "%sAttachments%s — %s", display.Bold, display.Reset, b.keyHelp())
+	first := 2
+	rows := b.screen.Height - first - 1
+	scroll := 0
+	if b.cur >= rows {
+		scroll = b.cur - rows + 1
+	}
+	for n := scroll; n < len(b.as) && n-scroll < rows; n++ {
+		a := b.as[n]
+		cur := " "
+		if n == b.cur {
+			cur = display.Bold + ">"
 		}
-		a, err := dialog.Question("Action to do on attachment", sendQ, keys)
+		mark := " "
+		if b.marked[n] {
+			mark = "x"
+		}
+		extra := ""
+		if a.IsDecrypted() {
+			extra = " (decrypted)"
+		}
+		b.screen.Printlnf(first+n-scroll, "%s [%s] %10s  %s  %s%s%s%s", cur, mark, humanSize(a.Size()), a.Part.Filename, display.ActiveTheme.Dim, a.Part.MimeType, extra, display.Reset)
+	}
+	b.screen.Printlnf(b.screen.Height-1, "%s", b.status)
+	b.screen.Draw()
+}
+
+// progress returns a progress callback showing download progress in the status line.
+func (b *attachmentBrowser) progress(prefix string, total int64) func(int64) {
+	var last time.Time
+	return func(n int64) {
+		if time.Since(last) < progressInterval && n < total {
+			return
+		}
+		last = time.Now()
+		if total > 0 {
+			b.status = fmt.Sprintf("%s: %d%% (%s of %s)", prefix, 100*n/total, humanSize(n), humanSize(total))
+		} else {
+			b.status = fmt.Sprintf("%s: %s", prefix, humanSize(n))
+		}
+		b.draw()
+	}
+}
+
+func (b *attachmentBrowser) open(ctx context.Context, a *cmdg.Attachment) error {
+	if a.IsDecrypted() {
+		// Opening needs a tempfile, so don't do that without asking.
+		q, err := dialog.Question("Write decrypted attachment to temporary file to open it?", []dialog.Option{
+			{Key: "y", Label: "y — Yes"},
+			{Key: "n", Label: "n — No"},
+		}, b.keys)
 		if err != nil {
 			return err
 		}
-
-		switch a {
-		case "a": // Abort
+		if q != "y" {
 			return nil
-		case "o": // Open
-			// TODO: show download status
-			data, err := chosen.Download(ctx)
-			if err != nil {
-				return err
+		}
+	}
+	return openFile(ctx, path.Ext(a.Part.Filename), func(w io.Writer) error {
+		return a.DownloadTo(ctx, w, b.progress("Downloading "+a.Part.Filename, a.Size()))
+	})
+}
+
+// save asks for a directory, and saves the attachments there.
+func (b *attachmentBrowser) save(ctx context.Context, as []*cmdg.Attachment) error {
+	if saveDir == "" {
+		saveDir = *attachmentDir
+	}
+	if !strings.HasSuffix(saveDir, "/") {
+		saveDir += "/"
+	}
+	dir, err := dialog.EntryComplete("Save to directory> ", saveDir, completeDir, b.keys)
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		return dialog.ErrAborted
+	}
+	saveDir = dir
+	dir = expandHome(dir)
+	if st, err := os.Stat(dir); err != nil {
+		return errors.Wrapf(err, "checking directory %q", dir)
+	} else if !st.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+
+	policy := collisionAsk
+	saved := 0
+	for n, a := range as {
+		fn := path.Join(dir, attachmentFilename(a.Part.Filename))
+		overwrite := false
+		if _, err := os.Stat(fn); err == nil {
+			p := policy
+			if p == collisionAsk {
+				alt := uniqueFilename(fn)
+				q, err := dialog.Question(fmt.Sprintf("%q already exists", fn), []dialog.Option{
+					{Key: "o", Label: "o — Overwrite"},
+					{Key: "r", Label: fmt.Sprintf("r — Rename to %q", path.Base(alt))},
+					{Key: "s", Label: "s — Skip"},
+					{Key: "O", Label: "O — Overwrite all"},
+					{Key: "R", Label: "R — Rename all"},
+					{Key: "S", Label: "S — Skip all"},
+					{Key: "a", Label: "a — Abort"},
+				}, b.keys)
+				if err != nil {
+					return err
+				}
+				switch q {
+				case "O", "R", "S":
+					policy = strings.ToLower(q)
+					p = policy
+				case "o", "r", "s":
+					p = q
+				default:
+					return dialog.ErrAborted
+				}
 			}
-			return openFile(ctx, data, path.Ext(chosen.Part.Filename))
-		case "s":
-			// TODO: show download status
-			data, err := chosen.Download(ctx)
-			if err != nil {
-				return err
+			switch p {
+			case collisionOverwrite:
+				overwrite = true
+			case collisionRename:
+				fn = uniqueFilename(fn)
+			case collisionSkip:
+				log.Infof("Skipping existing file %q", fn)
+				continue
 			}
-			return saveFile(ctx, data, chosen.Part.Filename)
 		}
+		prefix := fmt.Sprintf("Saving %s (%d/%d)", path.Base(fn), n+1, len(as))
+		if err := saveFile(fn, overwrite, func(w io.Writer) error {
+			return a.DownloadTo(ctx, w, b.progress(prefix, a.Size()))
+		}); err != nil {
+			return err
+		}
+		saved++
+	}
+	b.status = fmt.Sprintf("Saved %d of %d attachment(s) to %s", saved, len(as), dir)
+	return nil
+}
 
+// humanSize formats a byte count for display.
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for t := n / unit; t >= unit; t /= unit {
+		div *= unit
+		exp++
 	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
-func saveFile(ctx context.Context, data []byte, fn string) error {
-	if fn == "" {
+// attachmentFilename returns a safe local filename for an attachment.
+func attachmentFilename(fn string) string {
+	fn = path.Base(strings.Replace(fn, "\\", "/", -1))
+	if fn == "" || fn == "." || fn == ".." || fn == "/" {
 		fn = "unnamed-attachment"
 	}
-	fn = path.Base(fn)
-	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	return fn
+}
+
+// uniqueFilename returns a filename like "foo-1.pdf" that doesn't yet exist.
+func uniqueFilename(fn string) string {
+	ext := path.Ext(fn)
+	base := strings.TrimSuffix(fn, ext)
+	for n := 1; ; n++ {
+		t := fmt.Sprintf("%s-%d%s", base, n, ext)
+		if _, err := os.Stat(t); os.IsNotExist(err) {
+			return t
+		}
+	}
+}
+
+func expandHome(fn string) string {
+	if fn == "~" || strings.HasPrefix(fn, "~/") {
+		return path.Join(os.Getenv("HOME"), fn[1:])
+	}
+	return fn
+}
+
+// completeDir returns directories matching the prefix, for tab completion.
+func completeDir(s string) []string {
+	dir, base := path.Split(s)
+	rd := expandHome(dir)
+	if rd == "" {
+		rd = "."
+	}
+	fis, err := ioutil.ReadDir(rd)
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	for _, fi := range fis {
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), base) {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		ret = append(ret, dir+fi.Name()+"/")
+	}
+	return ret
+}
+
+// saveFile streams data into a new file, removing it on failure.
+// If `overwrite` is true, an existing file is only replaced once the new data is all written.
+func saveFile(fn string, overwrite bool, write func(io.Writer) error) error {
+	var f *os.File
+	var err error
+	if overwrite {
+		f, err = ioutil.TempFile(path.Dir(fn), ".cmdg-partial-*")
+	} else {
+		f, err = os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	}
 	if err != nil {
 		return errors.Wrapf(err, "opening %q", fn)
 	}
-	if _, err := f.Write(data); err != nil {
+	if err := write(f); err != nil {
+		f.Close()
 		if err := os.Remove(f.Name()); err != nil {
-			log.Errorf("Failed to remove tempfile after failure %q: %v", fn, err)
+			log.Errorf("Failed to remove file after failure %q: %v", f.Name(), err)
 		}
 		return err
 	}
 	if err := f.Close(); err != nil {
-		if err := os.Remove(fn); err != nil {
-			log.Errorf("Failed to remove tempfile after failure %q: %v", fn, err)
+		if err := os.Remove(f.Name()); err != nil {
+			log.Errorf("Failed to remove file after failure %q: %v", f.Name(), err)
 		}
 		return err
 	}
+	if overwrite {
+		if err := os.Rename(f.Name(), fn); err != nil {
+			if err := os.Remove(f.Name()); err != nil {
+				log.Errorf("Failed to remove tempfile after failure %q: %v", f.Name(), err)
+			}
+			return errors.Wrapf(err, "replacing %q", fn)
+		}
+	}
 	return nil
 }
 
-func openFile(ctx context.Context, data []byte, ext string) error {
+func openFile(ctx context.Context, ext string, write func(io.Writer) error) error {
 	f, err := ioutil.TempFile("", "cmdg-attachment-*"+ext)
 	if err != nil {
 		return err
 	}
-	if _, err := f.Write(data); err != nil {
+	if err := write(f); err != nil {
+		f.Close()
 		if err := os.Remove(f.Name()); err != nil {
 			log.Errorf("Failed to remove tempfile after failure %q: %v", f.Name(), err)
 		}
@@ -118,6 +412,7 @@ func openFile(ctx context.Context, data []byte, ext string) error {
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
+		defer display.Invalidate()
 	}
 	if err := cmd.Start(); err != nil {
 		return errors.Wrapf(err, "failed to start binary %q", *openBinary)
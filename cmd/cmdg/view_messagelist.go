@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/mail"
 	"strings"
 	"sync"
 	"time"
@@ -21,29 +22,6 @@ import (
 
 const (
 	scrollLimit = 5
-
-	messageListViewHelp = `?, F1              — Help
-enter              — Open message
-space, x           — Mark message and advance
-X                  — Mark message and step up
-e                  — Archive marked messages
-d                  — Move marked messages to trash
-l                  — Label marked messages
-L                  — Unlabel marked messages
-*                  — Toggle starred on hilighted message
-c                  — Compose new message
-C                  — Continue message from draft
-N, n, ^N, j, Down  — Next message
-P, p, ^P, k, Up    — Previous message
-r, ^R              — Reload current view
-g                  — Go to label
-1                  — Go to inbox
-s, ^s              — Search
-q                  — Quit
-^L                 — Refresh screen
-
-Press [enter] to exit
-`
 )
 
 var (
@@ -92,9 +70,26 @@ type MessageView struct {
 	removeMessage   chan string
 
 	// Only for use by main thread.
-	messages  []*cmdg.Message
-	pos       int
-	historyID cmdg.HistoryID
+	messages     []*cmdg.Message
+	threadCounts map[cmdg.ThreadID]int
+	pos          int
+	historyID    cmdg.HistoryID
+}
+
+// countThreads returns how many of the messages are in each thread.
+// Messages not yet loaded aren't counted.
+func countThreads(ctx context.Context, msgs []*cmdg.Message) map[cmdg.ThreadID]int {
+	ret := make(map[cmdg.ThreadID]int)
+	for _, m := range msgs {
+		// Don't block on loading messages just to count them.
+		if !m.HasData(cmdg.LevelMinimal) {
+			continue
+		}
+		if t, err := m.ThreadID(ctx); err == nil {
+			ret[t]++
+		}
+	}
+	return ret
 }
 
 func NewMessageView(ctx context.Context, label, q string, in *input.Input) *MessageView {
@@ -163,6 +158,104 @@ func (mv *MessageView) fetchPage(ctx context.Context, token string) {
 	mv.pageCh <- page
 }
 
+// listField returns the value of a field in the message list format.
+func (mv *MessageView) listField(ctx context.Context, msg *cmdg.Message, field byte, arg string, current, marked, shortLabels bool) (string, error) {
+	indicator := func(b bool, s string) string {
+		if b {
+			return s
+		}
+		return " "
+	}
+	switch field {
+	case 'C':
+		return indicator(current, "*"), nil
+	case 'M':
+		return indicator(marked, "X"), nil
+	case 'U':
+		return indicator(msg.IsUnread(), ">"), nil
+	case 'S':
+		return indicator(msg.HasLabel(cmdg.Starred), "*"), nil
+	case 'd':
+		return msg.GetTimeFmt(ctx)
+	case 'D', 'r', '{':
+		tm, err := msg.GetTime(ctx)
+		if err != nil {
+			return "", err
+		}
+		switch field {
+		case 'D':
+			return tm.Format("2006-01-02 15:04"), nil
+		case 'r':
+			return shortAge(tm, time.Now()), nil
+		}
+		return tm.Format(arg), nil
+	case 'F':
+		return msg.GetFrom(ctx)
+	case 'A':
+		v, err := msg.GetHeader(ctx, "From")
+		if err != nil {
+			return "", err
+		}
+		if a, err := mail.ParseAddress(v); err == nil {
+			return a.Address, nil
+		}
+		return v, nil
+	case 't':
+		v, err := msg.GetHeader(ctx, "To")
+		if errors.Cause(err) == cmdg.ErrMissing {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		return shortAddress(v), nil
+	case 's':
+		subj, err := msg.GetHeader(ctx, "subject")
+		if errors.Cause(err) == cmdg.ErrMissing || subj == "" {
+			return "(No subject)", nil
+		}
+		return subj, err
+	case 'n':
+		tid, err := msg.ThreadID(ctx)
+		if err != nil {
+			return "", err
+		}
+		n := mv.threadCounts[tid]
+		if n < 2 {
+			return "", nil
+		}
+		return fmt.Sprint(n), nil
+	case 'a':
+		if msg.HasAttachments() {
+			return "@", nil
+		}
+		return "", nil
+	case 'z':
+		return humanSize(msg.SizeEstimate()), nil
+	case 'l':
+		ls, err := msg.GetLabels(ctx, false)
+		if err != nil {
+			return "", err
+		}
+		var names []string
+		for _, l := range ls {
+			if l.ID != mv.label {
+				names = append(names, l.Label)
+			}
+		}
+		return strings.Join(names, ", "), nil
+	case 'L':
+		colors, fullColors, err := msg.GetLabelColors(ctx, mv.label)
+		if err != nil {
+			return "", err
+		}
+		if shortLabels {
+			return colors, nil
+		}
+		return fullColors, nil
+	}
+	return "", fmt.Errorf("unknown list format field %%%c", field)
+}
+
 type MessageViewOp struct {
 	fun         func(*MessageView)
 	quit        bool
@@ -227,6 +320,34 @@ func OpRemoveCurrent(next *MessageViewOp) *MessageViewOp {
 	}
 }
 
+// OpRemoveThread removes all listed messages in the thread, such as after it's been archived.
+func OpRemoveThread(threadID cmdg.ThreadID, next *MessageViewOp) *MessageViewOp {
+	return &MessageViewOp{
+		fun: func(view *MessageView) {
+			var nm []*cmdg.Message
+			pos := view.pos
+			for n, m := range view.messages {
+				// Only look at already loaded thread IDs, to not block the UI.
+				if m.HasData(cmdg.LevelMinimal) {
+					if tid, err := m.ThreadID(context.Background()); err == nil && tid == threadID {
+						if n < view.pos {
+							pos--
+						}
+						continue
+					}
+				}
+				nm = append(nm, m)
+			}
+			view.messages = nm
+			view.pos = pos
+			if view.pos >= len(view.messages) && view.pos != 0 {
+				view.pos = len(view.messages) - 1
+			}
+		},
+		next: next,
+	}
+}
+
 func OpQuit() *MessageViewOp {
 	return &MessageViewOp{
 		quit: true,
@@ -353,12 +474,13 @@ func (mv *MessageView) Run(ctx context.Context) error {
 
 	initScreen := func() error {
 		var err error
+		display.Invalidate()
 		screen, err = display.NewScreen()
 		if err != nil {
 			return err
 		}
 		contentHeight = screen.Height - 2
-		scroll = 0 // TODO: only scroll back if we need to.
+		scroll = keepVisible(mv.pos, scroll, contentHeight)
 		return nil
 	}
 	if err := initScreen(); err != nil {
@@ -370,6 +492,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 		for n, m := range mv.messages {
 			messagePos[m.ID] = n
 		}
+		mv.threadCounts = countThreads(ctx, mv.messages)
 	}
 	empty := func() {
 		screen.Printf(0, 0, "Loading…")
@@ -383,52 +506,31 @@ func (mv *MessageView) Run(ctx context.Context) error {
 	empty()
 
 	drawMessage := func(cur int) error {
-		s := "Loading…"
 		if cur >= len(mv.messages) {
 			return fmt.Errorf("trying to draw message %d with len %d", cur, len(mv.messages))
 		}
 		curmsg := mv.messages[cur]
 
-		prefix := " "
 		reset := display.Reset
 		if cur == mv.pos {
-			reset = display.Reverse
-			prefix = "*"
+			reset = display.ActiveTheme.Selection
+		}
+		attrs := ""
+		if curmsg.IsUnread() {
+			attrs = display.ActiveTheme.Unread
+		}
+		if curmsg.HasLabel(cmdg.Starred) {
+			attrs = display.ActiveTheme.Starred + attrs
 		}
 
+		shortLabels := false
+		get := func(field byte, arg string) (string, error) {
+			return mv.listField(ctx, curmsg, field, arg, cur == mv.pos, marked[curmsg.ID], shortLabels)
+		}
+
+		f := loadingListFormat
 		if curmsg.HasData(cmdg.LevelMetadata) {
-			subj, err := curmsg.GetHeader(ctx, "subject")
-			if errors.Cause(err) == cmdg.ErrMissing || subj == "" {
-				subj = "(No subject)"
-			} else if err != nil {
-				return err
-			}
-			tm, err := curmsg.GetTimeFmt(ctx)
-			if err != nil {
-				return err
-			}
-			from, err := curmsg.GetFrom(ctx)
-			if err != nil {
-				return err
-			}
-			colors, fullColors, err := curmsg.GetLabelColors(ctx, mv.label)
-			if err != nil {
-				return err
-			}
-			if len(colors) > 0 {
-				colors = " | " + colors
-				fullColors = " | " + fullColors
-			}
-			from = display.FixedWidth(from, 20)
-			s = fmt.Sprintf("%[1]*.[1]*[2]s | %[3]s | %[4]s",
-				6, tm,
-				from, subj)
-			if display.StringWidth(s)+display.StringWidth(fullColors) < screen.Width {
-				s += fullColors
-			} else {
-				s += colors
-			}
-			s += reset
+			f = messageListFormat
 		} else {
 			go func(cur int) {
 				if err := curmsg.Preload(ctx, cmdg.LevelMetadata); err != nil {
@@ -444,26 +546,17 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				}
 			}(cur)
 		}
-
-		if marked[curmsg.ID] {
-			prefix += "X"
-		} else {
-			prefix += " "
-		}
-
-		if curmsg.IsUnread() {
-			prefix = display.Bold + prefix + ">"
-		} else {
-			prefix += " "
+		s, err := f.render(get)
+		if err != nil {
+			return err
 		}
-
-		star := " "
-		if curmsg.HasLabel(cmdg.Starred) {
-			star = "*"
-			prefix = display.Yellow + prefix
+		if display.StringWidth(s) >= screen.Width {
+			shortLabels = true
+			if s, err = f.render(get); err != nil {
+				return err
+			}
 		}
-
-		screen.Printlnf(cur-scroll, "%s%s%s%s", reset, prefix, star, s)
+		screen.Printlnf(cur-scroll, "%s%s%s%s", reset, attrs, s, reset)
 		return nil
 	}
 
@@ -650,11 +743,13 @@ func (mv *MessageView) Run(ctx context.Context) error {
 			screen.Draw()
 			continue
 		case m := <-mv.messageCh:
+			// Its thread is now known.
+			mv.threadCounts = countThreads(ctx, mv.messages)
 			cur := messagePos[m.ID]
 			if err := drawMessage(cur); err != nil {
 				mv.errors <- errors.Wrapf(err, "Drawing message")
 			}
-			screen.Draw() // TODO: avoid redrawing whole screen.
+			screen.Draw()
 			continue
 		case p := <-mv.pageCh:
 			log.Printf("MessageListView: Got page!")
@@ -686,11 +781,34 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				log.Errorf("MessageList: Input channel closed!")
 				continue
 			}
+			if input.IsPaste(key) {
+				log.Infof("Ignoring paste in message list")
+				continue
+			}
 			log.Debugf("MessageListView got key %q", key)
-			switch key {
-			case "?", input.F1:
-				help(messageListViewHelp, mv.keys)
-			case input.Enter:
+			action := mv.keys.Keymap().Action(viewMessageList, key)
+			if e, ok := input.ParseMouse(key); ok {
+				action = mouseHandled
+				switch e.Button {
+				case input.MouseWheelUp:
+					action = "prev"
+				case input.MouseWheelDown:
+					action = "next"
+				case input.MouseLeft:
+					if e.Y < contentHeight && e.Y+scroll < len(mv.messages) {
+						mv.pos = e.Y + scroll
+						if e.Double {
+							action = "open"
+						}
+					}
+				}
+			}
+			switch action {
+			case mouseHandled:
+				// Already handled, just redraw.
+			case "help":
+				help(viewHelp(mv.keys, viewMessageList), mv.keys)
+			case "open":
 				if len(mv.messages) == 0 {
 					// Let's assume we've never gotten to the state where mv.pos >= len(mv.messages)
 					break
@@ -730,12 +848,12 @@ func (mv *MessageView) Run(ctx context.Context) error {
 					}
 					break
 				}
-			case input.CtrlL:
+			case "redraw":
 				if err := initScreen(); err != nil {
 					// Screen failed to init. Yeah it's time to bail.
 					return err
 				}
-			case "e":
+			case "archive":
 				ok, nm, ofs := mv.applyMarked(ctx, "archive", conn.BatchArchive, marked)
 				if !ok {
 					break
@@ -750,7 +868,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 					marked = map[string]bool{}
 					mkMessagePos()
 				}
-			case "d":
+			case "trash":
 				ok, nm, ofs := mv.applyMarked(ctx, "delete", conn.BatchTrash, marked)
 				if !ok {
 					break
@@ -764,7 +882,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				marked = map[string]bool{}
 				mkMessagePos()
 
-			case "*":
+			case "star":
 				// TODO: Because it's a toggle this is not suitable for batch operation.
 				curmsg := mv.messages[mv.pos]
 				f := curmsg.AddLabelID
@@ -782,8 +900,8 @@ func (mv *MessageView) Run(ctx context.Context) error {
 						mv.errors <- errors.Wrapf(err, "%s STARRED label", verb)
 					}
 				}()
-			case "l":
-				// TODO: can this be partially merged with 'L' code?
+			case "label":
+				// TODO: can this be partially merged with unlabel code?
 				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
 				if len(ids) != 0 {
 					var opts []*dialog.Option
@@ -793,19 +911,22 @@ func (mv *MessageView) Run(ctx context.Context) error {
 							Label: l.Label,
 						})
 					}
-					label, err := dialog.Selection(opts, "Label> ", false, mv.keys)
+					labels, err := dialog.MultiSelection(opts, "Label> ", nil, mv.keys)
 					if errors.Cause(err) == dialog.ErrAborted {
 						// No-op.
 					} else if err != nil {
 						mv.errors <- errors.Wrapf(err, "Selecting label")
 					} else {
+						lids := dialog.OptionKeys(labels)
 						for _, id := range ids {
-							mv.messages[messagePos[id]].AddLabelIDLocal(label.Key)
+							for _, l := range lids {
+								mv.messages[messagePos[id]].AddLabelIDLocal(l)
+							}
 						}
-						log.Infof("Batch labelling %q/%q %d messages in the background…", label.Key, label.Label, len(ids))
+						log.Infof("Batch labelling %q %d messages in the background…", lids, len(ids))
 						go func() {
 							st := time.Now()
-							if err := conn.BatchLabel(ctx, ids, label.Key); err != nil {
+							if err := conn.BatchLabel(ctx, ids, lids...); err != nil {
 								mv.errors <- errors.Wrapf(err, "Batch labelling")
 							} else {
 								log.Infof("Batch labelled %d: %v", len(ids), time.Since(st))
@@ -813,7 +934,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 						}()
 					}
 				}
-			case "L":
+			case "unlabel":
 				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
 				if len(ids) != 0 {
 					var opts []*dialog.Option
@@ -833,19 +954,22 @@ func (mv *MessageView) Run(ctx context.Context) error {
 						})
 					}
 					if len(opts) > 0 {
-						label, err := dialog.Selection(opts, "Label> ", false, mv.keys)
+						labels, err := dialog.MultiSelection(opts, "Label> ", nil, mv.keys)
 						if errors.Cause(err) == dialog.ErrAborted {
 							// No-op.
 						} else if err != nil {
 							mv.errors <- errors.Wrapf(err, "Selecting label")
 						} else {
+							lids := dialog.OptionKeys(labels)
 							for _, id := range ids {
-								mv.messages[messagePos[id]].RemoveLabelIDLocal(label.Key)
+								for _, l := range lids {
+									mv.messages[messagePos[id]].RemoveLabelIDLocal(l)
+								}
 							}
-							log.Infof("Batch unlabelling %q/%q from %d messages in the background…", label.Key, label.Label, len(ids))
+							log.Infof("Batch unlabelling %q from %d messages in the background…", lids, len(ids))
 							go func() {
 								st := time.Now()
-								if err := conn.BatchUnlabel(ctx, ids, label.Key); err != nil {
+								if err := conn.BatchUnlabel(ctx, ids, lids...); err != nil {
 									mv.errors <- errors.Wrapf(err, "Batch labelling")
 								} else {
 									log.Infof("Batch unlabelled %d: %v", len(ids), time.Since(st))
@@ -854,38 +978,46 @@ func (mv *MessageView) Run(ctx context.Context) error {
 						}
 					}
 				}
-			case "c":
-				if err := composeNew(ctx, conn, mv.keys); err != nil {
+			case "compose":
+				if err := composeNew(ctx, conn, mv.keys, nil); err != nil {
 					mv.errors <- errors.Wrapf(err, "Composing new message")
 				}
-			case "C":
+			case "continue-draft":
 				if err := continueDraft(ctx, conn, mv.keys); err != nil {
 					mv.errors <- errors.Wrapf(err, "Continuing draft")
 				}
-			case input.Home:
+			case "first":
 				mv.pos = 0
 				scroll = 0
-			case "x", " ":
+			case "last":
+				if len(mv.messages) == 0 {
+					break
+				}
+				mv.pos = len(mv.messages) - 1
+				if t := mv.pos - (contentHeight - scrollLimit); t > scroll {
+					scroll = t
+				}
+			case "mark-next":
 				marked[mv.messages[mv.pos].ID] = !marked[mv.messages[mv.pos].ID]
 				next()
-			case "X":
+			case "mark-prev":
 				marked[mv.messages[mv.pos].ID] = !marked[mv.messages[mv.pos].ID]
 				prev()
-			case "N", "n", "j", input.CtrlN, input.Down:
+			case "next":
 				if !next() {
 					// If already on last one, don't redraw.
 					continue
 				}
-			case "P", "p", "k", input.CtrlP, input.Up:
+			case "prev":
 				if !prev() {
 					// If already on first one, don't redraw.
 					continue
 				}
-			case "r", input.CtrlR:
+			case "reload":
 				empty()
 				screen.Clear()
 				go mv.fetchPage(ctx, "")
-			case "g":
+			case "goto-label":
 				var opts []*dialog.Option
 				for _, l := range conn.Labels() {
 					if strings.HasPrefix(l.ID, "CATEGORY_") {
@@ -910,11 +1042,11 @@ func (mv *MessageView) Run(ctx context.Context) error {
 					// stack frame on every navigation.
 					return nv.Run(ctx)
 				}
-			case "1":
+			case "inbox":
 				// TODO: not optimal, since it adds a
 				// stack frame on every navigation.
 				return NewMessageView(ctx, cmdg.Inbox, "", mv.keys).Run(ctx)
-			case "s", input.CtrlS:
+			case "search":
 				q, err := dialog.Entry("Query> ", mv.keys)
 				if err == dialog.ErrAborted {
 					// That's fine.
@@ -926,11 +1058,17 @@ func (mv *MessageView) Run(ctx context.Context) error {
 					// stack frame on every navigation.
 					return nv.Run(ctx)
 				}
-			case "q":
+			case "quit":
 				return nil
 			default:
 				log.Infof("MessageListView got unknown key %q %v", key, []byte(key))
 			}
+			if screen.SizeChanged() {
+				// Resized while a dialog or another view was showing.
+				if err := initScreen(); err != nil {
+					return err
+				}
+			}
 		}
 		if mv.messages != nil {
 			// Draw to buffer.
@@ -954,10 +1092,10 @@ func (mv *MessageView) Run(ctx context.Context) error {
 		}
 		// Print status.
 		if theresMore {
-			status += display.Color(50) + "Loading…"
+			status += "Loading…"
 		}
 		screen.Printlnf(screen.Height-2, "%s", strings.Repeat("—", screen.Width))
-		screen.Printlnf(screen.Height-1, "%s", status)
+		screen.Printlnf(screen.Height-1, "%s%s", display.ActiveTheme.Status, status)
 
 		// Draw.
 		st := time.Now()
@@ -965,3 +1103,20 @@ func (mv *MessageView) Run(ctx context.Context) error {
 		log.Debugf("Draw took %v", time.Since(st))
 	}
 }
+
+// keepVisible returns the scroll position closest to `scroll` that shows line `pos` with `height` lines.
+func keepVisible(pos, scroll, height int) int {
+	if height < 1 {
+		height = 1
+	}
+	if scroll > pos {
+		scroll = pos
+	}
+	if pos-scroll >= height {
+		scroll = pos - height + 1
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+	return scroll
+}
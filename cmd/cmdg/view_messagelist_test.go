@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+)
+
+func TestKeepVisible(t *testing.T) {
+	for _, test := range []struct {
+		pos, scroll, height int
+		want                int
+	}{
+		{0, 0, 10, 0},
+		{5, 0, 10, 0},
+		{5, 3, 10, 3},  // Already visible.
+		{15, 3, 10, 6}, // Below, e.g. after shrinking.
+		{2, 3, 10, 2},  // Above.
+		{9, 0, 10, 0},
+		{10, 0, 10, 1},
+		{0, 5, 0, 0},
+	} {
+		if got := keepVisible(test.pos, test.scroll, test.height); got != test.want {
+			t.Errorf("keepVisible(%d, %d, %d) = %d, want %d", test.pos, test.scroll, test.height, got, test.want)
+		}
+	}
+}
+
+func TestCountThreads(t *testing.T) {
+	c, err := cmdg.NewFake(&http.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := func(id, thread string) *cmdg.Message {
+		return cmdg.NewMessageWithResponse(c, id, &gmail.Message{Id: id, ThreadId: thread}, cmdg.LevelMinimal)
+	}
+	msgs := []*cmdg.Message{
+		msg("1", "a"),
+		msg("2", "b"),
+		msg("3", "a"),
+		msg("4", "a"),
+		cmdg.NewMessage(c, "5"), // Not loaded.
+	}
+	got := countThreads(context.Background(), msgs)
+	if want := map[cmdg.ThreadID]int{"a": 3, "b": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
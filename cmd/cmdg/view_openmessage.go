@@ -18,41 +18,18 @@ import (
 	"github.com/ThomasHabets/cmdg/pkg/cmdg"
 	"github.com/ThomasHabets/cmdg/pkg/dialog"
 	"github.com/ThomasHabets/cmdg/pkg/display"
+	"github.com/ThomasHabets/cmdg/pkg/gpg"
 	"github.com/ThomasHabets/cmdg/pkg/input"
 )
 
 const (
 	tsLayout = "2006-01-02 15:04:05"
-
-	openMessageViewHelp = `?, F1     — Help
-^R             — Reload
-l              — Add label
-L              — Remove label
-*              — Toggle "starred"
-u              — Exit message
-U              — Mark unread
-n, Down        — Scroll down
-space          — Page down
-backspace      — Page up
-p, Up          — Scroll up
-^P             — Previous message
-^N             — Next message
-f              — Forward message
-r              — Reply
-s, ^s          — Search within message
-a              — Reply all
-e              — Archive
-t              — Browse attachments (if any)
-H              — Force HTML view
-\              — Show raw message source
-|              — Pipe to command
-
-Press [enter] to exit
-`
 )
 
 var (
 	enableDottime = flag.Bool("dottime", false, "Enable dottime.")
+
+	quotePrefixRE = regexp.MustCompile(`^>[> ]*`)
 )
 
 func isGraphicString(s string) bool {
@@ -93,13 +70,19 @@ func help(txt string, keys *input.Input) error {
 			maxlen = n
 		}
 	}
-	screen.Printlnf(0, strings.Repeat("—", screen.Width))
-	for n, l := range lines {
-		screen.Printlnf(n+1, "%s%s", strings.Repeat(" ", (screen.Width-maxlen)/2), l)
-	}
 	for {
+		screen.Printlnf(0, strings.Repeat("—", screen.Width))
+		for n, l := range lines {
+			screen.Printlnf(n+1, "%s%s", strings.Repeat(" ", (screen.Width-maxlen)/2), l)
+		}
 		screen.Draw()
-		k := <-keys.Chan()
+		k, resized := keys.KeyOrResize()
+		if resized {
+			if screen, err = display.NewScreen(); err != nil {
+				return err
+			}
+			continue
+		}
 		switch k {
 		case input.Enter:
 			return nil
@@ -120,8 +103,19 @@ type OpenMessageView struct {
 	incrementalCurrent  int
 	incrementalQuery    string
 
+	// Body lines before wrapping, and which of them each displayed line comes from.
+	bodyLines  []string
+	lineSource []int
+
+	// Selected range of displayed lines, for quoting in replies. -1 if none.
+	selStart int
+	selEnd   int
+	marking  bool
+
 	// Local view state. Main goroutine only.
 	preferHTML bool
+	noWrap     bool // Scroll sideways instead of wrapping long lines.
+	hscroll    int  // Columns scrolled sideways, if not wrapping.
 }
 
 func dottime(t time.Time) string {
@@ -140,6 +134,9 @@ func NewOpenMessageView(ctx context.Context, msg *cmdg.Message, in *input.Input)
 		screen: screen,
 		update: make(chan struct{}),
 		errors: make(chan error, 20),
+
+		selStart: -1,
+		selEnd:   -1,
 	}
 	go func() {
 		st := time.Now()
@@ -169,9 +166,23 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 	if ov.inIncrementalSearch {
 		searching = fmt.Sprintf(" Incremental search: %s (at %d of %d)", ov.incrementalQuery, ov.incrementalCurrent, ov.incrementalCount)
 	}
+	if ov.noWrap {
+		searching += fmt.Sprintf(" Not wrapping, at column %d", ov.hscroll+1)
+	}
+	if ov.marking {
+		ov.selEnd = scroll
+	}
+	selStart, selEnd := ov.selection()
+	if selStart >= 0 {
+		verb := "Selected"
+		if ov.marking {
+			verb = "Selecting"
+		}
+		searching += fmt.Sprintf(" %s %d lines for reply", verb, selEnd-selStart+1)
+	}
 
 	// TODO: msg index.
-	ov.screen.Printlnf(line, "Email %d of %d (%d%%)%s", -1, -1, int(100*float64(scroll)/float64(len(lines)-contentSpace)), searching)
+	ov.screen.Printlnf(line, "%sEmail %d of %d (%d%%)%s", display.ActiveTheme.Status, -1, -1, int(100*float64(scroll)/float64(len(lines)-contentSpace)), searching)
 	line++
 
 	// From.
@@ -183,23 +194,12 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 	var signed string
 	var encrypted string
 	if st := ov.msg.GPGStatus(); st != nil {
-		if st.Signed != "" {
-			if st.GoodSignature {
-				signed = fmt.Sprintf(" — signed by %s", st.Signed)
-				if len(st.Warnings) == 0 {
-					signed = display.Bold + display.Green + signed
-				} else {
-					signed = " but with warnings"
-				}
-			} else {
-				signed = fmt.Sprintf("%s — BAD signature from %s", display.Bold+display.Red, st.Signed)
-			}
-		}
+		signed = signatureStatus(st)
 		if len(st.Encrypted) != 0 {
-			encrypted = fmt.Sprintf("%s — Encrypted to %s", display.Green+display.Bold, strings.Join(st.Encrypted, ";"))
+			encrypted = fmt.Sprintf("%s — Encrypted to %s", display.Bold+display.ActiveTheme.SignatureGood, strings.Join(st.Encrypted, ";"))
 		}
 	}
-	ov.screen.Printlnf(line, "From: %s%s", from, signed)
+	ov.screen.Printlnf(line, "%s%s", header("From"), from+signed)
 	line++
 
 	// To.
@@ -208,7 +208,7 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 		ov.errors <- err
 		to = fmt.Sprintf("Unknown: %q", err)
 	}
-	ov.screen.Printlnf(line, "To: %s%s", to, encrypted)
+	ov.screen.Printlnf(line, "%s%s", header("To"), to+encrypted)
 	line++
 
 	// CC.
@@ -216,7 +216,7 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 	if err != nil {
 		cc = ""
 	}
-	ov.screen.Printlnf(line, "CC: %s", cc)
+	ov.screen.Printlnf(line, "%s%s", header("CC"), cc)
 	line++
 
 	// Date.
@@ -229,7 +229,7 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 	if *enableDottime {
 		dt = fmt.Sprintf(" (dottime: %s)", dottime(date))
 	}
-	ov.screen.Printlnf(line, "Date: %s%s", dateLocal.Format(tsLayout), dt)
+	ov.screen.Printlnf(line, "%s%s%s", header("Date"), dateLocal.Format(tsLayout), dt)
 	line++
 
 	// Subject
@@ -238,7 +238,7 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 		ov.errors <- err
 		subject = fmt.Sprintf("Unknown: %q", err)
 	}
-	ov.screen.Printlnf(line, "Subject: %s", subject)
+	ov.screen.Printlnf(line, "%s%s", header("Subject"), subject)
 	line++
 
 	// Labels
@@ -247,7 +247,7 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 		ov.errors <- err
 		labels = fmt.Sprintf("Unknown: %q", err)
 	}
-	ov.screen.Printlnf(line, "Labels: %s", labels)
+	ov.screen.Printlnf(line, "%s%s", header("Labels"), labels)
 	line++
 
 	ov.screen.Printlnf(line, strings.Repeat("—", ov.screen.Width))
@@ -255,8 +255,18 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 
 	// Draw body.
 	if len(lines) > scroll {
-		for _, l := range lines[scroll:] {
+		for n, l := range lines[scroll:] {
 			l = strings.TrimRight(l, "\r ")
+			q := display.ActiveTheme.QuoteLevel(quoteLevel(l))
+			if ov.noWrap {
+				l = display.DropColumns(l, ov.hscroll)
+			}
+			if q != "" {
+				l = q + l + display.Reset
+			}
+			if n+scroll >= selStart && n+scroll <= selEnd {
+				l = display.ActiveTheme.Selection + l + display.Reset
+			}
 			ov.screen.Printlnf(line, "%s", l)
 			line++
 			if line >= ov.screen.Height-2 {
@@ -270,30 +280,153 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 	return nil
 }
 
-func showError(oscreen *display.Screen, keys *input.Input, msg string) {
-	log.Warningf("Displaying error to user: %q", msg)
+// selection returns the selected range of displayed lines, or -1 if none.
+func (ov *OpenMessageView) selection() (int, int) {
+	if ov.selStart < 0 {
+		return -1, -1
+	}
+	if ov.selStart > ov.selEnd {
+		return ov.selEnd, ov.selStart
+	}
+	return ov.selStart, ov.selEnd
+}
 
-	screen := oscreen.Copy()
-	lines := []string{
-		strings.Repeat("—", screen.Width),
+// toggleMark starts selecting at the top line, ends the selection, or clears it.
+func (ov *OpenMessageView) toggleMark(scroll int) {
+	switch {
+	case ov.marking:
+		ov.selEnd = scroll
+		ov.marking = false
+	case ov.selStart >= 0:
+		ov.selStart, ov.selEnd = -1, -1
+	default:
+		ov.selStart, ov.selEnd = scroll, scroll
+		ov.marking = true
+	}
+}
+
+// selectionText returns the selected body lines, to be quoted in a reply.
+func (ov *OpenMessageView) selectionText() string {
+	if ov.marking {
+		return ""
 	}
-	for len(msg) > 0 {
-		this := msg
-		if len(this) > screen.Width {
-			this, msg = msg[:screen.Width], msg[screen.Width:]
-		} else {
-			msg = ""
+	a, b := ov.selection()
+	if a < 0 || b >= len(ov.lineSource) {
+		return ""
+	}
+	var ret []string
+	for _, l := range ov.bodyLines[ov.lineSource[a] : ov.lineSource[b]+1] {
+		ret = append(ret, display.StripANSI(l))
+	}
+	return strings.Join(ret, "\n")
+}
+
+// header formats a header name for the message view.
+func header(name string) string {
+	return fmt.Sprintf("%s%s:%s ", display.ActiveTheme.Header, name, display.Reset)
+}
+
+// quotePrefix returns the quote markers at the start of a line, e.g. "> > ".
+func quotePrefix(l string) string {
+	return quotePrefixRE.FindString(l)
+}
+
+// quoteLevel returns how many levels of quoting a line has, e.g. 2 for "> > hello".
+func quoteLevel(l string) int {
+	n := 0
+	for _, r := range display.StripANSI(l) {
+		switch r {
+		case '>':
+			n++
+		case ' ':
+		default:
+			return n
 		}
-		lines = append(lines, this)
 	}
-	lines = append(lines, "Press [enter] to continue", lines[0])
-	start := (screen.Height - len(lines)) / 2
-	for n, l := range lines {
-		screen.Printlnf(start+n, "%s%s", display.Red, l)
+	return n
+}
+
+// signatureStatus returns the header annotation describing a signature.
+func signatureStatus(st *gpg.Status) string {
+	if st.UnknownKey {
+		return fmt.Sprintf("%s — signed by unknown key %s", display.Bold+display.ActiveTheme.SignatureWarn, st.KeyID)
+	}
+	if st.Signed == "" {
+		return ""
 	}
-	screen.Draw()
+	if !st.GoodSignature {
+		return fmt.Sprintf("%s — BAD signature from %s", display.Bold+display.ActiveTheme.SignatureBad, st.Signed)
+	}
+
+	var details []string
+	if !st.SignatureTime.IsZero() {
+		details = append(details, "made "+st.SignatureTime.Local().Format(tsLayout))
+	}
+	if st.Fingerprint != "" {
+		details = append(details, "key "+st.Fingerprint)
+	}
+	if st.Trust != gpg.TrustUnknown {
+		details = append(details, "trust "+string(st.Trust))
+	}
+	detail := ""
+	if len(details) > 0 {
+		detail = " (" + strings.Join(details, ", ") + ")"
+	}
+
+	switch {
+	case st.KeyRevoked:
+		return fmt.Sprintf("%s — signed by %s, but key is REVOKED%s", display.Bold+display.ActiveTheme.SignatureBad, st.Signed, detail)
+	case st.Trust == gpg.TrustNever:
+		return fmt.Sprintf("%s — signed by %s, but key is NOT trusted%s", display.Bold+display.ActiveTheme.SignatureBad, st.Signed, detail)
+	case st.IdentityMismatch:
+		return fmt.Sprintf("%s — valid signature, but from a different identity: %s%s", display.Bold+display.ActiveTheme.SignatureWarn, st.Signed, detail)
+	case st.KeyExpired:
+		return fmt.Sprintf("%s — signed by %s, but key has expired%s", display.Bold+display.ActiveTheme.SignatureWarn, st.Signed, detail)
+	case st.SignatureExpired:
+		return fmt.Sprintf("%s — signed by %s, but signature has expired%s", display.Bold+display.ActiveTheme.SignatureWarn, st.Signed, detail)
+	case len(st.Warnings) != 0:
+		return fmt.Sprintf("%s — signed by %s, but with warnings: %s%s", display.Bold+display.ActiveTheme.SignatureWarn, st.Signed, strings.Join(st.Warnings, "; "), detail)
+	case st.Trust == gpg.TrustUndefined || st.Trust == gpg.TrustMarginal:
+		return fmt.Sprintf("%s — signed by %s%s", display.ActiveTheme.SignatureGood, st.Signed, detail)
+	}
+	return fmt.Sprintf("%s — signed by %s%s", display.Bold+display.ActiveTheme.SignatureGood, st.Signed, detail)
+}
+
+func showError(oscreen *display.Screen, keys *input.Input, msg string) {
+	log.Warningf("Displaying error to user: %q", msg)
+
+	screen := oscreen.Copy()
 	for {
-		if input.Enter == <-keys.Chan() {
+		lines := []string{
+			strings.Repeat("—", screen.Width),
+		}
+		for rest := msg; len(rest) > 0; {
+			this := rest
+			if len(this) > screen.Width {
+				this, rest = rest[:screen.Width], rest[screen.Width:]
+			} else {
+				rest = ""
+			}
+			lines = append(lines, this)
+		}
+		lines = append(lines, "Press [enter] to continue", lines[0])
+		start := (screen.Height - len(lines)) / 2
+		for n, l := range lines {
+			screen.Printlnf(start+n, "%s%s", display.ActiveTheme.Error, l)
+		}
+		screen.Draw()
+		key, resized := keys.KeyOrResize()
+		if resized {
+			// The screen behind is redrawn by its view once the error is dismissed.
+			s, err := display.NewScreen()
+			if err != nil {
+				log.Errorf("Failed to create screen after resize: %v", err)
+				return
+			}
+			screen = s
+			continue
+		}
+		if key == input.Enter {
 			return
 		}
 	}
@@ -320,10 +453,24 @@ func (ov *OpenMessageView) incrementalSearch(ctx context.Context, inlines []stri
 			return -1, ctx.Err()
 		case key, ok = <-ov.keys.Chan():
 			break
+		case <-ov.keys.Winch():
+			// Redraw the search as is. The body is rewrapped when the search ends.
+			s, err := display.NewScreen()
+			if err != nil {
+				return -1, err
+			}
+			ov.screen = s
+			key, ok = "", true
 		}
 		if !ok {
 			return -1, fmt.Errorf("incremental search key read channel closed")
 		}
+		if input.IsMouse(key) {
+			continue
+		}
+		if p, ok := input.PasteText(key); ok {
+			key = strings.TrimRight(p, "\r\n")
+		}
 		switch key {
 		case input.CtrlC:
 			return found, nil
@@ -360,7 +507,7 @@ func (ov *OpenMessageView) incrementalSearch(ctx context.Context, inlines []stri
 						// Current hit.
 						ov.incrementalCurrent = ov.incrementalCount
 						found = n
-						lines[n] = hilightIncremental(lines[n], m, display.Reverse+display.Yellow)
+						lines[n] = hilightIncremental(lines[n], m, display.ActiveTheme.SearchMatch)
 					} else {
 						// Other hits that may be visible.
 						lines[n] = hilightIncremental(lines[n], m, display.Reverse)
@@ -392,12 +539,9 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 	scroll := 0
 	initScreen := func() error {
 		var err error
+		display.Invalidate()
 		ov.screen, err = display.NewScreen()
-		if err != nil {
-			return err
-		}
-		scroll = 0
-		return nil
+		return err
 	}
 	if err := initScreen(); err != nil {
 		return nil, err
@@ -405,19 +549,36 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 	ov.screen.Printf(0, 0, "Loading…")
 	ov.screen.Draw()
 	var lines []string
+
+	// rewrap wraps the body again, keeping the same body line at the top.
+	rewrap := func() {
+		if ov.bodyLines == nil {
+			ov.screen.Printf(0, 0, "Loading…")
+			return
+		}
+		lines, scroll = ov.rewrap(ov.screen.Width, scroll)
+		scroll = ov.scroll(cancelledContext(), len(lines), scroll, 0)
+		ov.screen.Clear()
+		ov.Draw(lines, scroll)
+	}
+
+	// relayout makes a new screen for the current terminal size, and rewraps the body.
+	// The scroll position is kept by rewrap, so initScreen mustn't reset it.
+	relayout := func() error {
+		if err := initScreen(); err != nil {
+			return err
+		}
+		rewrap()
+		return nil
+	}
 	for {
 		select {
 		case <-ov.keys.Winch():
 			log.Infof("OpenMessageView got WINCH")
-			s := scroll
-			if err := initScreen(); err != nil {
+			if err := relayout(); err != nil {
 				// Screen failed to init. Yeah it's time to bail.
 				return nil, err
 			}
-			scroll = s
-			go func() {
-				ov.update <- struct{}{}
-			}()
 		case err := <-ov.errors:
 			if err != nil {
 				showError(ov.screen, ov.keys, err.Error())
@@ -434,24 +595,9 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 			if err != nil {
 				ov.errors <- errors.Wrapf(err, "Getting message body")
 			} else {
-				lines = []string{}
-				for _, l := range strings.Split(b, "\n") {
-					if len(l) == 0 {
-						lines = append(lines, "")
-						continue
-					}
-					for len(l) > 0 {
-						// TODO: break on runewidth
-						// TODO: break on word boundary
-						if len(l) > ov.screen.Width {
-							lines = append(lines, l[:ov.screen.Width])
-							l = l[ov.screen.Width:]
-						} else {
-							lines = append(lines, l)
-							l = ""
-						}
-					}
-				}
+				ov.bodyLines = strings.Split(b, "\n")
+				ov.selStart, ov.selEnd, ov.marking = -1, -1, false
+				lines = ov.wrap(ov.screen.Width)
 			}
 			go func() {
 				if ov.msg.IsUnread() {
@@ -466,7 +612,7 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				// messageview; label list gets
 				// updated by RemoveLabelID.
 			}()
-			// Redraw could include fewer lines, because 'H' toggled HTML.
+			// Redraw could include fewer lines, because HTML view was toggled.
 			ov.screen.Clear()
 
 			// TODO: double check that scroll is not too high after `lines` was recreated.
@@ -477,17 +623,33 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				continue
 			}
 
-			switch key {
-			case input.CtrlR:
+			if input.IsPaste(key) {
+				log.Infof("Ignoring paste in message view")
+				continue
+			}
+			action := ov.keys.Keymap().Action(viewMessage, key)
+			if e, ok := input.ParseMouse(key); ok {
+				action = mouseHandled
+				switch e.Button {
+				case input.MouseWheelUp:
+					action = "scroll-up"
+				case input.MouseWheelDown:
+					action = "scroll-down"
+				}
+			}
+			switch action {
+			case mouseHandled:
+				// Nothing to do.
+			case "reload":
 				go func() {
 					if err := ov.msg.Reload(ctx, cmdg.LevelFull); err != nil {
 						ov.errors <- errors.Wrap(err, "reloading message")
 					}
 					ov.update <- struct{}{}
 				}()
-			case "?", input.F1:
-				help(openMessageViewHelp, ov.keys)
-			case "*":
+			case "help":
+				help(viewHelp(ov.keys, viewMessage), ov.keys)
+			case "star":
 				if ov.msg.HasLabel(cmdg.Starred) {
 					if err := ov.msg.RemoveLabelID(ctx, cmdg.Starred); err != nil {
 						ov.errors <- errors.Wrap(err, "Removing STARRED label")
@@ -501,7 +663,7 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 					ov.errors <- errors.Wrapf(err, "Failed to reload labels")
 				}
 				ov.Draw(lines, scroll)
-			case "l":
+			case "label":
 				var opts []*dialog.Option
 				for _, l := range conn.Labels() {
 					opts = append(opts, &dialog.Option{
@@ -509,14 +671,14 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 						Label: l.Label,
 					})
 				}
-				label, err := dialog.Selection(opts, "Label> ", false, ov.keys)
+				chosen, err := dialog.MultiSelection(opts, "Label> ", nil, ov.keys)
 				if errors.Cause(err) == dialog.ErrAborted {
 					// No-op.
 				} else if err != nil {
 					ov.errors <- errors.Wrapf(err, "Selecting label")
 				} else {
 					st := time.Now()
-					if err := ov.msg.AddLabelID(ctx, label.Key); err != nil {
+					if err := ov.msg.AddLabelIDs(ctx, dialog.OptionKeys(chosen)); err != nil {
 						ov.errors <- errors.Wrapf(err, "Failed to label")
 					} else {
 						log.Infof("Labelled: %v", time.Since(st))
@@ -526,7 +688,7 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 					}
 				}
 				ov.Draw(lines, scroll)
-			case "L":
+			case "unlabel":
 				var opts []*dialog.Option
 				labels, err := ov.msg.GetLabels(ctx, true)
 				if err != nil {
@@ -538,14 +700,14 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 							Label: l.Label,
 						})
 					}
-					label, err := dialog.Selection(opts, "Label> ", false, ov.keys)
+					chosen, err := dialog.MultiSelection(opts, "Label> ", nil, ov.keys)
 					if errors.Cause(err) == dialog.ErrAborted {
 						// No-op.
 					} else if err != nil {
 						ov.errors <- errors.Wrapf(err, "Selecting label")
 					} else {
 						st := time.Now()
-						if err := ov.msg.RemoveLabelID(ctx, label.Key); err != nil {
+						if err := ov.msg.RemoveLabelIDs(ctx, dialog.OptionKeys(chosen)); err != nil {
 							ov.errors <- errors.Wrapf(err, "Failed to unlabel")
 						} else {
 							log.Infof("Unlabelled: %v", time.Since(st))
@@ -556,57 +718,78 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 					}
 					ov.Draw(lines, scroll)
 				}
-			case "u":
+			case "close":
 				return nil, nil
-			case "q":
+			case "quit":
 				return OpQuit(), nil
-			case input.CtrlP:
+			case "prev-message":
 				return OpPrev(), nil
-			case input.CtrlN:
+			case "next-message":
 				return OpNext(), nil
-			case "U":
+			case "mark-unread":
 				if err := ov.msg.AddLabelID(ctx, cmdg.Unread); err != nil {
 					ov.errors <- fmt.Errorf("Failed to mark unread : %v", err)
 				} else {
 					return nil, nil
 				}
-			case input.Home:
+			case "top":
 				scroll = 0
 				ov.Draw(lines, scroll)
-			case "n", input.Down:
+			case "bottom":
+				scroll = ov.scroll(ctx, len(lines), scroll, len(lines))
+				ov.Draw(lines, scroll)
+			case "scroll-down":
 				scroll = ov.scroll(ctx, len(lines), scroll, 1)
 				ov.Draw(lines, scroll)
-			case " ", input.CtrlV, input.PgDown:
+			case "page-down":
 				scroll = ov.scroll(ctx, len(lines), scroll, ov.screen.Height-10)
 				ov.Draw(lines, scroll)
-			case "p", input.Up:
+			case "scroll-up":
 				scroll = ov.scroll(ctx, len(lines), scroll, -1)
 				ov.Draw(lines, scroll)
-			case "f":
-				if err := forward(ctx, conn, ov.keys, ov.msg); err != nil {
+			case "forward":
+				if err := forward(ctx, conn, ov.keys, ov.msg, forwardInline); err != nil {
+					ov.errors <- fmt.Errorf("Failed to forward: %v", err)
+				}
+			case "forward-as":
+				if mode, err := chooseForwardMode(ov.keys); errors.Cause(err) == dialog.ErrAborted {
+					log.Infof("Forward aborted")
+				} else if err != nil {
+					ov.errors <- fmt.Errorf("Failed to forward: %v", err)
+				} else if err := forward(ctx, conn, ov.keys, ov.msg, mode); err != nil {
 					ov.errors <- fmt.Errorf("Failed to forward: %v", err)
 				}
-			case "r":
-				if err := reply(ctx, conn, ov.keys, ov.msg); err != nil {
+			case "reply":
+				if op, err := reply(ctx, conn, ov.keys, ov.msg, ov.selectionText()); err != nil {
 					ov.errors <- fmt.Errorf("Failed to reply: %v", err)
+				} else if op != nil {
+					// Sent and archived.
+					return op, nil
 				}
-			case "a":
-				if err := replyAll(ctx, conn, ov.keys, ov.msg); err != nil {
+			case "reply-all":
+				if op, err := replyAll(ctx, conn, ov.keys, ov.msg, ov.selectionText()); err != nil {
 					ov.errors <- fmt.Errorf("Failed to replyAll: %v", err)
+				} else if op != nil {
+					// Sent and archived.
+					return op, nil
 				}
-			case "H":
+			case "select":
+				ov.toggleMark(scroll)
+				ov.Draw(lines, scroll)
+			case "html":
 				ov.preferHTML = !ov.preferHTML
 				scroll = 0
 				go func() {
 					ov.update <- struct{}{}
 				}()
-			case "e": // Archive
+			case "archive":
 				if err := ov.msg.RemoveLabelID(ctx, cmdg.Inbox); err != nil {
 					ov.errors <- fmt.Errorf("Failed to archive : %v", err)
 				} else {
 					return OpRemoveCurrent(nil), nil
 				}
-			case "s", input.CtrlS: // Search
+			case "search":
+				width := ov.screen.Width
 				ns, err := ov.incrementalSearch(ctx, lines)
 				if err != nil {
 					return nil, err
@@ -614,8 +797,12 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				if ns > 0 {
 					scroll = ns
 				}
+				if ov.screen.Width != width {
+					// Resized during the search.
+					rewrap()
+				}
 				ov.Draw(lines, scroll)
-			case "t": // Attachmments
+			case "attachments":
 				as, err := ov.msg.Attachments(ctx)
 				if err != nil {
 					ov.errors <- fmt.Errorf("Listing attachments failed: %v", err)
@@ -626,11 +813,11 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 						ov.errors <- fmt.Errorf("Attachment browser action failed: %v", err)
 					}
 				}
-			case "\\":
+			case "raw":
 				if err := ov.showRaw(ctx); err != nil {
 					ov.errors <- err
 				}
-			case "|":
+			case "pipe":
 				cmds, err := dialog.Entry("Command> ", ov.keys)
 				if err == dialog.ErrAborted || cmds == "" {
 					// User aborted; do nothing.
@@ -654,17 +841,120 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 					break
 				}
 				ov.errors <- ov.showPager(ctx, buf.String())
-			case input.Backspace, input.CtrlH, input.PgUp, "Meta-v":
+			case "page-up":
 				scroll = ov.scroll(ctx, len(lines), scroll, -(ov.screen.Height - 10))
 				ov.Draw(lines, scroll)
+			case "wrap":
+				ov.noWrap = !ov.noWrap
+				ov.hscroll = 0
+				rewrap()
+			case "scroll-left":
+				ov.hscrollBy(lines, -ov.screen.Width/2)
+				ov.Draw(lines, scroll)
+			case "scroll-right":
+				if ov.noWrap {
+					ov.hscrollBy(lines, ov.screen.Width/2)
+				}
+				ov.Draw(lines, scroll)
 			default:
 				log.Infof("Unknown key: %q", key)
 			}
+			if ov.screen.SizeChanged() {
+				// Resized while a dialog or another view was showing.
+				if err := relayout(); err != nil {
+					return nil, err
+				}
+			}
 		}
 		ov.screen.Draw()
 	}
 }
 
+// wrap breaks the body lines to fit the width, and records where each displayed line comes from.
+// If not wrapping, lines are kept whole and scrolled sideways instead.
+func (ov *OpenMessageView) wrap(width int) []string {
+	lines := []string{}
+	ov.lineSource = nil
+	for src, l := range ov.bodyLines {
+		ls := []string{display.ExpandTabs(l)}
+		if !ov.noWrap {
+			ls = display.Wrap(l, width, quotePrefix(l))
+		}
+		for range ls {
+			ov.lineSource = append(ov.lineSource, src)
+		}
+		lines = append(lines, ls...)
+	}
+	return lines
+}
+
+// rewrap wraps the body again for the width, keeping the same body lines
+// selected. Returns the new lines, and where to scroll to keep the body
+// line that was at the top of the screen there.
+func (ov *OpenMessageView) rewrap(width, scroll int) ([]string, int) {
+	top := -1
+	if scroll >= 0 && scroll < len(ov.lineSource) {
+		top = ov.lineSource[scroll]
+	}
+	selStart, selEnd := -1, -1
+	if ov.selStart >= 0 && ov.selStart < len(ov.lineSource) && ov.selEnd < len(ov.lineSource) {
+		selStart, selEnd = ov.lineSource[ov.selStart], ov.lineSource[ov.selEnd]
+	}
+	lines := ov.wrap(width)
+	if top >= 0 {
+		scroll = ov.displayLine(top)
+	}
+	switch {
+	case selStart < 0:
+		ov.selStart, ov.selEnd, ov.marking = -1, -1, false
+	case selStart <= selEnd:
+		ov.selStart, ov.selEnd = ov.displayLine(selStart), ov.lastDisplayLine(selEnd)
+	default:
+		// Marked upwards.
+		ov.selStart, ov.selEnd = ov.lastDisplayLine(selStart), ov.displayLine(selEnd)
+	}
+	return lines, scroll
+}
+
+// hscrollBy scrolls sideways, but not past the widest line.
+func (ov *OpenMessageView) hscrollBy(lines []string, inc int) {
+	widest := 0
+	for _, l := range lines {
+		if w := display.StringWidth(l); w > widest {
+			widest = w
+		}
+	}
+	ov.hscroll += inc
+	if limit := widest - ov.screen.Width; ov.hscroll > limit {
+		ov.hscroll = limit
+	}
+	if ov.hscroll < 0 {
+		ov.hscroll = 0
+	}
+}
+
+// displayLine returns the first displayed line of a body line.
+func (ov *OpenMessageView) displayLine(src int) int {
+	for n, s := range ov.lineSource {
+		if s >= src {
+			return n
+		}
+	}
+	return 0
+}
+
+// lastDisplayLine returns the last displayed line that comes from the given body line.
+func (ov *OpenMessageView) lastDisplayLine(src int) int {
+	ret := 0
+	for n, s := range ov.lineSource {
+		if s > src {
+			break
+		}
+		ret = n
+	}
+	return ret
+}
+
 func (ov *OpenMessageView) showRaw(ctx context.Context) error {
 	m, err := ov.msg.Raw(ctx)
 	if err != nil {
@@ -676,6 +966,7 @@ func (ov *OpenMessageView) showRaw(ctx context.Context) error {
 func (ov *OpenMessageView) showPager(ctx context.Context, content string) error {
 	ov.keys.Stop()
 	defer ov.keys.Start()
+	defer display.Invalidate()
 
 	cmd := exec.CommandContext(ctx, pagerBinary)
 	cmd.Stdin = strings.NewReader(content)
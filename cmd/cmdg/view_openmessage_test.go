@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisplayLine(t *testing.T) {
+	// Body line 1 wraps into three display lines, and line 3 into two.
+	ov := &OpenMessageView{lineSource: []int{0, 1, 1, 1, 2, 3, 3}}
+	for _, test := range []struct {
+		src, first, last int
+	}{
+		{0, 0, 0},
+		{1, 1, 3},
+		{2, 4, 4},
+		{3, 5, 6},
+	} {
+		if got := ov.displayLine(test.src); got != test.first {
+			t.Errorf("displayLine(%d) = %d, want %d", test.src, got, test.first)
+		}
+		if got := ov.lastDisplayLine(test.src); got != test.last {
+			t.Errorf("lastDisplayLine(%d) = %d, want %d", test.src, got, test.last)
+		}
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	words := strings.Repeat("word ", 30)
+	ov := &OpenMessageView{
+		bodyLines: []string{"Hi,", "", words, "> " + words, words, "Bye"},
+		selStart:  -1,
+		selEnd:    -1,
+	}
+	ov.wrap(20)
+	if ov.displayLine(3) == ov.lastDisplayLine(3) {
+		t.Fatalf("Long line not wrapped: %v", ov.lineSource)
+	}
+
+	for _, test := range []struct {
+		name     string
+		topSrc   int
+		midLine  bool // Scrolled to a later display line of the top body line.
+		selStart int  // Body lines, or -1 for no selection.
+		selEnd   int
+	}{
+		{name: "top", topSrc: 0, selStart: -1},
+		{name: "wrapped top", topSrc: 3, selStart: -1},
+		{name: "middle of wrapped top", topSrc: 3, midLine: true, selStart: -1},
+		{name: "selection", topSrc: 2, selStart: 2, selEnd: 4},
+		{name: "selection upwards", topSrc: 2, selStart: 4, selEnd: 2},
+		{name: "single line selection", topSrc: 1, selStart: 3, selEnd: 3},
+	} {
+		for _, widths := range [][2]int{{80, 20}, {20, 80}, {20, 33}} {
+			ov.wrap(widths[0])
+			scroll := ov.displayLine(test.topSrc)
+			if test.midLine {
+				scroll = ov.lastDisplayLine(test.topSrc)
+			}
+			ov.selStart, ov.selEnd = -1, -1
+			if test.selStart >= 0 {
+				if test.selStart <= test.selEnd {
+					ov.selStart, ov.selEnd = ov.displayLine(test.selStart), ov.lastDisplayLine(test.selEnd)
+				} else {
+					ov.selStart, ov.selEnd = ov.lastDisplayLine(test.selStart), ov.displayLine(test.selEnd)
+				}
+			}
+
+			lines, got := ov.rewrap(widths[1], scroll)
+			if len(lines) != len(ov.lineSource) {
+				t.Fatalf("%s %v: %d lines but %d line sources", test.name, widths, len(lines), len(ov.lineSource))
+			}
+			if want := ov.displayLine(test.topSrc); got != want {
+				t.Errorf("%s %v: scroll %d, want %d", test.name, widths, got, want)
+			}
+			if src := ov.lineSource[got]; src != test.topSrc {
+				t.Errorf("%s %v: top body line %d, want %d", test.name, widths, src, test.topSrc)
+			}
+
+			if test.selStart < 0 {
+				if ov.selStart != -1 || ov.selEnd != -1 {
+					t.Errorf("%s %v: selection %d-%d appeared", test.name, widths, ov.selStart, ov.selEnd)
+				}
+				continue
+			}
+			lo, hi := test.selStart, test.selEnd
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			first, last := ov.selection()
+			if want := ov.displayLine(lo); first != want {
+				t.Errorf("%s %v: selection starts at %d, want %d", test.name, widths, first, want)
+			}
+			if want := ov.lastDisplayLine(hi); last != want {
+				t.Errorf("%s %v: selection ends at %d, want %d", test.name, widths, last, want)
+			}
+			if (ov.selStart > ov.selEnd) != (test.selStart > test.selEnd) {
+				t.Errorf("%s %v: selection direction changed", test.name, widths)
+			}
+		}
+	}
+}
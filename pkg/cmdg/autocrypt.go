@@ -0,0 +1,265 @@
+package cmdg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// https://autocrypt.org/level1.html
+
+const (
+	AutocryptHeader = "Autocrypt"
+
+	PreferEncryptMutual       = "mutual"
+	PreferEncryptNoPreference = "nopreference"
+
+	autocryptLineLength = 76
+
+	// Peers whose last Autocrypt header is this much older than their last mail are stale.
+	autocryptStale = 35 * 24 * time.Hour
+)
+
+var (
+	// Autocrypt is the peer state store. If nil, incoming Autocrypt headers are ignored.
+	Autocrypt *AutocryptStore
+)
+
+// Recommendation is the Autocrypt recommendation for encrypting a message.
+type Recommendation int
+
+const (
+	RecommendDisable Recommendation = iota
+	RecommendDiscourage
+	RecommendAvailable
+	RecommendEncrypt
+)
+
+// AutocryptPeer is what we know about one peer.
+type AutocryptPeer struct {
+	Addr               string
+	LastSeen           time.Time
+	AutocryptTimestamp time.Time
+	KeyData            []byte
+	PreferEncrypt      string
+}
+
+// stale returns true if the peer has kept mailing without Autocrypt headers for a while.
+func (p *AutocryptPeer) stale() bool {
+	return p.LastSeen.Sub(p.AutocryptTimestamp) > autocryptStale
+}
+
+// AutocryptStore is the local Autocrypt peer state, saved as JSON.
+type AutocryptStore struct {
+	fn    string
+	m     sync.Mutex
+	Peers map[string]*AutocryptPeer
+}
+
+// LoadAutocrypt loads the peer state store from the given file. A missing file is an empty store.
+func LoadAutocrypt(fn string) (*AutocryptStore, error) {
+	s := &AutocryptStore{
+		fn:    fn,
+		Peers: make(map[string]*AutocryptPeer),
+	}
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading autocrypt state %q", fn)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, errors.Wrapf(err, "parsing autocrypt state %q", fn)
+	}
+	return s, nil
+}
+
+// save writes the store to disk. Called with lock held.
+func (s *AutocryptStore) save() error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(s.fn), 0700); err != nil {
+		return errors.Wrapf(err, "creating autocrypt state directory %q", path.Dir(s.fn))
+	}
+	tmp := s.fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrapf(err, "writing autocrypt state %q", tmp)
+	}
+	return os.Rename(tmp, s.fn)
+}
+
+// parseAutocrypt parses an Autocrypt header value.
+func parseAutocrypt(v string) (*AutocryptPeer, error) {
+	p := &AutocryptPeer{
+		PreferEncrypt: PreferEncryptNoPreference,
+	}
+	for _, attr := range strings.Split(v, ";") {
+		attr = strings.TrimSpace(attr)
+		if attr == "" {
+			continue
+		}
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed autocrypt attribute %q", attr)
+		}
+		k, val := strings.TrimSpace(kv[0]), kv[1]
+		switch k {
+		case "addr":
+			p.Addr = strings.ToLower(strings.TrimSpace(val))
+		case "prefer-encrypt":
+			if strings.TrimSpace(val) == PreferEncryptMutual {
+				p.PreferEncrypt = PreferEncryptMutual
+			}
+		case "keydata":
+			kd, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(val), ""))
+			if err != nil {
+				return nil, errors.Wrapf(err, "decoding autocrypt keydata")
+			}
+			p.KeyData = kd
+		default:
+			// Unknown critical attributes invalidate the header.
+			if !strings.HasPrefix(k, "_") {
+				return nil, fmt.Errorf("unknown critical autocrypt attribute %q", k)
+			}
+		}
+	}
+	if p.Addr == "" || len(p.KeyData) == 0 {
+		return nil, fmt.Errorf("autocrypt header missing addr or keydata")
+	}
+	return p, nil
+}
+
+// Observe updates peer state from an incoming message's From, Date, and Autocrypt header (may be empty).
+// The store is only written when a peer's key, preference, or staleness changes.
+func (s *AutocryptStore) Observe(from string, date time.Time, header string) error {
+	a, err := mail.ParseAddress(from)
+	if err != nil {
+		return errors.Wrapf(err, "parsing From address %q", from)
+	}
+	addr := strings.ToLower(a.Address)
+	if date.After(time.Now()) {
+		// Don't let messages from the future lock state.
+		date = time.Now()
+	}
+
+	var hp *AutocryptPeer
+	if header != "" {
+		hp, err = parseAutocrypt(header)
+		if err != nil {
+			log.Warningf("Ignoring invalid Autocrypt header from %q: %v", addr, err)
+			hp = nil
+		} else if hp.Addr != addr {
+			log.Warningf("Ignoring Autocrypt header for %q in mail from %q", hp.Addr, addr)
+			hp = nil
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	peer, found := s.Peers[addr]
+	if !found {
+		if hp == nil {
+			// Only keep state for peers that have used Autocrypt.
+			return nil
+		}
+		peer = &AutocryptPeer{Addr: addr}
+		s.Peers[addr] = peer
+	}
+	if !date.After(peer.LastSeen) {
+		return nil
+	}
+	wasStale := peer.stale()
+	peer.LastSeen = date
+	changed := false
+	if hp != nil {
+		peer.AutocryptTimestamp = date
+		if !bytes.Equal(peer.KeyData, hp.KeyData) || peer.PreferEncrypt != hp.PreferEncrypt {
+			peer.KeyData = hp.KeyData
+			peer.PreferEncrypt = hp.PreferEncrypt
+			log.Infof("Learned Autocrypt key for %q (prefer-encrypt=%s)", addr, peer.PreferEncrypt)
+			changed = true
+		}
+	}
+	if !changed && peer.stale() == wasStale {
+		// Timestamps alone aren't worth a write. They're saved with the next change.
+		return nil
+	}
+	return s.save()
+}
+
+// Keys returns the keys for all the addresses, or an error if any is missing.
+func (s *AutocryptStore) Keys(addrs []string) ([][]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var ret [][]byte
+	for _, a := range addrs {
+		p, found := s.Peers[strings.ToLower(a)]
+		if !found || len(p.KeyData) == 0 {
+			return nil, fmt.Errorf("no Autocrypt key known for %q", a)
+		}
+		ret = append(ret, p.KeyData)
+	}
+	return ret, nil
+}
+
+// Recommend returns the Autocrypt recommendation for a message to the given addresses.
+// That's the weakest of the per-recipient recommendations.
+func (s *AutocryptStore) Recommend(addrs []string, preferMutual bool) Recommendation {
+	if s == nil || len(addrs) == 0 {
+		return RecommendDisable
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	ret := RecommendEncrypt
+	for _, a := range addrs {
+		p, found := s.Peers[strings.ToLower(a)]
+		if !found || len(p.KeyData) == 0 {
+			return RecommendDisable
+		}
+		r := RecommendAvailable
+		switch {
+		case p.stale():
+			r = RecommendDiscourage
+		case preferMutual && p.PreferEncrypt == PreferEncryptMutual:
+			r = RecommendEncrypt
+		}
+		if r < ret {
+			ret = r
+		}
+	}
+	return ret
+}
+
+// MakeAutocryptHeader makes an Autocrypt header value, folded for use as a raw header.
+func MakeAutocryptHeader(addr string, keydata []byte, mutual bool) string {
+	attrs := []string{"addr=" + addr}
+	if mutual {
+		attrs = append(attrs, "prefer-encrypt="+PreferEncryptMutual)
+	}
+	attrs = append(attrs, "keydata=")
+	ret := strings.Join(attrs, "; ")
+	kd := base64.StdEncoding.EncodeToString(keydata)
+	for len(kd) > 0 {
+		n := autocryptLineLength
+		if n > len(kd) {
+			n = len(kd)
+		}
+		ret += "\r\n " + kd[:n]
+		kd = kd[n:]
+	}
+	return ret
+}
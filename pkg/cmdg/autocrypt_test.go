@@ -0,0 +1,337 @@
+package cmdg
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseAutocrypt(t *testing.T) {
+	key := []byte("some key data")
+	kd := base64.StdEncoding.EncodeToString(key)
+	for _, test := range []struct {
+		name  string
+		in    string
+		want  *AutocryptPeer
+		isErr bool
+	}{
+		{
+			name: "minimal",
+			in:   "addr=foo@example.com; keydata=" + kd,
+			want: &AutocryptPeer{Addr: "foo@example.com", KeyData: key, PreferEncrypt: PreferEncryptNoPreference},
+		},
+		{
+			name: "mutual",
+			in:   "addr=foo@example.com; prefer-encrypt=mutual; keydata=" + kd,
+			want: &AutocryptPeer{Addr: "foo@example.com", KeyData: key, PreferEncrypt: PreferEncryptMutual},
+		},
+		{
+			name: "unknown prefer-encrypt",
+			in:   "addr=foo@example.com; prefer-encrypt=sometimes; keydata=" + kd,
+			want: &AutocryptPeer{Addr: "foo@example.com", KeyData: key, PreferEncrypt: PreferEncryptNoPreference},
+		},
+		{
+			name: "folded keydata and uppercase addr",
+			in:   "addr=Foo@Example.COM; keydata=\r\n " + kd[:8] + "\r\n " + kd[8:],
+			want: &AutocryptPeer{Addr: "foo@example.com", KeyData: key, PreferEncrypt: PreferEncryptNoPreference},
+		},
+		{
+			name: "non-critical attribute",
+			in:   "addr=foo@example.com; _extra=yes; keydata=" + kd + ";",
+			want: &AutocryptPeer{Addr: "foo@example.com", KeyData: key, PreferEncrypt: PreferEncryptNoPreference},
+		},
+		{
+			name:  "critical attribute",
+			in:    "addr=foo@example.com; extra=yes; keydata=" + kd,
+			isErr: true,
+		},
+		{
+			name:  "no addr",
+			in:    "keydata=" + kd,
+			isErr: true,
+		},
+		{
+			name:  "no keydata",
+			in:    "addr=foo@example.com",
+			isErr: true,
+		},
+		{
+			name:  "bad keydata",
+			in:    "addr=foo@example.com; keydata=!!!",
+			isErr: true,
+		},
+		{
+			name:  "malformed attribute",
+			in:    "addr=foo@example.com; mutual; keydata=" + kd,
+			isErr: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseAutocrypt(test.in)
+			if test.isErr {
+				if err == nil {
+					t.Errorf("Want error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func newTestAutocrypt(t *testing.T) (*AutocryptStore, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cmdg-autocrypt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadAutocrypt(path.Join(dir, "autocrypt.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestAutocryptObserve(t *testing.T) {
+	hdr := func(key string, mutual bool) string {
+		return MakeAutocryptHeader("foo@example.com", []byte(key), mutual)
+	}
+	day := func(n int) time.Time {
+		return time.Date(2020, 1, n, 0, 0, 0, 0, time.UTC)
+	}
+	type obs struct {
+		from   string
+		date   time.Time
+		header string
+	}
+	for _, test := range []struct {
+		name string
+		obs  []obs
+		want *AutocryptPeer
+	}{
+		{
+			name: "no header from unknown peer",
+			obs:  []obs{{"foo@example.com", day(1), ""}},
+		},
+		{
+			name: "learn key",
+			obs:  []obs{{"Foo <Foo@example.com>", day(1), hdr("A", true)}},
+			want: &AutocryptPeer{Addr: "foo@example.com", LastSeen: day(1), AutocryptTimestamp: day(1), KeyData: []byte("A"), PreferEncrypt: PreferEncryptMutual},
+		},
+		{
+			name: "newer key wins",
+			obs: []obs{
+				{"foo@example.com", day(1), hdr("A", true)},
+				{"foo@example.com", day(2), hdr("B", false)},
+			},
+			want: &AutocryptPeer{Addr: "foo@example.com", LastSeen: day(2), AutocryptTimestamp: day(2), KeyData: []byte("B"), PreferEncrypt: PreferEncryptNoPreference},
+		},
+		{
+			name: "older key ignored",
+			obs: []obs{
+				{"foo@example.com", day(2), hdr("B", false)},
+				{"foo@example.com", day(1), hdr("A", true)},
+			},
+			want: &AutocryptPeer{Addr: "foo@example.com", LastSeen: day(2), AutocryptTimestamp: day(2), KeyData: []byte("B"), PreferEncrypt: PreferEncryptNoPreference},
+		},
+		{
+			name: "newer mail without header keeps key",
+			obs: []obs{
+				{"foo@example.com", day(1), hdr("A", true)},
+				{"foo@example.com", day(3), ""},
+			},
+			want: &AutocryptPeer{Addr: "foo@example.com", LastSeen: day(3), AutocryptTimestamp: day(1), KeyData: []byte("A"), PreferEncrypt: PreferEncryptMutual},
+		},
+		{
+			name: "stale",
+			obs: []obs{
+				{"foo@example.com", day(1), hdr("A", true)},
+				{"foo@example.com", day(40), ""},
+			},
+			want: &AutocryptPeer{Addr: "foo@example.com", LastSeen: day(40), AutocryptTimestamp: day(1), KeyData: []byte("A"), PreferEncrypt: PreferEncryptMutual},
+		},
+		{
+			name: "header for other address ignored",
+			obs: []obs{
+				{"bar@example.com", day(1), hdr("A", true)},
+			},
+		},
+		{
+			name: "invalid header ignored",
+			obs: []obs{
+				{"foo@example.com", day(1), hdr("A", true)},
+				{"foo@example.com", day(2), "addr=foo@example.com; keydata=!!!"},
+			},
+			want: &AutocryptPeer{Addr: "foo@example.com", LastSeen: day(2), AutocryptTimestamp: day(1), KeyData: []byte("A"), PreferEncrypt: PreferEncryptMutual},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s, cleanup := newTestAutocrypt(t)
+			defer cleanup()
+			for _, o := range test.obs {
+				if err := s.Observe(o.from, o.date, o.header); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := s.Peers["foo@example.com"]
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAutocryptObserveFuture(t *testing.T) {
+	s, cleanup := newTestAutocrypt(t)
+	defer cleanup()
+	future := time.Now().Add(24 * time.Hour)
+	if err := s.Observe("foo@example.com", future, MakeAutocryptHeader("foo@example.com", []byte("A"), false)); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Peers["foo@example.com"].LastSeen; !got.Before(future) {
+		t.Errorf("LastSeen = %v, want clamped to now", got)
+	}
+}
+
+func TestAutocryptSave(t *testing.T) {
+	s, cleanup := newTestAutocrypt(t)
+	defer cleanup()
+	day := func(n int) time.Time {
+		return time.Date(2020, 1, n, 0, 0, 0, 0, time.UTC)
+	}
+	saved := func() bool {
+		_, err := os.Stat(s.fn)
+		return err == nil
+	}
+
+	if err := s.Observe("foo@example.com", day(1), MakeAutocryptHeader("foo@example.com", []byte("A"), false)); err != nil {
+		t.Fatal(err)
+	}
+	if !saved() {
+		t.Fatalf("New key not saved")
+	}
+
+	// Nothing changed but timestamps.
+	os.Remove(s.fn)
+	if err := s.Observe("foo@example.com", day(2), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Observe("foo@example.com", day(3), MakeAutocryptHeader("foo@example.com", []byte("A"), false)); err != nil {
+		t.Fatal(err)
+	}
+	if saved() {
+		t.Errorf("Store saved without a peer change")
+	}
+
+	// Preference changed.
+	if err := s.Observe("foo@example.com", day(4), MakeAutocryptHeader("foo@example.com", []byte("A"), true)); err != nil {
+		t.Fatal(err)
+	}
+	if !saved() {
+		t.Fatalf("Changed preference not saved")
+	}
+
+	// Became stale.
+	os.Remove(s.fn)
+	if err := s.Observe("foo@example.com", day(4).Add(36*24*time.Hour), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !saved() {
+		t.Fatalf("Stale peer not saved")
+	}
+
+	// Still stale.
+	os.Remove(s.fn)
+	if err := s.Observe("foo@example.com", day(4).Add(37*24*time.Hour), ""); err != nil {
+		t.Fatal(err)
+	}
+	if saved() {
+		t.Errorf("Store saved when peer stayed stale")
+	}
+
+	// No longer stale.
+	if err := s.Observe("foo@example.com", day(4).Add(38*24*time.Hour), MakeAutocryptHeader("foo@example.com", []byte("A"), true)); err != nil {
+		t.Fatal(err)
+	}
+	if !saved() {
+		t.Fatalf("Peer no longer stale not saved")
+	}
+
+	// Reload, and get the same state back.
+	s2, err := LoadAutocrypt(s.fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s2.Peers, s.Peers; !reflect.DeepEqual(got, want) {
+		t.Errorf("Reloaded %+v, want %+v", got, want)
+	}
+}
+
+func TestAutocryptRecommend(t *testing.T) {
+	now := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := &AutocryptStore{
+		Peers: map[string]*AutocryptPeer{
+			"mutual@example.com":  {Addr: "mutual@example.com", KeyData: []byte("A"), PreferEncrypt: PreferEncryptMutual},
+			"mutual2@example.com": {Addr: "mutual2@example.com", KeyData: []byte("B"), PreferEncrypt: PreferEncryptMutual},
+			"nopref@example.com":  {Addr: "nopref@example.com", KeyData: []byte("C"), PreferEncrypt: PreferEncryptNoPreference},
+			"nokey@example.com":   {Addr: "nokey@example.com", PreferEncrypt: PreferEncryptMutual},
+			"stale@example.com": {
+				Addr: "stale@example.com", KeyData: []byte("D"), PreferEncrypt: PreferEncryptMutual,
+				LastSeen: now, AutocryptTimestamp: now.Add(-36 * 24 * time.Hour),
+			},
+			"recent@example.com": {
+				Addr: "recent@example.com", KeyData: []byte("E"), PreferEncrypt: PreferEncryptMutual,
+				LastSeen: now, AutocryptTimestamp: now.Add(-34 * 24 * time.Hour),
+			},
+		},
+	}
+	for _, test := range []struct {
+		addrs  []string
+		mutual bool
+		want   Recommendation
+	}{
+		{nil, true, RecommendDisable},
+		{[]string{"mutual@example.com"}, true, RecommendEncrypt},
+		{[]string{"Mutual@Example.com"}, true, RecommendEncrypt},
+		{[]string{"mutual@example.com"}, false, RecommendAvailable},
+		{[]string{"mutual@example.com", "mutual2@example.com"}, true, RecommendEncrypt},
+		{[]string{"mutual@example.com", "nopref@example.com"}, true, RecommendAvailable},
+		{[]string{"nopref@example.com"}, true, RecommendAvailable},
+		{[]string{"mutual@example.com", "unknown@example.com"}, true, RecommendDisable},
+		{[]string{"nokey@example.com"}, true, RecommendDisable},
+		{[]string{"stale@example.com"}, true, RecommendDiscourage},
+		{[]string{"stale@example.com", "mutual@example.com"}, true, RecommendDiscourage},
+		{[]string{"stale@example.com", "nopref@example.com"}, true, RecommendDiscourage},
+		{[]string{"stale@example.com", "nokey@example.com"}, true, RecommendDisable},
+		{[]string{"recent@example.com"}, true, RecommendEncrypt},
+	} {
+		if got := s.Recommend(test.addrs, test.mutual); got != test.want {
+			t.Errorf("Recommend(%q, %v) = %v, want %v", test.addrs, test.mutual, got, test.want)
+		}
+	}
+
+	var nilStore *AutocryptStore
+	if got := nilStore.Recommend([]string{"mutual@example.com"}, true); got != RecommendDisable {
+		t.Errorf("nil store Recommend = %v, want %v", got, RecommendDisable)
+	}
+
+	keys, err := s.Keys([]string{"mutual@example.com", "NOPREF@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{[]byte("A"), []byte("C")}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys = %q, want %q", keys, want)
+	}
+	if _, err := s.Keys([]string{"nokey@example.com"}); err == nil {
+		t.Errorf("Keys succeeded for peer without key")
+	}
+}
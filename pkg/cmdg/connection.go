@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
@@ -24,6 +25,7 @@ import (
 	"golang.org/x/oauth2"
 	drive "google.golang.org/api/drive/v3"
 	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/googleapi/transport"
 	people "google.golang.org/api/people/v1"
 )
@@ -37,6 +39,10 @@ const (
 	accessType = "offline"
 	email      = "me"
 
+	// AttachHeader is a pseudo-header that can be written in the
+	// editor to attach files. It's never sent.
+	AttachHeader = "Attach"
+
 	LevelEmpty    DataLevel = ""         // Nothing
 	LevelMinimal  DataLevel = "minimal"  // ID, labels
 	LevelMetadata DataLevel = "metadata" // ID, labels, headers
@@ -99,6 +105,8 @@ func (c *CmdG) LabelCache(label *Label) *Label {
 func NewFake(client *http.Client) (*CmdG, error) {
 	conn := &CmdG{
 		authedClient: client,
+		messageCache: make(map[string]*Message),
+		labelCache:   make(map[string]*Label),
 	}
 	return conn, conn.setupClients()
 }
@@ -253,6 +261,9 @@ func (c *CmdG) GetProfile(ctx context.Context) (*gmail.Profile, error) {
 type Part struct {
 	Contents string
 	Header   textproto.MIMEHeader
+
+	// If set, the contents are instead read from here, and base64 encoded.
+	Open func() (io.ReadCloser, error)
 }
 
 func (p *Part) FullString() string {
@@ -273,15 +284,23 @@ func (p *Part) FullString() string {
 }
 
 // ParseUserMessage parses what's in the user's editor and turns into into a Part and message headers.
-func ParseUserMessage(in string) (mail.Header, *Part, error) {
+// `Attach:` pseudo-headers are removed from the headers, and their values returned.
+func ParseUserMessage(in string) (mail.Header, *Part, []string, error) {
 	m, err := mail.ReadMessage(strings.NewReader(in))
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "message to send is malformed")
+		return nil, nil, nil, errors.Wrapf(err, "message to send is malformed")
 	}
 	b, err := ioutil.ReadAll(m.Body)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "failed to read user message")
+		return nil, nil, nil, errors.Wrapf(err, "failed to read user message")
+	}
+	var attach []string
+	for _, v := range m.Header[AttachHeader] {
+		if v = strings.TrimSpace(v); v != "" {
+			attach = append(attach, v)
+		}
 	}
+	delete(m.Header, AttachHeader)
 	m.Header["MIME-Version"] = []string{"1.0"}
 	return m.Header, &Part{
 		Header: map[string][]string{
@@ -289,20 +308,33 @@ func ParseUserMessage(in string) (mail.Header, *Part, error) {
 			"Content-Disposition": []string{"inline"},
 		},
 		Contents: string(b),
-	}, nil
+	}, attach, nil
 }
 
-// SendParts sends a multipart message.
+// WriteEntity writes parts as a multipart MIME entity, including its
+// own Content-Type header but no message headers. Parts with `Open`
+// set are streamed, so attachments are never fully in memory.
 // Args:
 //   mp:    multipart type. "mixed" is a typical type.
-//   head:  Email header.
 //   parts: Email parts.
-func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head mail.Header, parts []*Part) error {
-	var mbuf bytes.Buffer
-	w := multipart.NewWriter(&mbuf)
+func WriteEntity(out io.Writer, mp string, parts []*Part) error {
+	w := multipart.NewWriter(out)
+	hlines := []string{
+		fmt.Sprintf(`Content-Type: multipart/%s; boundary="%s"`, mp, w.Boundary()),
+		`Content-Disposition: inline`,
+	}
+	if _, err := io.WriteString(out, strings.Join(hlines, "\r\n")+"\r\n\r\n"); err != nil {
+		return errors.Wrapf(err, "writing entity headers")
+	}
 
 	// Create mail contents.
 	for _, p := range parts {
+		if p.Open != nil {
+			if err := writeStreamedPart(w, p); err != nil {
+				return err
+			}
+			continue
+		}
 		p2, err := w.CreatePart(p.Header)
 		if err != nil {
 			return errors.Wrapf(err, "failed to create part")
@@ -311,10 +343,46 @@ func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head
 			return errors.Wrapf(err, "assembling part")
 		}
 	}
-	if err := w.Close(); err != nil {
-		return errors.Wrapf(err, "closing multipart")
+	return errors.Wrapf(w.Close(), "closing multipart")
+}
+
+// MakeEntity is like WriteEntity, but returns the entity as a string.
+// Used when the whole entity is needed anyway, such as for encryption.
+func MakeEntity(mp string, parts []*Part) (string, error) {
+	var buf bytes.Buffer
+	if err := WriteEntity(&buf, mp, parts); err != nil {
+		return "", err
 	}
+	return buf.String(), nil
+}
 
+// SendParts sends a multipart message, streaming it to the server.
+// Args:
+//   mp:    multipart type. "mixed" is a typical type.
+//   head:  Email header.
+//   parts: Email parts.
+func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head mail.Header, parts []*Part) error {
+	hlines, err := formatHeaders(head)
+	if err != nil {
+		return err
+	}
+	r, w := io.Pipe()
+	defer r.Close()
+	go func() {
+		w.CloseWithError(func() error {
+			if len(hlines) > 0 {
+				if _, err := io.WriteString(w, strings.Join(hlines, "\r\n")+"\r\n"); err != nil {
+					return err
+				}
+			}
+			return WriteEntity(w, mp, parts)
+		}())
+	}()
+	return c.send(ctx, threadID, r)
+}
+
+// formatHeaders turns message headers into encoded header lines, sorted.
+func formatHeaders(head mail.Header) ([]string, error) {
 	addrHeader := map[string]bool{
 		"to":       true,
 		"cc":       true,
@@ -322,17 +390,26 @@ func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head
 		"reply-to": true,
 	}
 
+	// Headers that are already encoded and folded, and go in as-is.
+	rawHeader := map[string]bool{
+		strings.ToLower(AutocryptHeader): true,
+	}
+
 	// Add message headers for gmail.
 	var hlines []string
 	for k, vs := range head {
-		if addrHeader[strings.ToLower(k)] {
+		if rawHeader[strings.ToLower(k)] {
+			for _, v := range vs {
+				hlines = append(hlines, fmt.Sprintf("%s: %s", k, v))
+			}
+		} else if addrHeader[strings.ToLower(k)] {
 			for _, v := range vs {
 				if v == "" {
 					continue
 				}
 				as, err := mail.ParseAddressList(v)
 				if err != nil {
-					return errors.Wrapf(err, "parsing address list %q, which is %q", k, v)
+					return nil, errors.Wrapf(err, "parsing address list %q, which is %q", k, v)
 				}
 				var ass []string
 				for _, a := range as {
@@ -352,19 +429,31 @@ func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head
 		}
 	}
 	sort.Strings(hlines)
-	hlines = append(hlines, fmt.Sprintf(`Content-Type: multipart/%s; boundary="%s"`, mp, w.Boundary()))
-	hlines = append(hlines, `Content-Disposition: inline`)
-	msgs := strings.Join(hlines, "\r\n") + "\r\n\r\n" + mbuf.String()
+	return hlines, nil
+}
+
+// SendEntity sends a message made up of the given headers and an
+// already assembled MIME entity, as returned by MakeEntity.
+func (c *CmdG) SendEntity(ctx context.Context, threadID ThreadID, head mail.Header, entity string) error {
+	hlines, err := formatHeaders(head)
+	if err != nil {
+		return err
+	}
+	msgs := entity
+	if len(hlines) > 0 {
+		msgs = strings.Join(hlines, "\r\n") + "\r\n" + entity
+	}
 
 	log.Infof("Final message: %q", msgs)
-	return c.send(ctx, threadID, msgs)
+	return c.send(ctx, threadID, strings.NewReader(msgs))
 }
 
-func (c *CmdG) send(ctx context.Context, threadID ThreadID, msg string) error {
+// send uploads a raw RFC 822 message, instead of putting it base64
+// encoded in the request, so that it's never held in memory as a whole.
+func (c *CmdG) send(ctx context.Context, threadID ThreadID, msg io.Reader) error {
 	_, err := c.gmail.Users.Messages.Send(email, &gmail.Message{
-		Raw:      MIMEEncode(msg),
 		ThreadId: string(threadID),
-	}).Context(ctx).Do()
+	}).Media(msg, googleapi.ContentType("message/rfc822")).Context(ctx).Do()
 	return err
 }
 
@@ -463,6 +552,14 @@ func (c *CmdG) BatchArchive(ctx context.Context, ids []string) error {
 	}).Context(ctx).Do()
 }
 
+// ArchiveThread removes all messages in the thread from the inbox.
+func (c *CmdG) ArchiveThread(ctx context.Context, threadID ThreadID) error {
+	_, err := c.gmail.Users.Threads.Modify(email, string(threadID), &gmail.ModifyThreadRequest{
+		RemoveLabelIds: []string{Inbox},
+	}).Context(ctx).Do()
+	return err
+}
+
 // BatchDelete deletes. Does not put in trash. Does not pass go:
 // "Immediately and permanently deletes the specified message. This operation cannot be undone."
 //
@@ -479,17 +576,17 @@ func (c *CmdG) BatchTrash(ctx context.Context, ids []string) error {
 	return c.BatchLabel(ctx, ids, Trash)
 }
 
-func (c *CmdG) BatchLabel(ctx context.Context, ids []string, labelID string) error {
+func (c *CmdG) BatchLabel(ctx context.Context, ids []string, labelIDs ...string) error {
 	return c.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
 		Ids:         ids,
-		AddLabelIds: []string{labelID},
+		AddLabelIds: labelIDs,
 	}).Context(ctx).Do()
 }
 
-func (c *CmdG) BatchUnlabel(ctx context.Context, ids []string, labelID string) error {
+func (c *CmdG) BatchUnlabel(ctx context.Context, ids []string, labelIDs ...string) error {
 	return c.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
 		Ids:            ids,
-		RemoveLabelIds: []string{labelID},
+		RemoveLabelIds: labelIDs,
 	}).Context(ctx).Do()
 }
 
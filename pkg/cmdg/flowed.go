@@ -0,0 +1,93 @@
+package cmdg
+
+import (
+	"context"
+	"mime"
+	"strings"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// https://tools.ietf.org/html/rfc3676
+
+const flowedSigSep = "-- "
+
+// flowedParams returns the format=flowed parameters of the first text/plain part.
+func flowedParams(part *gmail.MessagePart) (flowed bool, delsp bool) {
+	if part.MimeType == "text/plain" && !partIsAttachment(part) {
+		for _, h := range part.Headers {
+			if !strings.EqualFold(h.Name, "Content-Type") {
+				continue
+			}
+			_, params, err := mime.ParseMediaType(h.Value)
+			if err != nil {
+				return false, false
+			}
+			return strings.EqualFold(params["format"], "flowed"), strings.EqualFold(params["delsp"], "yes")
+		}
+		return false, false
+	}
+	for _, p := range part.Parts {
+		if p.MimeType == "text/plain" || strings.HasPrefix(p.MimeType, "multipart/") {
+			return flowedParams(p)
+		}
+	}
+	return false, false
+}
+
+// DecodeFlowed joins format=flowed lines into one line per paragraph.
+// Quoted lines keep their quote depth, written as "> > ".
+func DecodeFlowed(s string, delsp bool) string {
+	var ret []string
+	cur := ""
+	curDepth := -1
+	flush := func() {
+		if curDepth < 0 {
+			return
+		}
+		ret = append(ret, strings.Repeat("> ", curDepth)+cur)
+		cur = ""
+		curDepth = -1
+	}
+	for _, l := range strings.Split(strings.Replace(s, "\r", "", -1), "\n") {
+		depth := 0
+		for strings.HasPrefix(l, ">") {
+			depth++
+			l = l[1:]
+		}
+		// Remove space stuffing.
+		l = strings.TrimPrefix(l, " ")
+
+		if curDepth >= 0 && depth != curDepth {
+			// Quote depth changed, so the paragraph is over no matter what.
+			flush()
+		}
+		flowed := strings.HasSuffix(l, " ") && l != flowedSigSep
+		if flowed && delsp {
+			l = l[:len(l)-1]
+		}
+		cur += l
+		curDepth = depth
+		if !flowed {
+			flush()
+		}
+	}
+	flush()
+	return strings.Join(ret, "\n")
+}
+
+// GetQuotableBody returns the unpatched body, with format=flowed
+// paragraphs joined into one line each. The bool is true if the body
+// was flowed, and thus may need to be wrapped.
+func (msg *Message) GetQuotableBody(ctx context.Context) (string, bool, error) {
+	if err := msg.Preload(ctx, LevelFull); err != nil {
+		return "", false, err
+	}
+	msg.m.RLock()
+	defer msg.m.RUnlock()
+	flowed, delsp := flowedParams(msg.Response.Payload)
+	if !flowed {
+		return msg.originalBody, false, nil
+	}
+	return DecodeFlowed(msg.originalBody, delsp), true, nil
+}
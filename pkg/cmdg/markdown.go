@@ -0,0 +1,369 @@
+package cmdg
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A small Markdown renderer, covering what people write in plain text
+// email: paragraphs, quotes, code, lists, headings, emphasis and links.
+
+const (
+	// Same look as quotes written in the Gmail web UI.
+	blockquoteStyle = "margin:0 0 0 .8ex;border-left:1px #ccc solid;padding-left:1ex"
+)
+
+var (
+	mdHeadingRE  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRuleRE     = regexp.MustCompile(`^ {0,3}(([-*_])\s*){3,}$`)
+	mdFenceRE    = regexp.MustCompile("^ {0,3}(```+|~~~+)\\s*([^`\\s]*)")
+	mdListItemRE = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])( +|$)`)
+
+	// Backslash escapes, code spans, links and URLs. Everything between them is escaped text.
+	// Escapes are matched so that an escaped backtick or bracket doesn't start a code span or link.
+	mdInlineRE = regexp.MustCompile(`(\\[!-/:-@\[-` + "`" + `{-~])` +
+		"|`([^`]+)`" +
+		`|\[([^\]]+)\]\(([^)\s]+)\)` +
+		`|<?(https?://[^\s<>]*[^\s<>.,;:!?)'"])>?`)
+	mdStrongRE = regexp.MustCompile(`(\*\*|__)([^\s*](?:[^*]*[^\s*])?)(\*\*|__)`)
+	mdEmRE     = regexp.MustCompile(`(^|[^\w*])([*_])([^\s*_](?:[^*_]*[^\s*_])?)([*_])($|[^\w*])`)
+	// Any ASCII punctuation can be backslash escaped.
+	mdEscapeRE = regexp.MustCompile(`\\([!-/:-@\[-` + "`" + `{-~])`)
+)
+
+// MarkdownToHTML renders a Markdown message body as an HTML document.
+// Everything after the signature separator is kept as-is.
+func MarkdownToHTML(s string) string {
+	lines := strings.Split(strings.Replace(s, "\r", "", -1), "\n")
+	var sig []string
+	for n := len(lines) - 1; n >= 0; n-- {
+		if lines[n] == flowedSigSep {
+			sig = lines[n:]
+			lines = lines[:n]
+			for len(sig) > 0 && isBlank(sig[len(sig)-1]) {
+				sig = sig[:len(sig)-1]
+			}
+			break
+		}
+	}
+	var b strings.Builder
+	b.WriteString("<html><body>\n")
+	b.WriteString(mdBlocks(lines))
+	if len(sig) > 0 {
+		var esc []string
+		for _, l := range sig {
+			esc = append(esc, html.EscapeString(l))
+		}
+		fmt.Fprintf(&b, "<div class=\"signature\">%s</div>\n", strings.Join(esc, "<br>\n"))
+	}
+	b.WriteString("</body></html>\n")
+	return b.String()
+}
+
+func isBlank(l string) bool {
+	return strings.TrimSpace(l) == ""
+}
+
+// mdStartsBlock returns true if the line interrupts a paragraph.
+func mdStartsBlock(l string) bool {
+	return strings.HasPrefix(strings.TrimLeft(l, " "), ">") ||
+		mdHeadingRE.MatchString(l) ||
+		mdRuleRE.MatchString(l) ||
+		mdFenceRE.MatchString(l) ||
+		mdListItemRE.MatchString(l)
+}
+
+// mdIndented returns true for lines of indented code.
+func mdIndented(l string) bool {
+	return strings.HasPrefix(l, "    ") || strings.HasPrefix(l, "\t")
+}
+
+// mdBlocks renders block level elements.
+func mdBlocks(lines []string) string {
+	var b strings.Builder
+	for n := 0; n < len(lines); {
+		l := lines[n]
+		switch {
+		case isBlank(l):
+			n++
+
+		case mdFenceRE.MatchString(l):
+			m := mdFenceRE.FindStringSubmatch(l)
+			fence := m[1]
+			var code []string
+			n++
+			for ; n < len(lines); n++ {
+				if strings.HasPrefix(strings.TrimLeft(lines[n], " "), fence) {
+					n++
+					break
+				}
+				code = append(code, lines[n])
+			}
+			class := ""
+			if m[2] != "" {
+				class = fmt.Sprintf(` class="language-%s"`, html.EscapeString(m[2]))
+			}
+			fmt.Fprintf(&b, "<pre><code%s>%s</code></pre>\n", class, mdCode(code))
+
+		case mdIndented(l):
+			var code []string
+			for ; n < len(lines) && (mdIndented(lines[n]) || isBlank(lines[n])); n++ {
+				code = append(code, strings.TrimPrefix(strings.TrimPrefix(lines[n], "\t"), "    "))
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			fmt.Fprintf(&b, "<pre><code>%s</code></pre>\n", mdCode(code))
+
+		case strings.HasPrefix(strings.TrimLeft(l, " "), ">"):
+			var quoted []string
+			for ; n < len(lines) && strings.HasPrefix(strings.TrimLeft(lines[n], " "), ">"); n++ {
+				q := strings.TrimPrefix(strings.TrimLeft(lines[n], " "), ">")
+				quoted = append(quoted, strings.TrimPrefix(q, " "))
+			}
+			fmt.Fprintf(&b, "<blockquote style=\"%s\">\n%s</blockquote>\n", blockquoteStyle, mdBlocks(quoted))
+
+		case mdHeadingRE.MatchString(l):
+			m := mdHeadingRE.FindStringSubmatch(l)
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", len(m[1]), mdInline(m[2]), len(m[1]))
+			n++
+
+		case mdRuleRE.MatchString(l):
+			b.WriteString("<hr>\n")
+			n++
+
+		case mdListItemRE.MatchString(l):
+			var s string
+			s, n = mdList(lines, n)
+			b.WriteString(s)
+
+		default:
+			var para []string
+			for ; n < len(lines) && !isBlank(lines[n]); n++ {
+				if len(para) > 0 && mdStartsBlock(lines[n]) {
+					break
+				}
+				para = append(para, lines[n])
+			}
+			fmt.Fprintf(&b, "<p>%s</p>\n", mdParagraph(para))
+		}
+	}
+	return b.String()
+}
+
+// mdList renders the list starting at lines[n], returning the HTML and the line after the list.
+func mdList(lines []string, n int) (string, int) {
+	first := mdListItemRE.FindStringSubmatch(lines[n])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+
+	var items [][]string
+	indent := 0
+	loose := false
+	// sameList returns true if the line is an item in this list.
+	sameList := func(l string) bool {
+		m := mdListItemRE.FindStringSubmatch(l)
+		return m != nil && (m[2][0] >= '0' && m[2][0] <= '9') == ordered
+	}
+	for n < len(lines) {
+		l := lines[n]
+		if len(items) > 0 && !isBlank(l) && strings.HasPrefix(l, strings.Repeat(" ", indent)) {
+			items[len(items)-1] = append(items[len(items)-1], l[indent:])
+			n++
+			continue
+		}
+		if m := mdListItemRE.FindStringSubmatch(l); m != nil {
+			if !sameList(l) {
+				break
+			}
+			indent = len(m[0])
+			if m[3] == "" {
+				indent++
+			}
+			items = append(items, []string{strings.TrimPrefix(l, m[0])})
+			n++
+			continue
+		}
+		if isBlank(l) {
+			// Blank lines continue the list only if followed by more of it.
+			next := n + 1
+			for next < len(lines) && isBlank(lines[next]) {
+				next++
+			}
+			if next == len(lines) {
+				n = next
+				break
+			}
+			if !sameList(lines[next]) && !strings.HasPrefix(lines[next], strings.Repeat(" ", indent)) {
+				break
+			}
+			loose = true
+			cur := &items[len(items)-1]
+			for ; n < next; n++ {
+				*cur = append(*cur, "")
+			}
+			continue
+		}
+		if mdStartsBlock(l) {
+			break
+		}
+		// Lazy continuation of the item's paragraph.
+		items[len(items)-1] = append(items[len(items)-1], strings.TrimLeft(l, " "))
+		n++
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s>\n", tag)
+	for _, item := range items {
+		s := mdBlocks(item)
+		if !loose && strings.HasPrefix(s, "<p>") {
+			// Tight lists don't wrap their items in paragraphs.
+			if i := strings.Index(s, "</p>\n"); i >= 0 {
+				s = s[len("<p>"):i] + "\n" + s[i+len("</p>\n"):]
+			}
+		}
+		s = strings.TrimSuffix(s, "\n")
+		fmt.Fprintf(&b, "<li>%s</li>\n", s)
+	}
+	fmt.Fprintf(&b, "</%s>\n", tag)
+	return b.String(), n
+}
+
+func mdCode(lines []string) string {
+	return html.EscapeString(strings.Join(lines, "\n"))
+}
+
+// mdParagraph renders the lines of a paragraph. Lines ending in two
+// spaces or a backslash are hard line breaks.
+func mdParagraph(lines []string) string {
+	var ret []string
+	for n, l := range lines {
+		brk := false
+		if n < len(lines)-1 {
+			if strings.HasSuffix(l, "  ") {
+				brk = true
+			} else if strings.HasSuffix(l, `\`) && !strings.HasSuffix(l, `\\`) {
+				brk = true
+				l = strings.TrimSuffix(l, `\`)
+			}
+		}
+		s := mdInline(strings.TrimSpace(l))
+		if brk {
+			s += "<br>"
+		}
+		ret = append(ret, s)
+	}
+	return strings.Join(ret, "\n")
+}
+
+// mdInline renders code spans, links, URLs and emphasis.
+func mdInline(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range mdInlineRE.FindAllStringSubmatchIndex(s, -1) {
+		if m[2] >= 0 {
+			// Escapes are left in the text, for mdText.
+			continue
+		}
+		b.WriteString(mdText(s[last:m[0]]))
+		last = m[1]
+		switch {
+		case m[4] >= 0:
+			fmt.Fprintf(&b, "<code>%s</code>", html.EscapeString(s[m[4]:m[5]]))
+		case m[6] >= 0:
+			fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(s[m[8]:m[9]]), mdText(s[m[6]:m[7]]))
+		default:
+			u := html.EscapeString(s[m[10]:m[11]])
+			fmt.Fprintf(&b, `<a href="%s">%s</a>`, u, u)
+		}
+	}
+	b.WriteString(mdText(s[last:]))
+	return b.String()
+}
+
+// mdText escapes text and renders emphasis.
+// Backslash escaped characters become character references before
+// emphasis is found, so they never count as emphasis markers.
+func mdText(s string) string {
+	var esc strings.Builder
+	last := 0
+	for _, m := range mdEscapeRE.FindAllStringSubmatchIndex(s, -1) {
+		esc.WriteString(html.EscapeString(s[last:m[0]]))
+		fmt.Fprintf(&esc, "&#%d;", s[m[2]])
+		last = m[1]
+	}
+	esc.WriteString(html.EscapeString(s[last:]))
+	s = esc.String()
+	s = mdStrongRE.ReplaceAllStringFunc(s, func(m string) string {
+		sm := mdStrongRE.FindStringSubmatch(m)
+		if sm[1] != sm[3] {
+			return m
+		}
+		return "<strong>" + sm[2] + "</strong>"
+	})
+	em := func(m string) string {
+		sm := mdEmRE.FindStringSubmatch(m)
+		if sm[2] != sm[4] {
+			return m
+		}
+		return sm[1] + "<em>" + sm[3] + "</em>" + sm[5]
+	}
+	// Twice, since adjacent matches share the character between them.
+	s = mdEmRE.ReplaceAllStringFunc(s, em)
+	return mdEmRE.ReplaceAllStringFunc(s, em)
+}
+
+// AlternativePart combines a text part and its HTML rendering into a multipart/alternative part.
+func AlternativePart(text *Part, htmlBody string) (*Part, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	th := make(textproto.MIMEHeader)
+	for k, v := range text.Header {
+		if k != "Content-Disposition" {
+			th[k] = v
+		}
+	}
+	tw, err := w.CreatePart(th)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating text part")
+	}
+	if _, err := tw.Write([]byte(text.Contents)); err != nil {
+		return nil, errors.Wrap(err, "writing text part")
+	}
+
+	hw, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {`text/html; charset="UTF-8"`},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating HTML part")
+	}
+	qp := quotedprintable.NewWriter(hw)
+	if _, err := qp.Write([]byte(htmlBody)); err != nil {
+		return nil, errors.Wrap(err, "writing HTML part")
+	}
+	if err := qp.Close(); err != nil {
+		return nil, errors.Wrap(err, "writing HTML part")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "closing multipart")
+	}
+	return &Part{
+		Header: map[string][]string{
+			"Content-Type":        {fmt.Sprintf(`multipart/alternative; boundary="%s"`, w.Boundary())},
+			"Content-Disposition": {"inline"},
+		},
+		Contents: buf.String(),
+	}, nil
+}
@@ -0,0 +1,125 @@
+package cmdg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// mdBody renders Markdown, without the surrounding document.
+func mdBody(s string) string {
+	h := MarkdownToHTML(s)
+	h = strings.TrimPrefix(h, "<html><body>\n")
+	return strings.TrimSuffix(h, "</body></html>\n")
+}
+
+func TestMarkdownToHTML(t *testing.T) {
+	bq := fmt.Sprintf(`<blockquote style="%s">`, blockquoteStyle)
+	for _, test := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		// Paragraphs and text.
+		{"paragraphs", "one\ntwo\n\nthree", "<p>one\ntwo</p>\n<p>three</p>\n"},
+		{"CRLF", "one\r\n\r\ntwo", "<p>one</p>\n<p>two</p>\n"},
+		{"HTML escaped", "a <b> & \"c\"", "<p>a &lt;b&gt; &amp; &#34;c&#34;</p>\n"},
+		{"hard break spaces", "one  \ntwo", "<p>one<br>\ntwo</p>\n"},
+		{"hard break backslash", "one\\\ntwo", "<p>one<br>\ntwo</p>\n"},
+		{"trailing spaces on last line", "one  ", "<p>one</p>\n"},
+
+		// Emphasis.
+		{"em", "*a* _b_", "<p><em>a</em> <em>b</em></p>\n"},
+		{"strong", "**a** __b__", "<p><strong>a</strong> <strong>b</strong></p>\n"},
+		{"strong em", "***a***", "<p><em><strong>a</strong></em></p>\n"},
+		{"em with spaces", "*a b c*", "<p><em>a b c</em></p>\n"},
+		{"adjacent em", "*a* *b*", "<p><em>a</em> <em>b</em></p>\n"},
+		{"em in parens", "(*a*)", "<p>(<em>a</em>)</p>\n"},
+		{"snake case", "snake_case_name", "<p>snake_case_name</p>\n"},
+		{"arithmetic", "2*3*4", "<p>2*3*4</p>\n"},
+		{"mismatched", "*a_ and **b__", "<p>*a_ and **b__</p>\n"},
+		{"space inside", "* a *", "<ul>\n<li>a *</li>\n</ul>\n"},
+		{"lone star", "a * b", "<p>a * b</p>\n"},
+		{"escaped marker inside em", "*a \\* b*", "<p><em>a &#42; b</em></p>\n"},
+		{"escaped em", "\\*a\\*", "<p>&#42;a&#42;</p>\n"},
+
+		// Code.
+		{"code span", "a `b < c` d", "<p>a <code>b &lt; c</code> d</p>\n"},
+		{"code span keeps markers", "`*a*`", "<p><code>*a*</code></p>\n"},
+		{"code span keeps backslashes", "`a\\*b`", "<p><code>a\\*b</code></p>\n"},
+		{"escaped backtick", "\\`a\\`", "<p>&#96;a&#96;</p>\n"},
+		{"fenced", "```\nif a < b {\n  *x*\n}\n```", "<pre><code>if a &lt; b {\n  *x*\n}</code></pre>\n"},
+		{"fenced language", "```go\nx\n```", "<pre><code class=\"language-go\">x</code></pre>\n"},
+		{"fenced tilde", "~~~\nx\n~~~\nafter", "<pre><code>x</code></pre>\n<p>after</p>\n"},
+		{"fence needs same marker", "```\na\n~~~\nb\n```", "<pre><code>a\n~~~\nb</code></pre>\n"},
+		{"unterminated fence", "```\na\nb", "<pre><code>a\nb</code></pre>\n"},
+		{"indented", "    a < b\n\n    c\n\nd", "<pre><code>a &lt; b\n\nc</code></pre>\n<p>d</p>\n"},
+		{"tab indented", "\tx", "<pre><code>x</code></pre>\n"},
+
+		// Quotes.
+		{"quote", "> a\n> b", bq + "\n<p>a\nb</p>\n</blockquote>\n"},
+		{"quote without space", ">a", bq + "\n<p>a</p>\n</blockquote>\n"},
+		{"nested quote", "> a\n> > b\n> c", bq + "\n<p>a</p>\n" + bq + "\n<p>b</p>\n</blockquote>\n<p>c</p>\n</blockquote>\n"},
+		{"nested quote spaced", "> > a", bq + "\n" + bq + "\n<p>a</p>\n</blockquote>\n</blockquote>\n"},
+		{"quote after paragraph", "a\n> b", "<p>a</p>\n" + bq + "\n<p>b</p>\n</blockquote>\n"},
+		{"quote with list", "> - a\n> - b", bq + "\n<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n</blockquote>\n"},
+		{"quote then text", "> a\n\nb", bq + "\n<p>a</p>\n</blockquote>\n<p>b</p>\n"},
+
+		// Lists.
+		{"list", "- a\n- b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"list markers", "* a\n+ b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"ordered", "1. a\n2. b", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"ordered paren", "1) a\n2) b", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"list after paragraph", "a\n- b", "<p>a</p>\n<ul>\n<li>b</li>\n</ul>\n"},
+		{"list kinds don't mix", "- a\n1. b", "<ul>\n<li>a</li>\n</ul>\n<ol>\n<li>b</li>\n</ol>\n"},
+		{"nested list", "- a\n  - b\n  - c\n- d", "<ul>\n<li>a\n<ul>\n<li>b</li>\n<li>c</li>\n</ul></li>\n<li>d</li>\n</ul>\n"},
+		{"loose list", "- a\n\n- b", "<ul>\n<li><p>a</p></li>\n<li><p>b</p></li>\n</ul>\n"},
+		{"item with paragraphs", "- a\n\n  b\n- c", "<ul>\n<li><p>a</p>\n<p>b</p></li>\n<li><p>c</p></li>\n</ul>\n"},
+		{"lazy continuation", "- a\nb", "<ul>\n<li>a\nb</li>\n</ul>\n"},
+		{"list then paragraph", "- a\n\nb", "<ul>\n<li>a</li>\n</ul>\n<p>b</p>\n"},
+		{"list with emphasis", "- *a*", "<ul>\n<li><em>a</em></li>\n</ul>\n"},
+		{"empty item", "-\n- a", "<ul>\n<li></li>\n<li>a</li>\n</ul>\n"},
+
+		// Headings and rules.
+		{"headings", "# a\n## b ##\n###### c", "<h1>a</h1>\n<h2>b</h2>\n<h6>c</h6>\n"},
+		{"too deep heading", "####### a", "<p>####### a</p>\n"},
+		{"heading needs space", "#a", "<p>#a</p>\n"},
+		{"rules", "---\n* * *\n___", "<hr>\n<hr>\n<hr>\n"},
+
+		// Links.
+		{"link", "[a *b*](http://x/?a=1&b=2)", "<p><a href=\"http://x/?a=1&amp;b=2\">a <em>b</em></a></p>\n"},
+		{"url", "see https://x.com/a_b_c.", "<p>see <a href=\"https://x.com/a_b_c\">https://x.com/a_b_c</a>.</p>\n"},
+		{"bracketed url", "<http://x.com>", "<p><a href=\"http://x.com\">http://x.com</a></p>\n"},
+		{"escaped link", "\\[a\\](b)", "<p>&#91;a&#93;(b)</p>\n"},
+
+		// Escaped block markers.
+		{"escaped quote", "\\> a", "<p>&#62; a</p>\n"},
+		{"escaped heading", "\\# a", "<p>&#35; a</p>\n"},
+		{"escaped list", "\\- a", "<p>&#45; a</p>\n"},
+		{"escaped backslash", "a\\\\", "<p>a&#92;</p>\n"},
+		{"not escapable", "\\a \\é", "<p>\\a \\é</p>\n"},
+
+		// Signature.
+		{"signature", "a\n\n-- \nB <b@x>\n", "<p>a</p>\n<div class=\"signature\">-- <br>\nB &lt;b@x&gt;</div>\n"},
+		{"bare -- is not a separator", "a\n--\nb", "<p>a\n--\nb</p>\n"},
+		{"last separator wins", "a\n--\nb\n-- \nc", "<p>a\n--\nb</p>\n<div class=\"signature\">-- <br>\nc</div>\n"},
+	} {
+		if got := mdBody(test.in); got != test.want {
+			t.Errorf("%s: %q\ngot:\n%s\nwant:\n%s", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestMarkdownEscapes(t *testing.T) {
+	for c := byte('!'); c <= '~'; c++ {
+		isPunct := (c >= '!' && c <= '/') || (c >= ':' && c <= '@') || (c >= '[' && c <= '`') || (c >= '{' && c <= '~')
+		if !isPunct {
+			continue
+		}
+		in := fmt.Sprintf(`x \%c y`, c)
+		want := fmt.Sprintf("<p>x &#%d; y</p>\n", c)
+		if got := mdBody(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
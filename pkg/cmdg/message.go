@@ -1,6 +1,7 @@
 package cmdg
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/base64"
@@ -10,7 +11,9 @@ import (
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
+	"net/http"
 	"net/mail"
+	"net/url"
 	"os/exec"
 	"regexp"
 	"runtime/debug"
@@ -37,9 +40,6 @@ const (
 	Starred = "STARRED"
 
 	tmpfilePattern = "cmdg-*"
-
-	defaultInboxBG = "#ffffff"
-	defaultInboxFG = "#000000"
 )
 
 var (
@@ -48,6 +48,10 @@ var (
 	Lynx    = "lynx"    // Binary
 	Openssl = "openssl" // Binary
 
+	// SMIMECertDir is where certs of verified S/MIME signers are stored.
+	// If empty, certs are not stored.
+	SMIMECertDir string
+
 	ErrMissing = fmt.Errorf("resource missing")
 )
 
@@ -57,6 +61,15 @@ type Attachment struct {
 	conn     *CmdG
 	contents []byte
 	Part     *gmail.MessagePart
+
+	// Attachment was decrypted, and contents are only kept in memory.
+	decrypted bool
+}
+
+// IsDecrypted returns true if the attachment came from an encrypted
+// message, and its plaintext has never been written to disk.
+func (a *Attachment) IsDecrypted() bool {
+	return a.decrypted
 }
 
 func (a *Attachment) Download(ctx context.Context) ([]byte, error) {
@@ -74,6 +87,135 @@ func (a *Attachment) Download(ctx context.Context) ([]byte, error) {
 	return []byte(d), nil
 }
 
+// Size returns the size of the attachment in bytes, as reported by the server.
+func (a *Attachment) Size() int64 {
+	if a.contents != nil {
+		return int64(len(a.contents))
+	}
+	if a.Part == nil || a.Part.Body == nil {
+		return 0
+	}
+	return a.Part.Body.Size
+}
+
+// DownloadTo streams the attachment to a writer, without holding it all in memory.
+// `progress`, if not nil, is called with the number of bytes written so far.
+func (a *Attachment) DownloadTo(ctx context.Context, w io.Writer, progress func(int64)) error {
+	if progress == nil {
+		progress = func(int64) {}
+	}
+	cw := &countingWriter{w: w, progress: progress}
+	if a.contents != nil {
+		_, err := cw.Write(a.contents)
+		return err
+	}
+
+	u := fmt.Sprintf("%s%s/messages/%s/attachments/%s", a.conn.gmail.BasePath, email, url.PathEscape(a.MsgID), url.PathEscape(a.ID))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return errors.Wrapf(err, "creating request for %q", u)
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := a.conn.authedClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "downloading attachment %q", a.Part.Filename)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading attachment %q: %s", a.Part.Filename, resp.Status)
+	}
+	r, err := newJSONDataReader(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "parsing attachment %q", a.Part.Filename)
+	}
+	if _, err := io.Copy(cw, base64.NewDecoder(base64.URLEncoding, r)); err != nil {
+		return errors.Wrapf(err, "downloading attachment %q", a.Part.Filename)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w        io.Writer
+	n        int64
+	progress func(int64)
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.progress(c.n)
+	return n, err
+}
+
+// jsonDataReader reads the value of the "data" string of an attachment
+// JSON response, without reading all of it into memory.
+// The value is base64, so it contains no escaped characters.
+type jsonDataReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func newJSONDataReader(r io.Reader) (*jsonDataReader, error) {
+	br := bufio.NewReader(r)
+	const key = `"data"`
+	matched := 0
+	for matched < len(key) {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, errors.Wrapf(err, "looking for %s in response", key)
+		}
+		switch {
+		case b == key[matched]:
+			matched++
+		case b == key[0]:
+			matched = 1
+		default:
+			matched = 0
+		}
+	}
+	for _, want := range []byte{':', '"'} {
+		for {
+			b, err := br.ReadByte()
+			if err != nil {
+				return nil, errors.Wrapf(err, "looking for %q in response", want)
+			}
+			if b == want {
+				break
+			}
+			if !strings.ContainsRune(" \t\r\n", rune(b)) {
+				return nil, fmt.Errorf("unexpected %q in response, want %q", b, want)
+			}
+		}
+	}
+	return &jsonDataReader{r: br}, nil
+}
+
+func (j *jsonDataReader) Read(b []byte) (int, error) {
+	if j.done {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(b) {
+		c, err := j.r.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+		if c == '"' {
+			j.done = true
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		}
+		b[n] = c
+		n++
+	}
+	return n, nil
+}
+
 type Message struct {
 	m       sync.RWMutex
 	conn    *CmdG
@@ -146,12 +288,57 @@ func (msg *Message) annotateAttachments() error {
 			Part:  p,
 			conn:  msg.conn,
 		})
-		bodystr = append(bodystr, fmt.Sprintf("%s\n<<<Attachment %q; press 't' to view>>>", display.Bold, p.Filename))
+	}
+	for _, a := range msg.attachments {
+		if a.decrypted {
+			bodystr = append(bodystr, fmt.Sprintf("%s\n<<<Decrypted attachment %q; press 't' to view>>>", display.Bold, a.Part.Filename))
+		} else {
+			bodystr = append(bodystr, fmt.Sprintf("%s\n<<<Attachment %q; press 't' to view>>>", display.Bold, a.Part.Filename))
+		}
 	}
 	msg.body += strings.Join(bodystr, "\n")
 	return nil
 }
 
+// addDecryptedAttachment keeps a decrypted MIME part in memory as an attachment.
+// called with lock held
+func (msg *Message) addDecryptedAttachment(p *multipart.Part) error {
+	var r io.Reader = p
+	if strings.EqualFold(p.Header.Get("Content-Transfer-Encoding"), "base64") {
+		r = base64.NewDecoder(base64.StdEncoding, p)
+	}
+	// quoted-printable is already decoded by multipart.Reader.
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "reading decrypted attachment %q", p.FileName())
+	}
+	mt, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil {
+		mt = "application/octet-stream"
+	}
+	var hs []*gmail.MessagePartHeader
+	for k, vs := range p.Header {
+		for _, v := range vs {
+			hs = append(hs, &gmail.MessagePartHeader{Name: k, Value: v})
+		}
+	}
+	msg.attachments = append(msg.attachments, &Attachment{
+		MsgID: msg.ID,
+		conn:  msg.conn,
+		Part: &gmail.MessagePart{
+			Filename: p.FileName(),
+			MimeType: mt,
+			Headers:  hs,
+			Body: &gmail.MessagePartBody{
+				Size: int64(len(data)),
+			},
+		},
+		contents:  data,
+		decrypted: true,
+	})
+	return nil
+}
+
 func (msg *Message) GPGStatus() *gpg.Status {
 	return msg.gpgStatus
 }
@@ -190,6 +377,27 @@ func (msg *Message) HasData(level DataLevel) bool {
 	return hasData(msg.level, level)
 }
 
+// HasAttachments guesses if the message has attachments, from its top level content type.
+// It only needs metadata, so it's cheap, but misses some.
+func (msg *Message) HasAttachments() bool {
+	msg.m.RLock()
+	defer msg.m.RUnlock()
+	if msg.Response == nil || msg.Response.Payload == nil {
+		return false
+	}
+	return strings.EqualFold(msg.Response.Payload.MimeType, "multipart/mixed")
+}
+
+// SizeEstimate returns the approximate size of the message, in bytes.
+func (msg *Message) SizeEstimate() int64 {
+	msg.m.RLock()
+	defer msg.m.RUnlock()
+	if msg.Response == nil {
+		return 0
+	}
+	return msg.Response.SizeEstimate
+}
+
 func (msg *Message) IsUnread() bool {
 	return msg.HasLabel(Unread)
 }
@@ -208,16 +416,22 @@ func (msg *Message) HasLabel(labelID string) bool {
 	return false
 }
 
+// RemoveLabelID removes a label from a message.
 func (msg *Message) RemoveLabelID(ctx context.Context, labelID string) error {
+	return msg.RemoveLabelIDs(ctx, []string{labelID})
+}
+
+// RemoveLabelIDs removes labels from a message in one API call.
+func (msg *Message) RemoveLabelIDs(ctx context.Context, labelIDs []string) error {
 	st := time.Now()
 	nm, err := msg.conn.gmail.Users.Messages.Modify(email, msg.ID, &gmail.ModifyMessageRequest{
-		RemoveLabelIds: []string{labelID},
+		RemoveLabelIds: labelIDs,
 	}).Context(ctx).Do()
 	if err != nil {
-		return errors.Wrapf(err, "removing label ID %q from %q", labelID, msg.ID)
+		return errors.Wrapf(err, "removing label IDs %q from %q", labelIDs, msg.ID)
 	}
 
-	log.Infof("Removed label ID %q from %q. Now %q: %v", labelID, msg.ID, nm.LabelIds, time.Since(st))
+	log.Infof("Removed label IDs %q from %q. Now %q: %v", labelIDs, msg.ID, nm.LabelIds, time.Since(st))
 
 	msg.m.Lock()
 	defer msg.m.Unlock()
@@ -272,14 +486,19 @@ func (msg *Message) LocalLabels() []string {
 
 // AddLabelID adds a label to a message.
 func (msg *Message) AddLabelID(ctx context.Context, labelID string) error {
+	return msg.AddLabelIDs(ctx, []string{labelID})
+}
+
+// AddLabelIDs adds labels to a message in one API call.
+func (msg *Message) AddLabelIDs(ctx context.Context, labelIDs []string) error {
 	st := time.Now()
 	nm, err := msg.conn.gmail.Users.Messages.Modify(email, msg.ID, &gmail.ModifyMessageRequest{
-		AddLabelIds: []string{labelID},
+		AddLabelIds: labelIDs,
 	}).Context(ctx).Do()
 	if err != nil {
-		return errors.Wrapf(err, "removing label ID %q from %q", labelID, msg.ID)
+		return errors.Wrapf(err, "adding label IDs %q to %q", labelIDs, msg.ID)
 	}
-	log.Infof("Added label ID %q to %q. Is now %q: %v", labelID, msg.ID, nm.LabelIds, time.Since(st))
+	log.Infof("Added label IDs %q to %q. Is now %q: %v", labelIDs, msg.ID, nm.LabelIds, time.Since(st))
 	msg.m.Lock()
 	defer msg.m.Unlock()
 	if msg.Response == nil {
@@ -407,9 +626,9 @@ func (l *Label) LabelString() string {
 		return fmt.Sprintf("<Internal error: label response nil for label ID %q>", l.ID)
 	}
 	if c == "" {
-		c = display.Normal
+		c = display.ActiveTheme.Normal
 	}
-	return fmt.Sprintf("%s%s%s", c, l.Label, display.Normal)
+	return fmt.Sprintf("%s%s%s", c, l.Label, display.ActiveTheme.Normal)
 }
 
 func (l *Label) LabelColor() string {
@@ -418,17 +637,17 @@ func (l *Label) LabelColor() string {
 	if l.Response == nil {
 		return ""
 	}
-	var c string
+	t := display.ActiveTheme
+	if l.Response.Color == nil && l.ID != Inbox {
+		return ""
+	}
+	if !t.LabelColors {
+		return t.Label
+	}
 	if l.Response.Color == nil {
-		if l.ID == Inbox {
-			c = colorMap(defaultInboxFG, defaultInboxBG)
-		} else {
-			return ""
-		}
-	} else {
-		c = colorMap(l.Response.Color.TextColor, l.Response.Color.BackgroundColor)
+		return t.InboxLabel
 	}
-	return c
+	return colorMap(l.Response.Color.TextColor, l.Response.Color.BackgroundColor)
 }
 
 func (l *Label) LabelColorChar() string {
@@ -686,7 +905,7 @@ func htmlRender(ctx context.Context, s string) (string, error) {
 		return "", err
 	}
 	log.Infof("Rendered HTML in %v", time.Since(st))
-	return fmt.Sprintf("%sRendered HTML%s\n%s", display.Blue, display.Reset, stdout.String()), nil
+	return fmt.Sprintf("%sRendered HTML%s\n%s", display.ActiveTheme.Info, display.Reset, stdout.String()), nil
 }
 
 var errNoUsablePart = fmt.Errorf("could not find message part usable as message body")
@@ -881,7 +1100,11 @@ func (msg *Message) tryGPGInlineSigned(ctx context.Context) error {
 			e2 = fmt.Errorf("signature is there, but not 'good'")
 			return in
 		}
-		return fmt.Sprintf("%[1]sBEGIN message signed by %[2]s%[4]s\n%[3]s\n%[1]sEND message signed by %[2]s%[4]s", display.Green, st.Signed, in, display.Reset)
+		st.CheckSender(msg.headers["from"])
+		if st.IdentityMismatch {
+			return fmt.Sprintf("%[1]sBEGIN message signed by %[2]s, who is NOT the sender%[4]s\n%[3]s\n%[1]sEND message signed by %[2]s, who is NOT the sender%[4]s", display.ActiveTheme.SignatureWarn, st.Signed, in, display.Reset)
+		}
+		return fmt.Sprintf("%[1]sBEGIN message signed by %[2]s%[4]s\n%[3]s\n%[1]sEND message signed by %[2]s%[4]s", display.ActiveTheme.SignatureGood, st.Signed, in, display.Reset)
 	})
 	if e2 != nil {
 		return e2
@@ -949,6 +1172,12 @@ func (msg *Message) tryGPGEncrypted(ctx context.Context) error {
 			if err != nil {
 				return errors.Wrap(err, "failed to get mime part")
 			}
+			if p.FileName() != "" {
+				if err := msg.addDecryptedAttachment(p); err != nil {
+					return err
+				}
+				continue
+			}
 			dec, err := toUTF8Reader(map[string][]string(p.Header), p)
 			t, err := ioutil.ReadAll(dec)
 			if err != nil {
@@ -959,19 +1188,15 @@ func (msg *Message) tryGPGEncrypted(ctx context.Context) error {
 			if err != nil {
 				return errors.Wrapf(err, "parsing content-type %q", ct)
 			}
-			if p.FileName() == "" {
-				np := &gmail.MessagePart{
-					MimeType: mt,
-					Body: &gmail.MessagePartBody{
-						Data: MIMEEncode(string(t)),
-					},
-				}
-				msg.body, err = makeBody(ctx, np, false)
-				if err != nil {
-					return errors.Wrap(err, "failed to decrypt")
-				}
-			} else {
-				// TODO: handle attachment.
+			np := &gmail.MessagePart{
+				MimeType: mt,
+				Body: &gmail.MessagePartBody{
+					Data: MIMEEncode(string(t)),
+				},
+			}
+			msg.body, err = makeBody(ctx, np, false)
+			if err != nil {
+				return errors.Wrap(err, "failed to decrypt")
 			}
 		}
 
@@ -1007,6 +1232,23 @@ func toUTF8Reader(header mail.Header, r io.Reader) (io.Reader, error) {
 	return r, nil
 }
 
+// observeAutocrypt records the sender's Autocrypt state.
+// Called with lock held.
+func (msg *Message) observeAutocrypt() {
+	from := msg.headers["from"]
+	if from == "" {
+		return
+	}
+	date, err := parseTime(msg.headers["date"])
+	if err != nil {
+		log.Infof("Not observing Autocrypt for message %q with unparsable date %q: %v", msg.ID, msg.headers["date"], err)
+		return
+	}
+	if err := Autocrypt.Observe(from, date, msg.headers[strings.ToLower(AutocryptHeader)]); err != nil {
+		log.Errorf("Updating Autocrypt state for %q: %v", from, err)
+	}
+}
+
 func (msg *Message) Reload(ctx context.Context, level DataLevel) error {
 	return msg.load(ctx, level)
 }
@@ -1038,7 +1280,11 @@ func (msg *Message) load(ctx context.Context, level DataLevel) error {
 	for _, h := range msg.Response.Payload.Headers {
 		msg.headers[strings.ToLower(h.Name)] = h.Value
 	}
+	if Autocrypt != nil && level != LevelMinimal {
+		msg.observeAutocrypt()
+	}
 	if level == LevelFull {
+		msg.attachments = nil
 		msg.bodyHTML, err = makeBody(ctx, msg.Response.Payload, true)
 		if err != nil && err != errNoUsablePart {
 			return err
@@ -1050,11 +1296,12 @@ func (msg *Message) load(ctx context.Context, level DataLevel) error {
 			return err
 		}
 		if err := msg.tryGPGEncrypted(ctx); err != nil {
-			msg.body = fmt.Sprintf("%sDecrypting GPG: %v%s", display.Red, err, display.Grey)
+			msg.body = fmt.Sprintf("%sDecrypting GPG: %v%s", display.ActiveTheme.Error, err, display.Reset)
 		}
 		if err := msg.trySigned(ctx); err != nil {
 			log.Errorf("Checking GPG signature: %v", err)
 		}
+		msg.gpgStatus.CheckSender(msg.headers["from"])
 		msg.originalBody = msg.body
 		if err := msg.tryGPGInlineSigned(ctx); err != nil {
 			log.Errorf("Checking GPG inline signature: %v", err)
@@ -1132,9 +1379,21 @@ func (d *Draft) GetBody(ctx context.Context) (string, error) {
 	return d.body, nil
 }
 
+// UpdateParts replaces the contents of the draft.
 func (d *Draft) UpdateParts(ctx context.Context, head mail.Header, parts []*Part) error {
-	//d.update(ctx,
-	return fmt.Errorf("NOT IMPLEMENTED")
+	hlines, err := formatHeaders(head)
+	if err != nil {
+		return err
+	}
+	entity, err := MakeEntity("mixed", parts)
+	if err != nil {
+		return err
+	}
+	msg := entity
+	if len(hlines) > 0 {
+		msg = strings.Join(hlines, "\r\n") + "\r\n" + entity
+	}
+	return d.update(ctx, msg)
 }
 
 func (d *Draft) update(ctx context.Context, content string) error {
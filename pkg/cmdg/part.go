@@ -0,0 +1,156 @@
+package cmdg
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Max line length of base64 encoded parts, per RFC 2045.
+	base64LineLength = 76
+
+	// How much of a file http.DetectContentType looks at.
+	sniffLength = 512
+
+	defaultContentType = "application/octet-stream"
+)
+
+// DetectContentType guesses the MIME type of a file, first by its
+// extension and then by looking at its contents.
+func DetectContentType(fn string) (string, error) {
+	if ct := mime.TypeByExtension(path.Ext(fn)); ct != "" {
+		return ct, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", errors.Wrapf(err, "opening %q", fn)
+	}
+	defer f.Close()
+	b := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", errors.Wrapf(err, "reading %q", fn)
+	}
+	if n == 0 {
+		return defaultContentType, nil
+	}
+	return http.DetectContentType(b[:n]), nil
+}
+
+// AttachmentPart creates a part whose contents are streamed from `open` when the message is assembled.
+// Non-ASCII filenames are encoded per RFC 2231.
+func AttachmentPart(name, contentType string, open func() (io.ReadCloser, error)) (*Part, error) {
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing content type %q", contentType)
+	}
+	params["name"] = name
+	return &Part{
+		Header: map[string][]string{
+			"Content-Type":        {mime.FormatMediaType(mt, params)},
+			"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+		},
+		Open: open,
+	}, nil
+}
+
+// MessagePart creates a part for a whole email, attached as message/rfc822.
+// Encapsulated messages must not be base64 encoded (RFC 2046 section 5.2.1),
+// so it's sent as 8bit. Only use this for contents known to be an email.
+func MessagePart(name string, open func() (io.ReadCloser, error)) (*Part, error) {
+	p, err := AttachmentPart(name, "message/rfc822", open)
+	if err != nil {
+		return nil, err
+	}
+	p.Header["Content-Transfer-Encoding"] = []string{"8bit"}
+	return p, nil
+}
+
+// writeStreamedPart adds a part to the multipart, base64 encoding what's read from p.Open.
+// Parts made by MessagePart are copied as is.
+func writeStreamedPart(w *multipart.Writer, p *Part) error {
+	h := make(textproto.MIMEHeader)
+	for k, v := range p.Header {
+		h[k] = v
+	}
+	raw := strings.EqualFold(h.Get("Content-Transfer-Encoding"), "8bit")
+	if !raw {
+		h.Set("Content-Transfer-Encoding", "base64")
+	}
+	pw, err := w.CreatePart(h)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create part")
+	}
+	r, err := p.Open()
+	if err != nil {
+		return errors.Wrapf(err, "opening part contents")
+	}
+	defer r.Close()
+	if raw {
+		if _, err := io.Copy(pw, r); err != nil {
+			return errors.Wrapf(err, "copying part")
+		}
+		return nil
+	}
+	lw := &lineWrapper{w: pw, width: base64LineLength}
+	enc := base64.NewEncoder(base64.StdEncoding, lw)
+	if _, err := io.Copy(enc, r); err != nil {
+		return errors.Wrapf(err, "encoding part")
+	}
+	if err := enc.Close(); err != nil {
+		return errors.Wrapf(err, "encoding part")
+	}
+	return lw.finish()
+}
+
+// lineWrapper inserts CRLF every `width` bytes.
+type lineWrapper struct {
+	w     io.Writer
+	width int
+	col   int
+}
+
+func (l *lineWrapper) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := l.width - l.col
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := l.w.Write(b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		l.col += n
+		b = b[n:]
+		if l.col == l.width {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+	}
+	return written, nil
+}
+
+// finish ends the last line, if not already ended.
+func (l *lineWrapper) finish() error {
+	if l.col == 0 {
+		return nil
+	}
+	_, err := io.WriteString(l.w, "\r\n")
+	l.col = 0
+	return err
+}
@@ -0,0 +1,91 @@
+package cmdg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestWriteEntity(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef\x00\xff"), 1000)
+	opened := 0
+	att, err := AttachmentPart("data.bin", "", func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != 0 {
+		t.Fatalf("Attachment opened before the entity was written")
+	}
+	text := &Part{
+		Header: map[string][]string{
+			"Content-Type": {`text/plain; charset="UTF-8"`},
+		},
+		Contents: "Hello",
+	}
+
+	var buf bytes.Buffer
+	if err := WriteEntity(&buf, "mixed", []*Part{text, att}); err != nil {
+		t.Fatal(err)
+	}
+	if opened != 1 {
+		t.Errorf("Attachment opened %d times, want 1", opened)
+	}
+
+	m, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mt, "multipart/mixed"; got != want {
+		t.Errorf("Content type %q, want %q", got, want)
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(p); string(b) != "Hello" {
+		t.Errorf("Text part %q, want %q", b, "Hello")
+	}
+
+	p, err = mr.NextRawPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.Header.Get("Content-Transfer-Encoding"), "base64"; got != want {
+		t.Errorf("Attachment encoding %q, want %q", got, want)
+	}
+	enc, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(string(enc), "\r\n"), "\r\n") {
+		if len(l) > base64LineLength {
+			t.Errorf("Line of length %d, want at most %d", len(l), base64LineLength)
+			break
+		}
+	}
+	dec, err := base64.StdEncoding.DecodeString(strings.Replace(string(enc), "\r\n", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, data) {
+		t.Errorf("Attachment data corrupted")
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Want only two parts, got err %v", err)
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net/mail"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -61,12 +63,125 @@ func (msg *Message) trySMIMESigned(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrapf(err, "failed to parse signer's cert")
 	}
-	// TODO: Verify that GetFrom() is in cert.EmailAddresses. Locking complicates this a bit.
 	log.Infof("Signed subject: %+v, emails: %v", cert.Subject, cert.EmailAddresses)
 	log.Infof("Issuer: %+v", cert.Issuer)
+	if err := saveSMIMECert(cert, b); err != nil {
+		log.Errorf("Failed to save S/MIME cert of %v: %v", cert.EmailAddresses, err)
+	}
+	var emails []string
+	for _, e := range cert.EmailAddresses {
+		emails = append(emails, strings.ToLower(e))
+	}
 	msg.gpgStatus = &gpg.Status{
 		GoodSignature: true,
 		Signed:        unprintableRE.ReplaceAllString(cert.Subject.String(), ""),
+		SignerEmails:  emails,
 	}
 	return nil
 }
+
+// smimeCertFile returns the filename where the cert for a given email address is stored.
+// Only plain addresses are accepted, since the address becomes part of a filename.
+func smimeCertFile(addr string) (string, error) {
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid S/MIME address %q", addr)
+	}
+	if a.Address != addr || a.Name != "" || strings.ContainsAny(addr, "/\\\x00") {
+		return "", fmt.Errorf("invalid S/MIME address %q", addr)
+	}
+	return path.Join(SMIMECertDir, strings.ToLower(addr)+".pem"), nil
+}
+
+// saveSMIMECert stores a verified signer's cert, so that we can encrypt to them later.
+// A different cert already stored for an address is kept, and the new one logged.
+func saveSMIMECert(cert *x509.Certificate, pemData []byte) error {
+	if SMIMECertDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(SMIMECertDir, 0700); err != nil {
+		return errors.Wrapf(err, "creating S/MIME cert directory %q", SMIMECertDir)
+	}
+	for _, addr := range cert.EmailAddresses {
+		fn, err := smimeCertFile(addr)
+		if err != nil {
+			log.Warningf("Not saving S/MIME cert: %v", err)
+			continue
+		}
+		old, err := ioutil.ReadFile(fn)
+		if err == nil {
+			if !bytes.Equal(old, pemData) {
+				log.Warningf("Not replacing S/MIME cert for %q in %q with a different one. Remove the file to accept the new cert.", addr, fn)
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "reading existing cert for %q from %q", addr, fn)
+		}
+		if err := ioutil.WriteFile(fn, pemData, 0600); err != nil {
+			return errors.Wrapf(err, "writing cert for %q to %q", addr, fn)
+		}
+		log.Infof("Saved S/MIME cert for %q in %q", addr, fn)
+	}
+	return nil
+}
+
+// SMIMECertsFor returns the filenames of stored certs for all the given addresses.
+// Fails if any address has no known cert.
+func SMIMECertsFor(addrs []string) ([]string, error) {
+	var ret []string
+	for _, a := range addrs {
+		fn, err := smimeCertFile(a)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(fn); err != nil {
+			return nil, errors.Wrapf(err, "no S/MIME cert known for %q", a)
+		}
+		ret = append(ret, fn)
+	}
+	return ret, nil
+}
+
+// runOpenssl runs openssl with the entity on stdin, returning stdout as a MIME entity without MIME-Version header.
+func runOpenssl(ctx context.Context, entity string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, Openssl, args...)
+	cmd.Stdin = strings.NewReader(entity)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "openssl %q failed: %q", args, stderr.String())
+	}
+
+	// The outer message already has a MIME-Version header, so
+	// only keep the headers describing the entity.
+	m, err := mail.ReadMessage(&stdout)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing openssl output")
+	}
+	body, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading openssl output")
+	}
+	var hlines []string
+	for _, h := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition"} {
+		if v := m.Header.Get(h); v != "" {
+			hlines = append(hlines, fmt.Sprintf("%s: %s", h, v))
+		}
+	}
+	return strings.Join(hlines, "\r\n") + "\r\n\r\n" + string(body), nil
+}
+
+// SMIMESign signs a MIME entity, returning a multipart/signed entity.
+func SMIMESign(ctx context.Context, entity, cert, key string) (string, error) {
+	return runOpenssl(ctx, entity, "cms", "-sign", "-signer", cert, "-inkey", key)
+}
+
+// SMIMEEncrypt encrypts a MIME entity to the given recipient cert files.
+func SMIMEEncrypt(ctx context.Context, entity string, certs []string) (string, error) {
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no recipients to S/MIME encrypt to")
+	}
+	return runOpenssl(ctx, entity, append([]string{"cms", "-encrypt", "-aes256"}, certs...)...)
+}
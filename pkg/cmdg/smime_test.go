@@ -0,0 +1,196 @@
+package cmdg
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSMIMECertFile(t *testing.T) {
+	old := SMIMECertDir
+	defer func() { SMIMECertDir = old }()
+	SMIMECertDir = "/certs"
+	for _, test := range []struct {
+		addr  string
+		want  string
+		isErr bool
+	}{
+		{addr: "foo@example.com", want: "/certs/foo@example.com.pem"},
+		{addr: "Foo@Example.COM", want: "/certs/foo@example.com.pem"},
+		{addr: "../../etc/passwd", isErr: true},
+		{addr: "a/b@example.com", isErr: true},
+		{addr: "/abs@example.com", isErr: true},
+		{addr: `a\b@example.com`, isErr: true},
+		{addr: "Foo <foo@example.com>", isErr: true},
+		{addr: "", isErr: true},
+	} {
+		got, err := smimeCertFile(test.addr)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("smimeCertFile(%q) = %q, want error", test.addr, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("smimeCertFile(%q): %v", test.addr, err)
+		} else if got != test.want {
+			t.Errorf("smimeCertFile(%q) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestSaveSMIMECert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-smime-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := SMIMECertDir
+	defer func() { SMIMECertDir = old }()
+	SMIMECertDir = dir
+
+	stored := func(addr string) string {
+		b, err := ioutil.ReadFile(path.Join(dir, addr+".pem"))
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+	cert := &x509.Certificate{EmailAddresses: []string{"b@example.com"}}
+	if err := saveSMIMECert(cert, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stored("b@example.com"), "first"; got != want {
+		t.Errorf("Stored %q, want %q", got, want)
+	}
+
+	// A different cert for the same address doesn't replace it,
+	// and neither does one whose address would map to the same file.
+	for _, addrs := range [][]string{
+		{"b@example.com"},
+		{"B@example.com"},
+		{"a/b@example.com"},
+	} {
+		cert := &x509.Certificate{EmailAddresses: addrs}
+		if err := saveSMIMECert(cert, []byte("second")); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := stored("b@example.com"), "first"; got != want {
+			t.Errorf("After saving for %q: stored %q, want %q", addrs, got, want)
+		}
+	}
+}
+
+// makeSMIMECert creates a self-signed cert and key for addr in dir.
+func makeSMIMECert(t *testing.T, dir, addr string) (string, string) {
+	t.Helper()
+	cert := path.Join(dir, "cert.pem")
+	key := path.Join(dir, "key.pem")
+	cmd := exec.Command(Openssl, "req", "-x509", "-newkey", "rsa:2048", "-nodes",
+		"-days", "1",
+		"-keyout", key,
+		"-out", cert,
+		"-subj", "/CN=Test User",
+		"-addext", "subjectAltName=email:"+addr)
+	var ebuf bytes.Buffer
+	cmd.Stderr = &ebuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Creating test cert: %v: %s", err, ebuf.String())
+	}
+	return cert, key
+}
+
+func TestSMIMEHarvest(t *testing.T) {
+	if err := exec.Command(Openssl, "version").Run(); err != nil {
+		t.Skipf("openssl not available: %v", err)
+	}
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-smime-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := SMIMECertDir
+	defer func() { SMIMECertDir = old }()
+	SMIMECertDir = path.Join(dir, "certs")
+
+	// Trust the self-signed cert when verifying.
+	cert, key := makeSMIMECert(t, dir, "Tester@Example.com")
+	oldTrust, hadTrust := os.LookupEnv("SSL_CERT_FILE")
+	os.Setenv("SSL_CERT_FILE", cert)
+	defer func() {
+		if hadTrust {
+			os.Setenv("SSL_CERT_FILE", oldTrust)
+		} else {
+			os.Unsetenv("SSL_CERT_FILE")
+		}
+	}()
+
+	// No cert harvested yet.
+	if _, err := SMIMECertsFor([]string{"tester@example.com"}); err == nil {
+		t.Fatalf("SMIMECertsFor succeeded before any cert was saved")
+	}
+
+	const entity = "Content-Type: text/plain; charset=utf-8\r\n\r\nHello world\r\n"
+	signed, err := SMIMESign(ctx, entity, cert, key)
+	if err != nil {
+		t.Fatalf("SMIMESign: %v", err)
+	}
+	if !strings.Contains(signed, "multipart/signed") {
+		t.Errorf("SMIMESign returned non-multipart/signed entity:\n%s", signed)
+	}
+
+	msg := &Message{raw: "From: tester@example.com\r\nMIME-Version: 1.0\r\n" + signed}
+	if err := msg.trySMIMESigned(ctx); err != nil {
+		t.Fatalf("trySMIMESigned: %v", err)
+	}
+	if !msg.gpgStatus.GoodSignature {
+		t.Errorf("Signature not reported as good")
+	}
+	if got, want := msg.gpgStatus.SignerEmails, []string{"tester@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SignerEmails = %q, want %q", got, want)
+	}
+
+	// The signer's cert is now known, case insensitively.
+	certs, err := SMIMECertsFor([]string{"TESTER@example.com"})
+	if err != nil {
+		t.Fatalf("SMIMECertsFor after harvest: %v", err)
+	}
+	if want := []string{path.Join(SMIMECertDir, "tester@example.com.pem")}; !reflect.DeepEqual(certs, want) {
+		t.Errorf("SMIMECertsFor = %q, want %q", certs, want)
+	}
+	if _, err := SMIMECertsFor([]string{"tester@example.com", "other@example.com"}); err == nil {
+		t.Errorf("SMIMECertsFor succeeded with an unknown address")
+	}
+
+	// Encrypting to the harvested cert decrypts with the key.
+	enc, err := SMIMEEncrypt(ctx, entity, certs)
+	if err != nil {
+		t.Fatalf("SMIMEEncrypt: %v", err)
+	}
+	if strings.Contains(enc, "Hello world") {
+		t.Errorf("Encrypted entity contains the cleartext")
+	}
+	cmd := exec.CommandContext(ctx, Openssl, "cms", "-decrypt", "-recip", cert, "-inkey", key)
+	cmd.Stdin = strings.NewReader("MIME-Version: 1.0\r\n" + enc)
+	var out, ebuf bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &ebuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Decrypting: %v: %s", err, ebuf.String())
+	}
+	if !strings.Contains(out.String(), "Hello world") {
+		t.Errorf("Decrypted entity lacks the cleartext:\n%s", out.String())
+	}
+	if _, err := SMIMEEncrypt(ctx, entity, nil); err == nil {
+		t.Errorf("SMIMEEncrypt succeeded with no recipients")
+	}
+}
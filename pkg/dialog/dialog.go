@@ -4,6 +4,7 @@ package dialog
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
 	"github.com/pkg/errors"
@@ -13,9 +14,36 @@ import (
 	"github.com/ThomasHabets/cmdg/pkg/input"
 )
 
+const (
+	// SelectionView is the keymap view used by Selection.
+	SelectionView = "selection"
+)
+
 var (
 	// ErrAborted is returned when user pressed ^C.
 	ErrAborted = fmt.Errorf("dialog aborted")
+
+	// SelectionBindings are the actions in Selection, with their default keys.
+	SelectionBindings = []input.Binding{
+		{Action: "accept", Help: "Choose the highlighted option, or what's typed", Keys: []string{input.Enter}},
+		{Action: "toggle", Help: "Choose or unchoose the highlighted option, when more than one can be chosen", Keys: []string{" "}},
+		{Action: "next", Help: "Next option", Keys: []string{input.CtrlN, input.Down}},
+		{Action: "prev", Help: "Previous option", Keys: []string{input.CtrlP, input.Up}},
+		{Action: "page-down", Help: "Next page of options", Keys: []string{input.PgDown}},
+		{Action: "page-up", Help: "Previous page of options", Keys: []string{input.PgUp}},
+		{Action: "first", Help: "First option", Keys: []string{input.Home}},
+		{Action: "last", Help: "Last option", Keys: []string{input.End}},
+		{Action: "backspace", Help: "Delete last character", Keys: []string{input.Backspace, input.CtrlH}},
+		{Action: "clear", Help: "Clear input", Keys: []string{input.CtrlU}},
+		{Action: "abort", Help: "Abort", Keys: []string{input.CtrlC}},
+	}
+
+	// Used if no keymap is set.
+	defaultKeymap = func() *input.Keymap {
+		k := input.NewKeymap()
+		k.BindAll(SelectionView, SelectionBindings)
+		return k
+	}()
 )
 
 // Option is one option in a multiple-choice dialog.
@@ -38,7 +66,9 @@ func (o *Option) String() string {
 // Any errors are logged.
 func Message(title, message string, keys *input.Input) error {
 	err := messageErr(title, message, keys)
-	log.Errorf("Showing message: %v", err)
+	if err != nil {
+		log.Errorf("Showing message: %v", err)
+	}
 	return err
 }
 
@@ -81,13 +111,20 @@ func messageErr(title, message string, keys *input.Input) error {
 		return errors.Wrap(err, "failed to create screen")
 	}
 
-	startLine, lines := printBox(screen, title, message)
-	for n, l := range lines {
-		screen.Printlnf(startLine+n, "%s", l)
-	}
-	screen.Draw()
 	for {
-		key := <-keys.Chan()
+		screen.Clear()
+		startLine, lines := printBox(screen, title, message)
+		for n, l := range lines {
+			screen.Printlnf(startLine+n, "%s", l)
+		}
+		screen.Draw()
+		key, resized := keys.KeyOrResize()
+		if resized {
+			if screen, err = display.NewScreen(); err != nil {
+				return errors.Wrap(err, "failed to create screen")
+			}
+			continue
+		}
 		switch key {
 		case input.Enter:
 			return nil
@@ -97,6 +134,7 @@ func messageErr(title, message string, keys *input.Input) error {
 
 // Question asks the user a multiple-choice question.
 // ^C is always a valid option, and returns ErrAborted.
+// If the mouse is enabled, options can also be clicked.
 // Example: `Should I send that email now?`
 func Question(title string, opts []Option, keys *input.Input) (string, error) {
 	screen, err := display.NewScreen()
@@ -109,29 +147,41 @@ func Question(title string, opts []Option, keys *input.Input) (string, error) {
 			widest = t
 		}
 	}
+	for {
+		// TODO: break line if too long.
+		pad := (screen.Width-widest)/2 - 4
+		if pad < 0 {
+			pad = 0
+		}
+		prefix := strings.Repeat(" ", pad)
 
-	// TODO: break line if too long.
-	pad := (screen.Width-widest)/2 - 4
-	if pad < 0 {
-		pad = 0
-	}
-	prefix := strings.Repeat(" ", pad)
+		titlePad := (screen.Width - len(title)) / 2
+		if titlePad < 0 {
+			titlePad = 0
+		}
 
-	titlePad := (screen.Width - len(title)) / 2
-	if titlePad < 0 {
-		titlePad = 0
-	}
+		start := (screen.Height-len(opts))/2 - 2
+		screen.Printlnf(start, "%s", strings.Repeat("—", screen.Width))
+		screen.Printlnf(start+1, "%s%s", strings.Repeat(" ", titlePad), title)
+		for n, l := range opts {
+			screen.Printlnf(start+n+2, "%s%s", prefix, l.String())
+		}
+		screen.Printlnf(start+len(opts)+2, "%s", strings.Repeat("—", screen.Width))
+		screen.Draw()
 
-	start := (screen.Height-len(opts))/2 - 2
-	screen.Printlnf(start, "%s", strings.Repeat("—", screen.Width))
-	screen.Printlnf(start+1, "%s%s", strings.Repeat(" ", titlePad), title)
-	for n, l := range opts {
-		screen.Printlnf(start+n+2, "%s%s", prefix, l.String())
-	}
-	screen.Printlnf(start+len(opts)+2, "%s", strings.Repeat("—", screen.Width))
-	screen.Draw()
-	for {
-		key := <-keys.Chan()
+		key, resized := keys.KeyOrResize()
+		if resized {
+			if screen, err = display.NewScreen(); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if e, ok := input.ParseMouse(key); ok {
+			if n := e.Y - start - 2; e.Button == input.MouseLeft && n >= 0 && n < len(opts) {
+				return opts[n].Key, nil
+			}
+			continue
+		}
 		for _, o := range opts {
 			if o.Key == string(key) {
 				return o.Key, nil
@@ -144,17 +194,6 @@ func Question(title string, opts []Option, keys *input.Input) (string, error) {
 	}
 }
 
-// filterSubmatch filters out all options not matching input. Case insensitive.
-func filterSubmatch(opts []*Option, filter string) []*Option {
-	var ret []*Option
-	for _, o := range opts {
-		if strings.Contains(strings.ToLower(o.String()), strings.ToLower(filter)) {
-			ret = append(ret, o)
-		}
-	}
-	return ret
-}
-
 // Strings2Options takes a slice of strings and turns them into Options.
 func Strings2Options(ss []string) []*Option {
 	var ret []*Option
@@ -172,6 +211,15 @@ func Strings2Options(ss []string) []*Option {
 	return ret
 }
 
+// OptionKeys returns the keys of options.
+func OptionKeys(opts []*Option) []string {
+	var ret []string
+	for _, o := range opts {
+		ret = append(ret, o.Key)
+	}
+	return ret
+}
+
 // trimOneChar removes bytes until the printed size of the string is reduced.
 // This is used by "backspace".
 // TODO: should this use utf8.DecodeLastRuneInString to remove one codepoint at a time?
@@ -190,6 +238,17 @@ func TrimOneChar(s string) string {
 	return s[:len(s)-1]
 }
 
+// pastedLine turns pasted text into something that fits on one line.
+func pastedLine(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 127 {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.TrimRight(s, " ")
+}
+
 // Entry asks for a free-form input.
 // Example: Search.
 func Entry(prompt string, keys *input.Input) (string, error) {
@@ -199,103 +258,402 @@ func Entry(prompt string, keys *input.Input) (string, error) {
 	}
 	cur := ""
 	prefix := "    "
-	keys.PastePush(false)
-	defer keys.PastePop()
 	for {
 		start := 3
 		screen.Printlnf(start+2, "%s%s%s%s%s", prefix, display.Bold, prompt, display.Reset, cur)
 		screen.Draw()
-		select {
-		case key := <-keys.Chan():
-			switch key {
-			case input.Enter:
-				return cur, nil
-			case input.Backspace, input.CtrlH:
-				cur = TrimOneChar(cur)
-			case input.CtrlU:
-				cur = ""
-			case input.CtrlC:
-				return "", ErrAborted
-			default:
-				cur += string(key)
+		key, resized := keys.KeyOrResize()
+		if resized {
+			if screen, err = display.NewScreen(); err != nil {
+				return "", err
 			}
+			continue
+		}
+		if input.IsMouse(key) {
+			continue
+		}
+		if p, ok := input.PasteText(key); ok {
+			cur += pastedLine(p)
+			continue
+		}
+		switch key {
+		case input.Enter:
+			return cur, nil
+		case input.Backspace, input.CtrlH:
+			cur = TrimOneChar(cur)
+		case input.CtrlU:
+			cur = ""
+		case input.CtrlC:
+			return "", ErrAborted
+		default:
+			cur += string(key)
+		}
+	}
+}
+
+// commonPrefix returns the longest common prefix of all strings.
+func commonPrefix(ss []string) string {
+	if len(ss) == 0 {
+		return ""
+	}
+	ret := ss[0]
+	for _, s := range ss[1:] {
+		for !strings.HasPrefix(s, ret) {
+			ret = ret[:len(ret)-1]
+		}
+	}
+	// Don't return half a character.
+	for !utf8.ValidString(ret) {
+		ret = ret[:len(ret)-1]
+	}
+	return ret
+}
+
+// EntryComplete asks for a free-form input, starting with `cur`.
+// Pressing tab completes using the `complete` function, which returns all candidates for the current input.
+// Example: Directory to save in.
+func EntryComplete(prompt, cur string, complete func(string) []string, keys *input.Input) (string, error) {
+	screen, err := display.NewScreen()
+	if err != nil {
+		return "", err
+	}
+	prefix := "    "
+	var candidates []string
+	for {
+		start := 3
+		screen.Clear()
+		screen.Printlnf(start+2, "%s%s%s%s%s", prefix, display.Bold, prompt, display.Reset, cur)
+		for n, c := range candidates {
+			if start+4+n >= screen.Height {
+				break
+			}
+			screen.Printlnf(start+4+n, "%s  %s", prefix, c)
+		}
+		screen.Draw()
+		key, resized := keys.KeyOrResize()
+		if resized {
+			if screen, err = display.NewScreen(); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if input.IsMouse(key) {
+			continue
+		}
+		candidates = nil
+		if p, ok := input.PasteText(key); ok {
+			cur += pastedLine(p)
+			continue
+		}
+		switch key {
+		case input.Enter:
+			return cur, nil
+		case input.Tab:
+			c := complete(cur)
+			if p := commonPrefix(c); len(p) > len(cur) {
+				cur = p
+			}
+			if len(c) > 1 {
+				candidates = c
+			}
+		case input.Backspace, input.CtrlH:
+			cur = TrimOneChar(cur)
+		case input.CtrlU:
+			cur = ""
+		case input.CtrlC:
+			return "", ErrAborted
+		default:
+			cur += string(key)
 		}
 	}
 }
 
 // Selection asks the user for a choice, with populated suggestions that can be searched in.
 // If `free` is `true` then the user can input anything. If `false` then the options listed are the only valid ones.
+// Typed characters match options fuzzily, and the best matches are listed first.
+// If the mouse is enabled, options can also be clicked.
 // Example: Email recipient choice.
 func Selection(opts []*Option, prompt string, free bool, keys *input.Input) (*Option, error) {
+	var valid func(string) bool
+	if free {
+		valid = AnyText
+	}
+	ret, err := selection(opts, prompt, valid, false, keys)
+	if err != nil {
+		return nil, err
+	}
+	return ret[0], nil
+}
+
+// MultiSelection is like Selection, but more than one option can be chosen.
+// Options are toggled with space, and enter chooses the toggled options, or the highlighted one if none are.
+// While searching, space is typed instead, unless the selection has been moved.
+// If `free` is not nil, then what's typed can be chosen too, if `free` accepts it.
+// Returns the options in the order they were chosen. Can be empty if `free` is not nil.
+// Example: Labels to add.
+func MultiSelection(opts []*Option, prompt string, free func(string) bool, keys *input.Input) ([]*Option, error) {
+	return selection(opts, prompt, free, true, keys)
+}
+
+// AnyText accepts any typed text as a free choice.
+func AnyText(string) bool {
+	return true
+}
+
+// accepted returns what accepting a selection chooses, or false if there's nothing valid to accept.
+// What's typed is added to the chosen options if nothing is highlighted and `free` accepts it.
+// Otherwise chosen options win over the highlighted one.
+func accepted(chosen []*Option, highlighted *Option, typed string, free func(string) bool, multi bool) ([]*Option, bool) {
+	if highlighted == nil && typed != "" && free != nil {
+		if free(typed) {
+			return append(append([]*Option{}, chosen...), &Option{Key: typed, Label: typed}), true
+		}
+		if len(chosen) == 0 {
+			return nil, false
+		}
+	}
+	switch {
+	case len(chosen) > 0:
+		return chosen, true
+	case highlighted != nil:
+		return []*Option{highlighted}, true
+	case free == nil:
+		return nil, false
+	case !multi:
+		return []*Option{{Key: typed, Label: typed}}, true
+	}
+	return nil, true
+}
+
+// toggled returns the chosen options after toggling the highlighted one, or,
+// if none is highlighted, adding what's typed if `free` accepts it.
+// While searching, an option that's only highlighted for being the best match
+// isn't toggled unless `moved`, i.e. the user moved the selection to it.
+// The added option is returned too, so that it can be listed and toggled off again.
+// Returns false if there's nothing to toggle.
+func toggled(chosen []*Option, highlighted *Option, moved bool, typed string, free func(string) bool) ([]*Option, *Option, bool) {
+	if highlighted != nil && (moved || typed == "") {
+		for n, c := range chosen {
+			if c == highlighted {
+				return append(append([]*Option{}, chosen[:n]...), chosen[n+1:]...), nil, true
+			}
+		}
+		return append(append([]*Option{}, chosen...), highlighted), nil, true
+	}
+	if highlighted != nil || typed == "" || free == nil || !free(typed) {
+		return chosen, nil, false
+	}
+	o := &Option{Key: typed, Label: typed}
+	return append(append([]*Option{}, chosen...), o), o, true
+}
+
+func selection(opts []*Option, prompt string, free func(string) bool, multi bool, keys *input.Input) ([]*Option, error) {
 	screen, err := display.NewScreen()
 	if err != nil {
 		return nil, err
 	}
+	isFree := free != nil
 	cur := ""
 	last := ""
 	selected := -1
-	scroll := 0 // TODO, implement scrolling.
-	visible := opts
-	keys.PastePush(false)
-	defer keys.PastePop()
+	moved := false // Selection moved by the user since last typing.
+	scroll := 0
+	visible := filterFuzzy(opts, cur)
+	km := keys.Keymap()
+	if km == nil {
+		km = defaultKeymap
+	}
+
+	// Chosen options in multi-select, in order.
+	var chosen []*Option
+	isChosen := func(o *Option) bool {
+		for _, c := range chosen {
+			if c == o {
+				return true
+			}
+		}
+		return false
+	}
+	highlighted := func() *Option {
+		if selected < 0 {
+			return nil
+		}
+		return visible[selected].opt
+	}
+	done := func(ret ...*Option) ([]*Option, error) {
+		for _, o := range ret {
+			remember(o)
+		}
+		return ret, nil
+	}
 	for {
-		start := 3
+		const start = 3
 		prefix := "    "
+		rows := screen.Height - start - 1
+		if rows < 1 {
+			rows = 1
+		}
+		scroll = followSelection(selected, scroll, rows)
+
+		screen.Clear()
 		screen.Printlnf(2, "%s%s%s", prefix, prompt, cur)
-		for n, o := range visible[scroll:] {
-			sstr := display.Reset + " "
+		for n := scroll; n < len(visible) && n-scroll < rows; n++ {
+			m := visible[n]
+			sstr, attr := display.Reset+" ", display.Reset
 			if selected == n {
-				sstr = display.Bold + ">"
+				sstr, attr = display.Bold+">", display.Bold
 			}
-			screen.Printlnf(n+start, "%s%s %s", prefix, sstr, o)
+			if multi {
+				if isChosen(m.opt) {
+					sstr += " [x]"
+				} else {
+					sstr += " [ ]"
+				}
+			}
+			screen.Printlnf(n-scroll+start, "%s%s %s", prefix, sstr, highlight(m.opt.String(), m.pos, display.ActiveTheme.SearchMatch, display.Reset+attr))
 		}
-
-		// Clear the area.
-		for n := len(visible); n < len(opts); n++ {
-			screen.Printlnf(n+start, "")
+		var status []string
+		if len(visible) > rows {
+			end := scroll + rows
+			if end > len(visible) {
+				end = len(visible)
+			}
+			status = append(status, fmt.Sprintf("%d–%d of %d", scroll+1, end, len(visible)))
+		}
+		if multi {
+			status = append(status, fmt.Sprintf("%d chosen", len(chosen)))
+			if ks := km.Keys(SelectionView, "toggle"); len(ks) > 0 {
+				status = append(status, fmt.Sprintf("%s to choose more", input.KeyName(ks[0])))
+			}
+		}
+		if len(status) > 0 {
+			screen.Printlnf(screen.Height-1, "%s%s%s%s", prefix, display.ActiveTheme.Dim, strings.Join(status, " — "), display.Reset)
 		}
-
 		screen.Draw()
 
-		key := <-keys.Chan()
-		switch key {
-		case input.Enter:
-			if selected < 0 {
-				if !free {
-					continue
+		key, resized := keys.KeyOrResize()
+		if resized {
+			if screen, err = display.NewScreen(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		action := km.Action(SelectionView, key)
+		if e, ok := input.ParseMouse(key); ok {
+			switch e.Button {
+			case input.MouseLeft:
+				if n := e.Y - start + scroll; e.Y >= start && e.Y-start < rows && n < len(visible) {
+					if !multi {
+						return done(visible[n].opt)
+					}
+					selected = n
+					moved = true
+					chosen, _, _ = toggled(chosen, visible[n].opt, moved, cur, nil)
 				}
-				return &Option{
-					Key:   cur,
-					Label: cur,
-				}, nil
+				continue
+			case input.MouseWheelDown:
+				action = "next"
+			case input.MouseWheelUp:
+				action = "prev"
+			default:
+				continue
 			}
-			return visible[selected], nil
-		case input.CtrlN:
-			selected++
-			if selected >= len(visible) {
-				selected = len(visible) - 1
+		}
+		if p, ok := input.PasteText(key); ok {
+			action = ""
+			key = pastedLine(p)
+		}
+		if action == "toggle" && !multi {
+			// Just a key to type.
+			action = ""
+		}
+		switch action {
+		case "accept":
+			ret, ok := accepted(chosen, highlighted(), cur, free, multi)
+			if !ok {
+				continue
 			}
-		case input.CtrlP:
-			selected--
-			if selected < 0 && !free {
-				selected = 0
+			return done(ret...)
+		case "toggle":
+			c, added, ok := toggled(chosen, highlighted(), moved, cur, free)
+			if !ok {
+				// Nothing to toggle, e.g. a space in a name being searched for.
+				cur += string(key)
+				break
 			}
-		case input.CtrlC:
+			chosen = c
+			if added != nil {
+				opts = append([]*Option{added}, opts...)
+				cur = ""
+			} else {
+				selected = moveSelection(selected, 1, len(visible), isFree)
+			}
+		case "next":
+			selected = moveSelection(selected, 1, len(visible), isFree)
+			moved = true
+		case "prev":
+			selected = moveSelection(selected, -1, len(visible), isFree)
+			moved = true
+		case "page-down":
+			selected = moveSelection(selected, rows, len(visible), isFree)
+			moved = true
+		case "page-up":
+			selected = moveSelection(selected, -rows, len(visible), isFree)
+			moved = true
+		case "first":
+			selected = moveSelection(0, 0, len(visible), isFree)
+			moved = true
+		case "last":
+			selected = moveSelection(len(visible)-1, 0, len(visible), isFree)
+			moved = true
+		case "abort":
 			return nil, ErrAborted
-		case input.Backspace, input.CtrlH:
+		case "backspace":
 			cur = TrimOneChar(cur)
-		case input.CtrlU:
+		case "clear":
 			cur = ""
 		default:
 			cur += string(key)
 		}
 		if last != cur {
 			selected = -1
-			visible = filterSubmatch(opts, cur)
-			if !free && len(visible) > 0 {
+			moved = false
+			scroll = 0
+			visible = filterFuzzy(opts, cur)
+			if !isFree && len(visible) > 0 {
 				selected = 0
 			}
 		}
 		last = cur
 	}
 }
+
+// moveSelection moves the selection by `inc`, staying within the `n` options.
+// If `free`, then -1 selects what's typed.
+func moveSelection(selected, inc, n int, free bool) int {
+	selected += inc
+	if selected >= n {
+		selected = n - 1
+	}
+	if selected < 0 {
+		selected = -1
+		if !free && n > 0 {
+			selected = 0
+		}
+	}
+	return selected
+}
+
+// followSelection returns the scroll position closest to `scroll` that shows the selected option in `rows` rows.
+func followSelection(selected, scroll, rows int) int {
+	if selected < 0 {
+		return scroll
+	}
+	if selected < scroll {
+		return selected
+	}
+	if selected >= scroll+rows {
+		return selected - rows + 1
+	}
+	return scroll
+}
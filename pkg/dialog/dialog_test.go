@@ -2,6 +2,7 @@ package dialog
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -23,9 +24,12 @@ func TestTrimOneChar(t *testing.T) {
 	}
 }
 
-func TestFilterSubmatch(t *testing.T) {
-	a := &Option{Label: "foo"}
-	b := &Option{Label: "bar"}
+func TestFilterFuzzy(t *testing.T) {
+	a := &Option{Key: "a", Label: "foo"}
+	b := &Option{Key: "b", Label: "bar"}
+	c := &Option{Key: "c", Label: "Bob Fofo"}
+	d := &Option{Key: "d", Label: "xfoo"}
+	e := &Option{Key: "e", Label: "f-o-o"}
 
 	for _, test := range []struct {
 		in     []*Option
@@ -47,9 +51,274 @@ func TestFilterSubmatch(t *testing.T) {
 			filter: "fo",
 			out:    []*Option{a},
 		},
+		{
+			// Prefix, then word start, then substring, then initials.
+			in:     []*Option{e, d, c, a},
+			filter: "fo",
+			out:    []*Option{a, c, d, e},
+		},
+		{
+			in:     []*Option{b, c},
+			filter: "BF",
+			out:    []*Option{c},
+		},
+		{
+			in:     []*Option{a, b, c},
+			filter: "br",
+			out:    []*Option{b},
+		},
 	} {
-		if got, want := filterSubmatch(test.in, test.filter), test.out; !reflect.DeepEqual(got, want) {
+		var got []*Option
+		for _, m := range filterFuzzy(test.in, test.filter) {
+			got = append(got, m.opt)
+		}
+		if want := test.out; !reflect.DeepEqual(got, want) {
 			t.Errorf("For %q with filter %q got %q, want %q", test.in, test.filter, got, want)
 		}
 	}
 }
+
+func TestFilterFuzzyRecent(t *testing.T) {
+	a := &Option{Key: "recent-a", Label: "foo one"}
+	b := &Option{Key: "recent-b", Label: "foo two"}
+	remember(b)
+	var got []*Option
+	for _, m := range filterFuzzy([]*Option{a, b}, "foo") {
+		got = append(got, m.opt)
+	}
+	if want := []*Option{b, a}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want recently used first: %q", got, want)
+	}
+	// Not reordered without a filter.
+	got = nil
+	for _, m := range filterFuzzy([]*Option{a, b}, "") {
+		got = append(got, m.opt)
+	}
+	if want := []*Option{a, b}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	for _, test := range []struct {
+		s, filter string
+		rank      int
+		pos       []int
+		ok        bool
+	}{
+		{"John Doe", "", matchPrefix, nil, true},
+		{"John Doe", "jo", matchPrefix, []int{0, 1}, true},
+		{"John Doe", "doe", matchWordStart, []int{5, 6, 7}, true},
+		{"John Doe", "oh", matchSubstring, []int{1, 2}, true},
+		{"John Doe", "jd", matchInitials, []int{0, 5}, true},
+		{"John Doe", "jne", matchSubsequence, []int{0, 3, 7}, true},
+		{"John Doe", "x", 0, nil, false},
+		{"Räksmörgås", "MÖR", matchSubstring, []int{4, 5, 6}, true},
+	} {
+		rank, pos, ok := fuzzyMatch(test.s, test.filter)
+		if rank != test.rank || !reflect.DeepEqual(pos, test.pos) || ok != test.ok {
+			t.Errorf("fuzzyMatch(%q, %q) = %d, %v, %t, want %d, %v, %t", test.s, test.filter, rank, pos, ok, test.rank, test.pos, test.ok)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	for _, test := range []struct {
+		s   string
+		pos []int
+		out string
+	}{
+		{"hello", nil, "hello"},
+		{"hello", []int{0, 1}, "[he]llo"},
+		{"hello", []int{0, 2, 4}, "[h]e[l]l[o]"},
+		{"räksmörgås", []int{1, 2}, "r[äk]smörgås"},
+	} {
+		if got := highlight(test.s, test.pos, "[", "]"); got != test.out {
+			t.Errorf("highlight(%q, %v) = %q, want %q", test.s, test.pos, got, test.out)
+		}
+	}
+}
+
+func TestMoveSelection(t *testing.T) {
+	for _, test := range []struct {
+		selected, inc, n int
+		free             bool
+		want             int
+	}{
+		{0, 1, 10, false, 1},
+		{9, 1, 10, false, 9},
+		{0, -1, 10, false, 0},
+		{0, -1, 10, true, -1},
+		{-1, -1, 10, true, -1},
+		{-1, 5, 10, true, 4},
+		{3, 20, 10, false, 9},
+		{3, -20, 10, false, 0},
+		{0, 1, 0, false, -1},
+	} {
+		if got := moveSelection(test.selected, test.inc, test.n, test.free); got != test.want {
+			t.Errorf("moveSelection(%d, %d, %d, %t) = %d, want %d", test.selected, test.inc, test.n, test.free, got, test.want)
+		}
+	}
+}
+
+func TestFollowSelection(t *testing.T) {
+	for _, test := range []struct {
+		selected, scroll, rows int
+		want                   int
+	}{
+		{-1, 3, 10, 3},
+		{0, 0, 10, 0},
+		{9, 0, 10, 0},
+		{10, 0, 10, 1},
+		{25, 3, 10, 16},
+		{2, 5, 10, 2},
+	} {
+		if got := followSelection(test.selected, test.scroll, test.rows); got != test.want {
+			t.Errorf("followSelection(%d, %d, %d) = %d, want %d", test.selected, test.scroll, test.rows, got, test.want)
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	for _, test := range []struct {
+		in  []string
+		out string
+	}{
+		{nil, ""},
+		{[]string{"foo"}, "foo"},
+		{[]string{"foo/", "foobar/"}, "foo"},
+		{[]string{"/tmp/a", "/tmp/b"}, "/tmp/"},
+		{[]string{"abc", "xyz"}, ""},
+	} {
+		if got, want := commonPrefix(test.in), test.out; got != want {
+			t.Errorf("For %q got %q, want %q", test.in, got, want)
+		}
+	}
+}
+
+func TestPastedLine(t *testing.T) {
+	for _, test := range []struct {
+		in  string
+		out string
+	}{
+		{"", ""},
+		{"foo@example.com", "foo@example.com"},
+		{"foo@example.com\n", "foo@example.com"},
+		{"line one\r\nline two\n", "line one  line two"},
+		{"tab\there", "tab here"},
+		{"räksmörgås", "räksmörgås"},
+	} {
+		if got, want := pastedLine(test.in), test.out; got != want {
+			t.Errorf("For %q got %q, want %q", test.in, got, want)
+		}
+	}
+}
+
+func TestOptionKeys(t *testing.T) {
+	if got := OptionKeys(nil); got != nil {
+		t.Errorf("OptionKeys(nil) = %q, want nil", got)
+	}
+	opts := Strings2Options([]string{"a", "", "c"})
+	if got, want := OptionKeys(opts), []string{"a", "", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OptionKeys(%q) = %q, want %q", opts, got, want)
+	}
+}
+
+func TestAccepted(t *testing.T) {
+	a, b, c := &Option{Key: "a"}, &Option{Key: "b"}, &Option{Key: "c"}
+	hasAt := func(s string) bool { return strings.Contains(s, "@") }
+	for _, test := range []struct {
+		name        string
+		chosen      []*Option
+		highlighted *Option
+		typed       string
+		free        func(string) bool
+		multi       bool
+		want        []string // Keys.
+		ok          bool
+	}{
+		{name: "highlighted", highlighted: a, multi: true, want: []string{"a"}, ok: true},
+		{name: "chosen win over highlighted", chosen: []*Option{b, c}, highlighted: a, multi: true, want: []string{"b", "c"}, ok: true},
+		{name: "chosen, nothing highlighted", chosen: []*Option{b}, multi: true, want: []string{"b"}, ok: true},
+		{name: "nothing", multi: true, ok: false},
+		{name: "typed, not free", typed: "x", multi: true, ok: false},
+		{name: "free, nothing", free: AnyText, multi: true, want: []string{}, ok: true},
+		{name: "free typed", typed: "x", free: AnyText, multi: true, want: []string{"x"}, ok: true},
+		{name: "free typed after chosen", chosen: []*Option{a}, typed: "x", free: AnyText, multi: true, want: []string{"a", "x"}, ok: true},
+		{name: "free typed, highlighted wins", highlighted: b, typed: "x", free: AnyText, multi: true, want: []string{"b"}, ok: true},
+		{name: "invalid typed", typed: "John Sm", free: hasAt, multi: true, ok: false},
+		{name: "invalid typed, with chosen", chosen: []*Option{a}, typed: "John Sm", free: hasAt, multi: true, want: []string{"a"}, ok: true},
+		{name: "valid typed", typed: "j@x", free: hasAt, multi: true, want: []string{"j@x"}, ok: true},
+		{name: "single highlighted", highlighted: a, want: []string{"a"}, ok: true},
+		{name: "single nothing", ok: false},
+		{name: "single free typed", typed: "x", free: AnyText, want: []string{"x"}, ok: true},
+		{name: "single free empty", free: AnyText, want: []string{""}, ok: true},
+	} {
+		got, ok := accepted(test.chosen, test.highlighted, test.typed, test.free, test.multi)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if keys := OptionKeys(got); !reflect.DeepEqual(append([]string{}, keys...), test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, keys, test.want)
+		}
+	}
+}
+
+func TestToggled(t *testing.T) {
+	a, b := &Option{Key: "a"}, &Option{Key: "b"}
+	hasAt := func(s string) bool { return strings.Contains(s, "@") }
+	for _, test := range []struct {
+		name        string
+		chosen      []*Option
+		highlighted *Option
+		moved       bool
+		typed       string
+		free        func(string) bool
+		want        []string // Keys.
+		added       string
+		ok          bool
+	}{
+		{name: "choose highlighted", highlighted: a, want: []string{"a"}, ok: true},
+		{name: "choose another", chosen: []*Option{a}, highlighted: b, want: []string{"a", "b"}, ok: true},
+		{name: "unchoose", chosen: []*Option{a, b}, highlighted: a, want: []string{"b"}, ok: true},
+		{name: "highlighted wins over typed", highlighted: a, moved: true, typed: "x@y", free: hasAt, want: []string{"a"}, ok: true},
+		{name: "best match while searching", highlighted: a, typed: "Foo", ok: false},
+		{name: "best match while searching, free", highlighted: a, typed: "x@y", free: hasAt, ok: false},
+		{name: "moved to while searching", highlighted: b, moved: true, typed: "Foo", want: []string{"b"}, ok: true},
+		{name: "nothing", ok: false},
+		{name: "typed, not free", typed: "x", ok: false},
+		{name: "typed free", chosen: []*Option{a}, typed: "x", free: AnyText, want: []string{"a", "x"}, added: "x", ok: true},
+		{name: "typed valid", typed: "x@y", free: hasAt, want: []string{"x@y"}, added: "x@y", ok: true},
+		{name: "typed invalid", typed: "John", free: hasAt, ok: false},
+		{name: "nothing typed, free", free: AnyText, ok: false},
+	} {
+		orig := append([]*Option(nil), test.chosen...)
+		got, added, ok := toggled(test.chosen, test.highlighted, test.moved, test.typed, test.free)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !reflect.DeepEqual(test.chosen, orig) {
+			t.Errorf("%s: chosen modified in place", test.name)
+		}
+		if !ok {
+			continue
+		}
+		if keys := OptionKeys(got); !reflect.DeepEqual(append([]string{}, keys...), test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, keys, test.want)
+		}
+		switch {
+		case test.added == "" && added != nil:
+			t.Errorf("%s: added %q, want nothing", test.name, added.Key)
+		case test.added != "" && (added == nil || added.Key != test.added):
+			t.Errorf("%s: added %v, want %q", test.name, added, test.added)
+		}
+		if added != nil && got[len(got)-1] != added {
+			t.Errorf("%s: added option not chosen", test.name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package dialog
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// How well an option matches the filter, best last.
+const (
+	matchSubsequence = iota // Characters in order, e.g. "jhn" in "john".
+	matchInitials           // Characters at the start of words, e.g. "jd" in "John Doe".
+	matchSubstring          // E.g. "ohn" in "John".
+	matchWordStart          // E.g. "doe" in "John Doe".
+	matchPrefix             // E.g. "jo" in "John Doe".
+)
+
+var (
+	// How many times options have been chosen, by key. Recently used options rank higher.
+	recent = struct {
+		sync.Mutex
+		uses map[string]int
+	}{uses: make(map[string]int)}
+)
+
+// remember records that an option was chosen.
+func remember(o *Option) {
+	recent.Lock()
+	defer recent.Unlock()
+	recent.uses[o.Key]++
+}
+
+func recentUses(o *Option) int {
+	recent.Lock()
+	defer recent.Unlock()
+	return recent.uses[o.Key]
+}
+
+// match is an option that matches the filter.
+type match struct {
+	opt  *Option
+	rank int
+	uses int
+	pos  []int // Matched runes of the option string, for highlighting.
+}
+
+// filterFuzzy returns the options matching the filter, best first.
+// Equally good matches are ordered by how often they've been chosen, and then kept in order.
+func filterFuzzy(opts []*Option, filter string) []match {
+	var ret []match
+	for _, o := range opts {
+		rank, pos, ok := fuzzyMatch(o.String(), filter)
+		if ok {
+			ret = append(ret, match{opt: o, rank: rank, pos: pos})
+		}
+	}
+	if filter == "" {
+		return ret
+	}
+	for n := range ret {
+		ret[n].uses = recentUses(ret[n].opt)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].rank != ret[j].rank {
+			return ret[i].rank > ret[j].rank
+		}
+		return ret[i].uses > ret[j].uses
+	})
+	return ret
+}
+
+// fuzzyMatch matches a filter against a string, case insensitive.
+// Returns how good the match is, and which runes matched.
+func fuzzyMatch(s, filter string) (int, []int, bool) {
+	rs := lowerRunes(s)
+	q := lowerRunes(filter)
+	if len(q) == 0 {
+		return matchPrefix, nil, true
+	}
+
+	// Substrings, preferring the start of the string and then the start of words.
+	best, rank := -1, 0
+	for i := 0; i+len(q) <= len(rs); i++ {
+		if string(rs[i:i+len(q)]) != string(q) {
+			continue
+		}
+		r := matchSubstring
+		switch {
+		case i == 0:
+			r = matchPrefix
+		case wordStart(rs, i):
+			r = matchWordStart
+		}
+		if best < 0 || r > rank {
+			best, rank = i, r
+		}
+	}
+	if best >= 0 {
+		var pos []int
+		for n := range q {
+			pos = append(pos, best+n)
+		}
+		return rank, pos, true
+	}
+	if pos := subsequence(rs, q, true); pos != nil {
+		return matchInitials, pos, true
+	}
+	if pos := subsequence(rs, q, false); pos != nil {
+		return matchSubsequence, pos, true
+	}
+	return 0, nil, false
+}
+
+// subsequence finds the characters of q in order in rs, optionally only at the start of words.
+func subsequence(rs, q []rune, words bool) []int {
+	var pos []int
+	for i := 0; i < len(rs) && len(pos) < len(q); i++ {
+		if rs[i] == q[len(pos)] && (!words || wordStart(rs, i)) {
+			pos = append(pos, i)
+		}
+	}
+	if len(pos) < len(q) {
+		return nil
+	}
+	return pos
+}
+
+// wordStart returns true if the rune at i starts a word.
+func wordStart(rs []rune, i int) bool {
+	if i == 0 {
+		return true
+	}
+	p := rs[i-1]
+	return !unicode.IsLetter(p) && !unicode.IsDigit(p)
+}
+
+// lowerRunes lowercases one rune at a time, so that positions stay the same.
+func lowerRunes(s string) []rune {
+	rs := []rune(s)
+	for n, r := range rs {
+		rs[n] = unicode.ToLower(r)
+	}
+	return rs
+}
+
+// highlight wraps the runes at the given positions in `on` and `off`.
+func highlight(s string, pos []int, on, off string) string {
+	if len(pos) == 0 {
+		return s
+	}
+	hl := make(map[int]bool)
+	for _, p := range pos {
+		hl[p] = true
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if hl[n] && !hl[n-1] {
+			b.WriteString(on)
+		}
+		b.WriteRune(r)
+		if hl[n] && !hl[n+1] {
+			b.WriteString(off)
+		}
+		n++
+	}
+	return b.String()
+}
@@ -2,8 +2,12 @@ package display
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
 	log "github.com/sirupsen/logrus"
@@ -104,18 +108,166 @@ func NewScreen2(w int, h int) *Screen {
 	}
 }
 
+// SizeChanged returns true if the terminal is no longer the size of the screen.
+// E.g. because it was resized while another screen was showing.
+func (s *Screen) SizeChanged() bool {
+	w, h, err := TermSize()
+	if err != nil {
+		return false
+	}
+	return w != s.Width || h != s.Height
+}
+
 func (s *Screen) Clear() {
 	s.buffer = make([]string, s.Height, s.Height)
 }
 
+// Draw updates the terminal to show the screen.
+// Only cells that changed since the last Draw, of this or any other screen, are written.
 func (s *Screen) Draw() {
-	for n, l := range s.buffer {
-		pad := ""
-		if padlen := s.Width - StringWidth(l); padlen > 0 {
-			pad = strings.Repeat(" ", padlen)
+	terminalFrame.Lock()
+	defer terminalFrame.Unlock()
+
+	rows := make([][]cell, s.Height)
+	for n := range rows {
+		l := ""
+		if n < len(s.buffer) {
+			l = s.buffer[n]
+		}
+		rows[n] = parseCells(l, s.Width)
+	}
+	full := terminalFrame.rows == nil || terminalFrame.width != s.Width || len(terminalFrame.rows) != s.Height
+	var b strings.Builder
+	for n, row := range rows {
+		first, last := 0, len(row)-1
+		if !full {
+			first, last = diffCells(terminalFrame.rows[n], row)
+			if first < 0 {
+				continue
+			}
+		}
+		drawCells(&b, n, first, last, row)
+	}
+	terminalFrame.width = s.Width
+	terminalFrame.rows = rows
+	if b.Len() > 0 {
+		fmt.Fprint(output, b.String())
+	}
+}
+
+// Invalidate forgets what's on the terminal, so that the next Draw redraws everything.
+// Call it when something else has written to the terminal, e.g. an editor or pager.
+func Invalidate() {
+	terminalFrame.Lock()
+	defer terminalFrame.Unlock()
+	terminalFrame.rows = nil
+}
+
+var (
+	// Where screens are drawn.
+	output io.Writer = os.Stdout
+
+	// What was last drawn on the terminal.
+	terminalFrame struct {
+		sync.Mutex
+		width int
+		rows  [][]cell
+	}
+)
+
+// cell is one column of a screen line.
+type cell struct {
+	text string // Character including combining marks. Empty for the second column of a wide character.
+	attr string // Escape sequences in effect since the last reset.
+}
+
+// parseCells splits a line into exactly `w` cells.
+// Padding has the attributes in effect at the end of the line, like with the old full redraw.
+func parseCells(l string, w int) []cell {
+	ret := make([]cell, 0, w)
+	attr := ""
+	for len(l) > 0 {
+		if l[0] == '\033' {
+			seq := stripANSIRE.FindString(l)
+			l = l[len(seq):]
+			attr = addAttr(attr, seq)
+			continue
 		}
-		fmt.Printf("\033[%d;%dH%s%s%s", n+1, 1, l, pad, Reset)
+		r, size := utf8.DecodeRuneInString(l)
+		ch := l[:size]
+		l = l[size:]
+		rw := runewidth.RuneWidth(r)
+		if rw == 0 {
+			// Combining mark, or control character.
+			if len(ret) > 0 {
+				// Add to the last character, which could be a wide character.
+				last := len(ret) - 1
+				if ret[last].text == "" && last > 0 {
+					last--
+				}
+				ret[last].text += ch
+			}
+			continue
+		}
+		if len(ret)+rw > w {
+			break
+		}
+		ret = append(ret, cell{text: ch, attr: attr})
+		if rw == 2 {
+			ret = append(ret, cell{attr: attr})
+		}
+	}
+	for len(ret) < w {
+		ret = append(ret, cell{text: " ", attr: attr})
+	}
+	return ret
+}
+
+// addAttr returns the attributes in effect after an escape sequence.
+func addAttr(attr, seq string) string {
+	if seq == Reset || seq == "\033[m" {
+		return ""
 	}
+	return attr + seq
+}
+
+// diffCells returns the first and last cell that differ between two lines, or -1, -1 if none do.
+func diffCells(old, cur []cell) (int, int) {
+	first, last := -1, -1
+	for n := range cur {
+		if n < len(old) && old[n] == cur[n] {
+			continue
+		}
+		if first < 0 {
+			first = n
+		}
+		last = n
+	}
+	if first < 0 {
+		return -1, -1
+	}
+	// Wide characters have to be redrawn as a whole.
+	if first > 0 && cur[first].text == "" {
+		first--
+	}
+	if last+1 < len(cur) && cur[last+1].text == "" {
+		last++
+	}
+	return first, last
+}
+
+// drawCells writes cells `first` through `last` of a line.
+func drawCells(b *strings.Builder, y, first, last int, row []cell) {
+	fmt.Fprintf(b, "\033[%d;%dH", y+1, first+1)
+	attr := ""
+	for _, c := range row[first : last+1] {
+		if c.attr != attr {
+			b.WriteString(Reset + c.attr)
+			attr = c.attr
+		}
+		b.WriteString(c.text)
+	}
+	b.WriteString(Reset)
 }
 
 var (
@@ -126,6 +278,11 @@ func stripANSI(s string) string {
 	return stripANSIRE.ReplaceAllString(s, "")
 }
 
+// StripANSI removes colors and other escape sequences from a string.
+func StripANSI(s string) string {
+	return stripANSI(s)
+}
+
 func StringWidth(s string) int {
 	return runewidth.StringWidth(stripANSI(s))
 }
@@ -1,6 +1,8 @@
 package display
 
 import (
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -58,3 +60,81 @@ func TestFixedWidth(t *testing.T) {
 		}
 	}
 }
+
+func TestParseCells(t *testing.T) {
+	for _, test := range []struct {
+		in  string
+		w   int
+		out []cell
+	}{
+		{"", 2, []cell{{" ", ""}, {" ", ""}}},
+		{"ab", 3, []cell{{"a", ""}, {"b", ""}, {" ", ""}}},
+		{"abc", 2, []cell{{"a", ""}, {"b", ""}}},
+		{Bold + "a" + Reset + "b", 3, []cell{{"a", Bold}, {"b", ""}, {" ", ""}}},
+		{Reverse + "a", 2, []cell{{"a", Reverse}, {" ", Reverse}}},
+		{Bold + Red + "a", 1, []cell{{"a", Bold + Red}}},
+		{"漢a", 3, []cell{{"漢", ""}, {"", ""}, {"a", ""}}},
+		{"a漢", 2, []cell{{"a", ""}, {" ", ""}}},
+		{"éx", 2, []cell{{"é", ""}, {"x", ""}}},
+	} {
+		got := parseCells(test.in, test.w)
+		if len(got) != len(test.out) {
+			t.Errorf("parseCells(%q, %d) = %q, want %q", test.in, test.w, got, test.out)
+			continue
+		}
+		for n := range got {
+			if got[n] != test.out[n] {
+				t.Errorf("parseCells(%q, %d) = %q, want %q", test.in, test.w, got, test.out)
+				break
+			}
+		}
+	}
+}
+
+func TestDraw(t *testing.T) {
+	var buf strings.Builder
+	output = &buf
+	defer func() { output = os.Stdout }()
+	Invalidate()
+	defer Invalidate()
+
+	draw := func(s *Screen) string {
+		buf.Reset()
+		s.Draw()
+		return buf.String()
+	}
+
+	s := NewScreen2(5, 2)
+	s.Printlnf(0, "hello")
+	if got, want := draw(s), "\033[1;1Hhello"+Reset+"\033[2;1H     "+Reset; got != want {
+		t.Errorf("First draw: got %q, want %q", got, want)
+	}
+	if got := draw(s); got != "" {
+		t.Errorf("Unchanged draw: got %q, want nothing", got)
+	}
+
+	s.Printf(0, 1, "E")
+	s.Printlnf(1, "%s", Bold+"x")
+	if got, want := draw(s), "\033[1;2HE"+Reset+"\033[2;1H"+Reset+Bold+"x    "+Reset; got != want {
+		t.Errorf("Changed draw: got %q, want %q", got, want)
+	}
+
+	// A different screen of the same size only draws what differs.
+	s2 := s.Copy()
+	s2.Printf(1, 3, "漢")
+	if got, want := draw(s2), "\033[2;4H"+Reset+Bold+"漢"+Reset; got != want {
+		t.Errorf("Copy draw: got %q, want %q", got, want)
+	}
+	if got, want := draw(s), "\033[2;4H"+Reset+Bold+"  "+Reset; got != want {
+		t.Errorf("Back to first screen: got %q, want %q", got, want)
+	}
+
+	// Full redraw after Invalidate and on resize.
+	Invalidate()
+	if got, want := draw(s), "\033[1;1HhEllo"+Reset+"\033[2;1H"+Reset+Bold+"x    "+Reset; got != want {
+		t.Errorf("Draw after Invalidate: got %q, want %q", got, want)
+	}
+	if got, want := draw(NewScreen2(2, 2)), "\033[1;1H  "+Reset+"\033[2;1H  "+Reset; got != want {
+		t.Errorf("Draw after resize: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,271 @@
+package display
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Theme is the set of escape sequences used for each role on the screen.
+// Text in a role is followed by Reset, or by Normal if other attributes should be kept.
+type Theme struct {
+	Normal        string   // Restores normal text after something colored, without resetting Reverse etc.
+	Selection     string   // Current message in list, and lines selected for reply.
+	Unread        string   // Unread messages in list.
+	Starred       string   // Starred messages in list.
+	Header        string   // Header names in the message view.
+	Status        string   // Status bar.
+	Dim           string   // Less important text, e.g. MIME types.
+	Error         string   // Errors.
+	Info          string   // Notes added to the message, e.g. "Rendered HTML".
+	SearchMatch   string   // Incremental search matches.
+	SignatureGood string   // Good GPG signature, or encrypted.
+	SignatureWarn string   // Signature that's valid, but with problems.
+	SignatureBad  string   // Bad or untrusted signature.
+	Quote         []string // Quote levels. The last one is used for deeper quotes.
+
+	// Label colors. If LabelColors is false, then Label is used for all labels that have a color.
+	LabelColors bool
+	Label       string
+	InboxLabel  string // Inbox has no color set, so this is used when LabelColors is true.
+}
+
+var (
+	// ActiveTheme is the theme in use.
+	ActiveTheme = Themes["dark"]
+
+	// Themes are the built-in themes.
+	Themes = map[string]*Theme{
+		"dark": {
+			Normal:        White + BgBlack,
+			Selection:     Reverse,
+			Unread:        Bold,
+			Starred:       Yellow,
+			Status:        Color(50),
+			Dim:           Grey,
+			Error:         Red,
+			Info:          Blue,
+			SearchMatch:   Reverse + Yellow,
+			SignatureGood: Green,
+			SignatureWarn: Yellow,
+			SignatureBad:  Red,
+			LabelColors:   true,
+			Label:         Reverse,
+			InboxLabel:    Color(232) + "\033[48;5;255m",
+		},
+		"light": {
+			Normal:        fgDefault + bgDefault,
+			Selection:     Reverse,
+			Unread:        Bold,
+			Starred:       Color(130),
+			Header:        Color(24),
+			Status:        Color(24),
+			Dim:           Color(244),
+			Error:         Color(160),
+			Info:          Color(25),
+			SearchMatch:   Reverse + Color(130),
+			SignatureGood: Color(28),
+			SignatureWarn: Color(130),
+			SignatureBad:  Color(160),
+			Quote:         []string{Color(25), Color(28), Color(90)},
+			LabelColors:   true,
+			Label:         Reverse,
+			InboxLabel:    Color(15) + "\033[48;5;240m",
+		},
+		"16color": {
+			Normal:        fgDefault + bgDefault,
+			Selection:     Reverse,
+			Unread:        Bold,
+			Starred:       "\033[33m",
+			Header:        "\033[36m",
+			Status:        "\033[36m",
+			Dim:           "\033[2m",
+			Error:         Red8,
+			Info:          "\033[34m",
+			SearchMatch:   Reverse + "\033[33m",
+			SignatureGood: "\033[32m",
+			SignatureWarn: "\033[33m",
+			SignatureBad:  Red8,
+			Quote:         []string{"\033[36m", "\033[32m", "\033[35m"},
+			Label:         Reverse,
+		},
+		"nocolor": {
+			Normal:        fgDefault + bgDefault,
+			Selection:     Reverse,
+			Unread:        Bold,
+			SearchMatch:   Reverse,
+			SignatureGood: Bold,
+			SignatureWarn: Bold,
+			SignatureBad:  Underline,
+			Label:         Reverse,
+		},
+	}
+
+	// Roles settable in a theme file.
+	themeRoles = map[string]func(t *Theme) *string{
+		"normal":         func(t *Theme) *string { return &t.Normal },
+		"selection":      func(t *Theme) *string { return &t.Selection },
+		"unread":         func(t *Theme) *string { return &t.Unread },
+		"starred":        func(t *Theme) *string { return &t.Starred },
+		"header":         func(t *Theme) *string { return &t.Header },
+		"status":         func(t *Theme) *string { return &t.Status },
+		"dim":            func(t *Theme) *string { return &t.Dim },
+		"error":          func(t *Theme) *string { return &t.Error },
+		"info":           func(t *Theme) *string { return &t.Info },
+		"search-match":   func(t *Theme) *string { return &t.SearchMatch },
+		"signature-good": func(t *Theme) *string { return &t.SignatureGood },
+		"signature-warn": func(t *Theme) *string { return &t.SignatureWarn },
+		"signature-bad":  func(t *Theme) *string { return &t.SignatureBad },
+		"label":          func(t *Theme) *string { return &t.Label },
+		"inbox-label":    func(t *Theme) *string { return &t.InboxLabel },
+	}
+
+	// Color names usable in theme files, in addition to 256 color numbers.
+	colorNames = map[string]int{
+		"black":   0,
+		"red":     1,
+		"green":   2,
+		"yellow":  3,
+		"blue":    4,
+		"magenta": 5,
+		"cyan":    6,
+		"white":   7,
+	}
+)
+
+const (
+	fgDefault = "\033[39m"
+	bgDefault = "\033[49m"
+)
+
+// ThemeNames returns the names of the built-in themes.
+func ThemeNames() []string {
+	var ret []string
+	for n := range Themes {
+		ret = append(ret, n)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Copy returns a copy of the theme, which can be changed without affecting the original.
+func (t *Theme) Copy() *Theme {
+	r := *t
+	r.Quote = append([]string(nil), t.Quote...)
+	return &r
+}
+
+// QuoteLevel returns the escape sequence for a quote level, starting at 1.
+func (t *Theme) QuoteLevel(n int) string {
+	if n < 1 || len(t.Quote) == 0 {
+		return ""
+	}
+	if n > len(t.Quote) {
+		n = len(t.Quote)
+	}
+	return t.Quote[n-1]
+}
+
+// Load changes the theme according to a theme file. Each line is:
+//
+//	<role> <attributes…>
+//
+// where attributes are bold, underline, reverse, fg:<color> and bg:<color>,
+// with colors being a name (e.g. red, bright-red, default) or a 256 color number.
+// An empty list of attributes means no formatting. Quote levels are set with
+// "quote <attributes>", one line per level. Label colors from Gmail are
+// turned on or off with "label-colors on" or "label-colors off".
+// Empty lines and lines starting with # are ignored.
+func (t *Theme) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	var quotes []string
+	for scanner.Scan() {
+		lineno++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fs := strings.Fields(l)
+		if fs[0] == "label-colors" {
+			if len(fs) != 2 || (fs[1] != "on" && fs[1] != "off") {
+				return fmt.Errorf("line %d: want 'label-colors on' or 'label-colors off'", lineno)
+			}
+			t.LabelColors = fs[1] == "on"
+			continue
+		}
+		s, err := parseAttributes(fs[1:])
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineno, err)
+		}
+		if fs[0] == "quote" {
+			quotes = append(quotes, s)
+			continue
+		}
+		f, ok := themeRoles[fs[0]]
+		if !ok {
+			return fmt.Errorf("line %d: unknown theme role %q", lineno, fs[0])
+		}
+		*f(t) = s
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if quotes != nil {
+		t.Quote = quotes
+	}
+	return nil
+}
+
+// parseAttributes turns theme file attributes into an escape sequence.
+func parseAttributes(as []string) (string, error) {
+	var ret []string
+	for _, a := range as {
+		switch {
+		case a == "bold":
+			ret = append(ret, Bold)
+		case a == "underline":
+			ret = append(ret, Underline)
+		case a == "reverse":
+			ret = append(ret, Reverse)
+		case strings.HasPrefix(a, "fg:"):
+			c, err := parseColor(a[3:], fgDefault, 30)
+			if err != nil {
+				return "", err
+			}
+			ret = append(ret, c)
+		case strings.HasPrefix(a, "bg:"):
+			c, err := parseColor(a[3:], bgDefault, 40)
+			if err != nil {
+				return "", err
+			}
+			ret = append(ret, c)
+		default:
+			return "", fmt.Errorf("unknown attribute %q, want bold, underline, reverse, fg:<color> or bg:<color>", a)
+		}
+	}
+	return strings.Join(ret, ""), nil
+}
+
+// parseColor parses a color name or number into an escape sequence.
+// `base` is 30 for foreground, 40 for background.
+// Names use the basic 16 colors, so that they work on all terminals.
+func parseColor(s, def string, base int) (string, error) {
+	if s == "default" {
+		return def, nil
+	}
+	if n, ok := colorNames[strings.TrimPrefix(s, "bright-")]; ok {
+		if strings.HasPrefix(s, "bright-") {
+			base += 60
+		}
+		return fmt.Sprintf("\033[%dm", base+n), nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 255 {
+		return "", fmt.Errorf("invalid color %q, want a name or 0-255", s)
+	}
+	return fmt.Sprintf("\033[%d;5;%dm", base+8, n), nil
+}
@@ -0,0 +1,65 @@
+package display
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestThemeLoad(t *testing.T) {
+	th := Themes["dark"].Copy()
+	if err := th.Load(strings.NewReader(`
+# Solarized-ish.
+selection bg:0 fg:bright-white
+unread bold fg:33
+header
+label-colors off
+quote fg:cyan
+quote fg:green
+`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name      string
+		got, want string
+	}{
+		{"selection", th.Selection, "\033[48;5;0m\033[97m"},
+		{"unread", th.Unread, Bold + "\033[38;5;33m"},
+		{"header", th.Header, ""},
+		{"quote 1", th.QuoteLevel(1), "\033[36m"},
+		{"quote 3", th.QuoteLevel(3), "\033[32m"},
+		{"quote 0", th.QuoteLevel(0), ""},
+		{"status", th.Status, Themes["dark"].Status},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, test.got, test.want)
+		}
+	}
+	if th.LabelColors {
+		t.Errorf("label-colors off didn't turn off label colors")
+	}
+	if !Themes["dark"].LabelColors || Themes["dark"].Selection != Reverse {
+		t.Errorf("Loading changed the built-in theme")
+	}
+
+	for _, bad := range []string{
+		"selection fg:256",
+		"selection blink",
+		"nonexistent bold",
+		"label-colors maybe",
+	} {
+		if err := Themes["dark"].Copy().Load(strings.NewReader(bad)); err == nil {
+			t.Errorf("Load(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestThemesNoColor(t *testing.T) {
+	colorRE := regexp.MustCompile(`\033\[(3[0-8]|4[0-8]|9[0-7]|10[0-7])[;m]`)
+	th := Themes["nocolor"]
+	for _, s := range []string{th.Normal, th.Selection, th.Unread, th.Starred, th.Header, th.Status, th.Dim, th.Error, th.Info, th.SearchMatch, th.SignatureGood, th.SignatureWarn, th.SignatureBad, th.Label} {
+		if colorRE.MatchString(s) {
+			t.Errorf("nocolor theme has color %q", s)
+		}
+	}
+}
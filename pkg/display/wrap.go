@@ -0,0 +1,169 @@
+package display
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+)
+
+const (
+	// Tab stops are every this many columns.
+	tabWidth = 8
+)
+
+// nextChar splits off the first escape sequence or character of a string.
+// Returns the width of the character, or -1 for an escape sequence.
+func nextChar(s string) (string, string, int) {
+	if s[0] == '\033' {
+		seq := stripANSIRE.FindString(s)
+		return seq, s[len(seq):], -1
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	return s[:size], s[size:], runewidth.RuneWidth(r)
+}
+
+// ExpandTabs replaces tabs with spaces up to the next tab stop. Escape sequences take no space.
+func ExpandTabs(s string) string {
+	if !strings.Contains(s, "\t") {
+		return s
+	}
+	var b strings.Builder
+	col := 0
+	for len(s) > 0 {
+		var ch string
+		var w int
+		ch, s, w = nextChar(s)
+		if ch == "\t" {
+			n := tabWidth - col%tabWidth
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		b.WriteString(ch)
+		if w > 0 {
+			col += w
+		}
+	}
+	return b.String()
+}
+
+// Wrap breaks a line into lines at most `width` columns wide, preferably between words.
+// Wrapped lines start with `indent`, such as a quote prefix, and the colors in effect where the line was broken.
+// Wide characters count as two columns, and combining marks as none.
+func Wrap(s string, width int, indent string) []string {
+	s = ExpandTabs(s)
+	if width < 1 || StringWidth(s) <= width {
+		return []string{s}
+	}
+	indentW := StringWidth(indent)
+	if indentW > width/2 {
+		// Leave room for the text.
+		indent, indentW = "", 0
+	}
+	line := ""
+	if strings.HasPrefix(s, indent) {
+		// Don't break within the indentation on the first line.
+		line, s = indent, s[len(indent):]
+	}
+	var ret []string
+	lineW := StringWidth(line)
+	attr := ""
+	text := false    // Line has text other than spaces and indentation.
+	wrapped := false // Skipping spaces at the start of a wrapped line.
+
+	// Where the line can be broken: the start of the last run of spaces, and the text after it.
+	spaceStart, brk, brkW, brkAttr := -1, -1, 0, ""
+	newLine := func(a string) {
+		ret = append(ret, line)
+		line, lineW = indent+a, indentW
+		text, wrapped = false, true
+		spaceStart, brk = -1, -1
+	}
+	for len(s) > 0 {
+		var ch string
+		var w int
+		ch, s, w = nextChar(s)
+		if w < 0 {
+			line += ch
+			attr = addAttr(attr, ch)
+			continue
+		}
+		if ch == " " {
+			if wrapped {
+				continue
+			}
+			if lineW+w > width {
+				// Break at this space.
+				if spaceStart < 0 || brk >= 0 {
+					spaceStart = len(line)
+				}
+				line = line[:spaceStart]
+				newLine(attr)
+				continue
+			}
+			if text && (spaceStart < 0 || brk >= 0) {
+				spaceStart, brk = len(line), -1
+			}
+			line += ch
+			lineW += w
+			continue
+		}
+		wrapped = false
+		if text && spaceStart >= 0 && brk < 0 {
+			// First character after spaces.
+			brk, brkW, brkAttr = len(line), lineW, attr
+		}
+		if lineW+w > width && w > 0 {
+			if brk >= 0 && indentW+lineW-brkW+w <= width {
+				// Move the last word to the next line.
+				carry, carryW := line[brk:], lineW-brkW
+				line = line[:spaceStart]
+				newLine(brkAttr)
+				line += carry
+				lineW += carryW
+				text = true
+			} else if lineW > indentW {
+				// No room to break between words.
+				newLine(attr)
+			}
+		}
+		line += ch
+		lineW += w
+		text = true
+	}
+	return append(ret, line)
+}
+
+// DropColumns removes the first `n` columns of a line, keeping escape sequences.
+// A wide character cut in half is replaced by a space.
+func DropColumns(s string, n int) string {
+	var b strings.Builder
+	col := 0
+	for len(s) > 0 && col < n {
+		var ch string
+		var w int
+		ch, s, w = nextChar(s)
+		switch {
+		case w < 0:
+			b.WriteString(ch)
+		case col+w > n:
+			b.WriteString(strings.Repeat(" ", col+w-n))
+			col += w
+		default:
+			col += w
+		}
+	}
+	// Combining marks on the last dropped character.
+	for len(s) > 0 {
+		ch, rest, w := nextChar(s)
+		if w != 0 {
+			break
+		}
+		if strings.HasPrefix(ch, "\033") {
+			b.WriteString(ch)
+		}
+		s = rest
+	}
+	return b.String() + s
+}
@@ -0,0 +1,88 @@
+package display
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandTabs(t *testing.T) {
+	for _, test := range []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"a\tb", "a       b"},
+		{"\t", "        "},
+		{"abcdefgh\tb", "abcdefgh        b"},
+		{Bold + "ab" + Reset + "\tc", Bold + "ab" + Reset + "      c"},
+		{"漢\tc", "漢      c"},
+	} {
+		if got := ExpandTabs(test.in); got != test.out {
+			t.Errorf("ExpandTabs(%q) = %q, want %q", test.in, got, test.out)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	for _, test := range []struct {
+		in     string
+		width  int
+		indent string
+		out    []string
+	}{
+		{"", 10, "", []string{""}},
+		{"hello world", 20, "", []string{"hello world"}},
+		{"hello world", 8, "", []string{"hello", "world"}},
+		{"hello   world", 8, "", []string{"hello", "world"}},
+		{"hello world foo", 11, "", []string{"hello world", "foo"}},
+		{"one two three four", 9, "", []string{"one two", "three", "four"}},
+		{"abcdefghij", 4, "", []string{"abcd", "efgh", "ij"}},
+		{"ab abcdefghij", 4, "", []string{"ab", "abcd", "efgh", "ij"}},
+		{"    indented code", 10, "", []string{"    indent", "ed code"}},
+
+		// Quote prefixes.
+		{"> hello world foo", 11, "> ", []string{"> hello", "> world foo"}},
+		{"> > one two three", 9, "> > ", []string{"> > one", "> > two", "> > three"}},
+
+		// Wide characters and combining marks.
+		{"漢字漢字", 5, "", []string{"漢字", "漢字"}},
+		{"a漢字", 4, "", []string{"a漢", "字"}},
+		{"e\u0301e\u0301e\u0301e\u0301 ab", 5, "", []string{"e\u0301e\u0301e\u0301e\u0301", "ab"}},
+
+		// Colors carry over.
+		{Red + "hello world" + Reset + " x", 8, "", []string{Red + "hello", Red + "world" + Reset + " x"}},
+		{"> " + Red + "aaaa bbbb", 7, "> ", []string{"> " + Red + "aaaa", "> " + Red + "bbbb"}},
+
+		// Tabs.
+		{"a\tb", 8, "", []string{"a", "b"}},
+	} {
+		if got := Wrap(test.in, test.width, test.indent); !reflect.DeepEqual(got, test.out) {
+			t.Errorf("Wrap(%q, %d, %q) = %q, want %q", test.in, test.width, test.indent, got, test.out)
+		}
+		for _, l := range Wrap(test.in, test.width, test.indent) {
+			if w := StringWidth(l); w > test.width {
+				t.Errorf("Wrap(%q, %d, %q): line %q is %d wide", test.in, test.width, test.indent, l, w)
+			}
+		}
+	}
+}
+
+func TestDropColumns(t *testing.T) {
+	for _, test := range []struct {
+		in  string
+		n   int
+		out string
+	}{
+		{"hello", 0, "hello"},
+		{"hello", 2, "llo"},
+		{"hello", 10, ""},
+		{Bold + "he" + Reset + "llo", 2, Bold + Reset + "llo"},
+		{Red + "hello", 1, Red + "ello"},
+		{"漢字", 2, "字"},
+		{"漢字", 1, " 字"},
+		{"e\u0301x", 1, "x"},
+	} {
+		if got := DropColumns(test.in, test.n); got != test.out {
+			t.Errorf("DropColumns(%q, %d) = %q, want %q", test.in, test.n, got, test.out)
+		}
+	}
+}
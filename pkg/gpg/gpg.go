@@ -1,33 +1,102 @@
 package gpg
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/mail"
 	"os"
 	"os/exec"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
-	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// Trust is the validity of a signing key, as reported by GnuPG.
+type Trust string
+
+const (
+	TrustUnknown   Trust = ""
+	TrustUndefined Trust = "undefined"
+	TrustNever     Trust = "never"
+	TrustMarginal  Trust = "marginal"
+	TrustFully     Trust = "fully"
+	TrustUltimate  Trust = "ultimate"
+
+	// Status FD used for gpg. 0-2 are stdin/out/err, so ExtraFiles[0] is 3.
+	statusFD = "3"
+)
+
 type Status struct {
 	Signed        string
 	Encrypted     []string
 	GoodSignature bool
 	Warnings      []string
+
+	// SignerEmails are all email addresses of the signer identity (UIDs or cert emails).
+	SignerEmails []string
+
+	// IdentityMismatch is set when the signature is valid, but
+	// none of the signer's identities match the sender.
+	IdentityMismatch bool
+
+	// Details from GnuPG machine readable status.
+	KeyID            string
+	Fingerprint      string
+	Trust            Trust
+	SignatureTime    time.Time
+	SignatureExpired bool
+	KeyExpired       bool
+	KeyRevoked       bool
+	UnknownKey       bool
+}
+
+// CheckSender compares the signer's identities to a From header,
+// and sets IdentityMismatch if the signature is good but made by someone else.
+func (s *Status) CheckSender(from string) {
+	if s == nil || !s.GoodSignature {
+		return
+	}
+	addr := from
+	if a, err := mail.ParseAddress(from); err == nil {
+		addr = a.Address
+	}
+	for _, e := range s.SignerEmails {
+		if strings.EqualFold(e, addr) {
+			s.IdentityMismatch = false
+			return
+		}
+	}
+	log.Warningf("Signer %q (%v) does not match sender %q", s.Signed, s.SignerEmails, from)
+	s.IdentityMismatch = true
+}
+
+// emailsFromUIDs extracts the email addresses from GPG user IDs.
+func emailsFromUIDs(uids []string) []string {
+	var ret []string
+	for _, u := range uids {
+		if m := uidEmailRE.FindStringSubmatch(u); m != nil {
+			ret = append(ret, strings.ToLower(m[1]))
+		} else if a, err := mail.ParseAddress(u); err == nil {
+			ret = append(ret, strings.ToLower(a.Address))
+		}
+	}
+	return ret
 }
 
 var (
-	goodSignatureRE = regexp.MustCompile(`(?m)^gpg: Good signature from "(.*)"`)
-	badSignatureRE  = regexp.MustCompile(`(?m)^gpg: BAD signature from "(.*)"`)
-	encryptedRE     = regexp.MustCompile(`(?m)^gpg: encrypted with[^\n]+\n\s*"([^\n]+)"\n`)
-	unprintableRE   = regexp.MustCompile(`[\033\r]`)
+	uidEmailRE    = regexp.MustCompile(`<([^<>]+@[^<>]+)>`)
+	unprintableRE = regexp.MustCompile(`[\033\r]`)
+	percentRE     = regexp.MustCompile(`%[0-9A-Fa-f]{2}`)
+	colonEscapeRE = regexp.MustCompile(`\\x[0-9a-fA-F]{2}`)
 )
 
 type GPG struct {
@@ -41,38 +110,270 @@ func New(gpg string) *GPG {
 	}
 }
 
-func (gpg *GPG) Decrypt(ctx context.Context, dec string) (string, *Status, error) {
+// statusLine is one "[GNUPG:] KEYWORD args…" line from --status-fd.
+type statusLine struct {
+	keyword string
+	args    []string
+}
+
+// unescapeStatus undoes the percent-escaping gpg does in status line strings.
+func unescapeStatus(s string) string {
+	return percentRE.ReplaceAllStringFunc(s, func(in string) string {
+		b, err := strconv.ParseUint(in[1:], 16, 8)
+		if err != nil {
+			return in
+		}
+		return string([]byte{byte(b)})
+	})
+}
+
+// parseStatusLines parses the output of --status-fd.
+func parseStatusLines(r io.Reader) []statusLine {
+	const prefix = "[GNUPG:] "
+	var ret []statusLine
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := scanner.Text()
+		if !strings.HasPrefix(l, prefix) {
+			continue
+		}
+		l = strings.TrimPrefix(l, prefix)
+		kw := l
+		rest := ""
+		if n := strings.Index(l, " "); n >= 0 {
+			kw, rest = l[:n], l[n+1:]
+		}
+		st := statusLine{keyword: kw}
+		switch kw {
+		case "GOODSIG", "EXPSIG", "EXPKEYSIG", "REVKEYSIG", "BADSIG", "USERID_HINT":
+			// Keyword, key ID, and then the rest is the user ID.
+			parts := strings.SplitN(rest, " ", 2)
+			st.args = append(st.args, parts[0])
+			if len(parts) > 1 {
+				st.args = append(st.args, unprintableRE.ReplaceAllString(unescapeStatus(parts[1]), ""))
+			}
+		default:
+			if rest != "" {
+				st.args = strings.Split(rest, " ")
+			}
+		}
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+// parseTimestamp parses a status timestamp, which is either seconds since epoch or ISO 8601.
+func parseTimestamp(s string) time.Time {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0)
+	}
+	if t, err := time.Parse("20060102T150405", s); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// applySignature fills in signature data from status lines. Only the
+// first signature is used. Returns true if any signature was found.
+func (s *Status) applySignature(lines []statusLine) bool {
+	found := false
+	for _, l := range lines {
+		if l.keyword == "NEWSIG" && found {
+			// Only look at first signature.
+			break
+		}
+		switch l.keyword {
+		case "GOODSIG", "EXPSIG", "EXPKEYSIG", "REVKEYSIG":
+			found = true
+			s.GoodSignature = true
+			s.KeyID = l.args[0]
+			if len(l.args) > 1 {
+				s.Signed = l.args[1]
+			}
+			switch l.keyword {
+			case "EXPSIG":
+				s.SignatureExpired = true
+				s.Warnings = append(s.Warnings, "signature expired")
+			case "EXPKEYSIG":
+				s.KeyExpired = true
+				s.Warnings = append(s.Warnings, "key expired")
+			case "REVKEYSIG":
+				s.KeyRevoked = true
+				s.Warnings = append(s.Warnings, "key revoked")
+			}
+		case "BADSIG":
+			found = true
+			s.GoodSignature = false
+			s.KeyID = l.args[0]
+			if len(l.args) > 1 {
+				s.Signed = l.args[1]
+			}
+		case "ERRSIG":
+			found = true
+			if len(l.args) > 0 {
+				s.KeyID = l.args[0]
+			}
+			if len(l.args) > 4 {
+				s.SignatureTime = parseTimestamp(l.args[4])
+			}
+			// Return code 9 is missing public key.
+			if len(l.args) > 5 && l.args[5] == "9" {
+				s.UnknownKey = true
+			}
+		case "NO_PUBKEY":
+			s.UnknownKey = true
+			if len(l.args) > 0 {
+				s.KeyID = l.args[0]
+			}
+		case "VALIDSIG":
+			if len(l.args) > 0 {
+				s.Fingerprint = l.args[0]
+			}
+			if len(l.args) > 2 {
+				s.SignatureTime = parseTimestamp(l.args[2])
+			}
+			if len(l.args) > 9 {
+				// Fingerprint of primary key, in case signed with a subkey.
+				s.Fingerprint = l.args[9]
+			}
+		case "TRUST_UNDEFINED":
+			s.Trust = TrustUndefined
+		case "TRUST_NEVER":
+			s.Trust = TrustNever
+		case "TRUST_MARGINAL":
+			s.Trust = TrustMarginal
+		case "TRUST_FULLY":
+			s.Trust = TrustFully
+		case "TRUST_ULTIMATE":
+			s.Trust = TrustUltimate
+		}
+	}
+	return found
+}
+
+// run runs gpg with the status FD turned on.
+// Returns stdout, status lines, stderr, and the error from running the command.
+func (gpg *GPG) run(ctx context.Context, stdin io.Reader, args ...string) (string, []statusLine, string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", nil, "", errors.Wrap(err, "creating status pipe")
+	}
+	defer r.Close()
+
 	var stderr bytes.Buffer
 	var stdout bytes.Buffer
-	cmd := exec.CommandContext(ctx, gpg.GPG, "--batch", "--no-tty")
+	cmd := exec.CommandContext(ctx, gpg.GPG, append([]string{"--no-tty", "--status-fd", statusFD}, args...)...)
+	cmd.Stdin = stdin
+	cmd.Stderr = &stderr
+	cmd.Stdout = &stdout
+	cmd.ExtraFiles = []*os.File{w}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return "", nil, "", errors.Wrapf(err, "failed to start gpg (%q)", gpg.GPG)
+	}
+	w.Close()
+
+	statusCh := make(chan []statusLine)
+	go func() {
+		statusCh <- parseStatusLines(r)
+	}()
+	err = cmd.Wait()
+	status := <-statusCh
+	log.Debugf("gpg status: %+v", status)
+	return stdout.String(), status, stderr.String(), err
+}
+
+// lookupUIDs returns all user IDs of the given key.
+func (gpg *GPG) lookupUIDs(ctx context.Context, key string) ([]string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, gpg.GPG, "--no-tty", "--batch", "--with-colons", "--list-keys", key)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "listing key %q", key)
+	}
+	var ret []string
+	for _, l := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Split(l, ":")
+		if len(fields) > 9 && fields[0] == "uid" {
+			ret = append(ret, unprintableRE.ReplaceAllString(unescapeColons(fields[9]), ""))
+		}
+	}
+	return ret, nil
+}
+
+// unescapeColons undoes the C-style \xNN escaping used in --with-colons output.
+func unescapeColons(s string) string {
+	return colonEscapeRE.ReplaceAllStringFunc(s, func(in string) string {
+		b, err := strconv.ParseUint(in[2:], 16, 8)
+		if err != nil {
+			return in
+		}
+		return string([]byte{byte(b)})
+	})
+}
+
+// fillSigner looks up all the identities of the signer.
+func (gpg *GPG) fillSigner(ctx context.Context, status *Status) {
+	uids := []string{status.Signed}
+	key := status.Fingerprint
+	if key == "" {
+		key = status.KeyID
+	}
+	if key != "" && !status.UnknownKey {
+		if us, err := gpg.lookupUIDs(ctx, key); err != nil {
+			log.Warningf("Failed to look up UIDs of signer %q: %v", key, err)
+		} else if len(us) > 0 {
+			uids = us
+		}
+	}
+	status.SignerEmails = emailsFromUIDs(uids)
+}
+
+func (gpg *GPG) Decrypt(ctx context.Context, dec string) (string, *Status, error) {
+	args := []string{"--batch", "--decrypt"}
 	if gpg.Passphrase != "" {
 		// Used for testing.
-		cmd.Args = append(cmd.Args,
+		args = append(args,
 			"--passphrase", gpg.Passphrase,
 			"--pinentry-mode", "loopback",
 		)
 	}
-	cmd.Stdin = bytes.NewBufferString(dec)
-	cmd.Stderr = &stderr
-	cmd.Stdout = &stdout
-	if err := cmd.Start(); err != nil {
-		return "", nil, errors.Wrapf(err, "failed to start gpg (%q): %q", gpg.GPG, stderr.String())
-	}
-	if err := cmd.Wait(); err != nil {
-		return "", nil, errors.Wrapf(err, "gpg decrypt failed: %q", stderr.String())
+	stdout, lines, stderr, err := gpg.run(ctx, bytes.NewBufferString(dec), args...)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "gpg decrypt failed: %q", stderr)
 	}
 	status := &Status{}
-	if m := goodSignatureRE.FindStringSubmatch(stderr.String()); m != nil {
-		status.Signed = unprintableRE.ReplaceAllString(m[1], "")
-		status.GoodSignature = true
+	if status.applySignature(lines) {
+		gpg.fillSigner(ctx, status)
 	}
-	if ms := encryptedRE.FindAllStringSubmatch(stderr.String(), -1); ms != nil {
-		for _, m := range ms {
-			status.Encrypted = append(status.Encrypted, strings.Trim(unprintableRE.ReplaceAllString(m[1], ""), "\t "))
+	for _, l := range lines {
+		if l.keyword != "ENC_TO" || len(l.args) == 0 {
+			continue
+		}
+		name := l.args[0]
+		if uids, err := gpg.lookupUIDs(ctx, l.args[0]); err != nil {
+			log.Infof("Encrypted to unknown key %q: %v", l.args[0], err)
+		} else if len(uids) > 0 {
+			name = uids[0]
 		}
+		status.Encrypted = append(status.Encrypted, strings.Trim(name, "\t "))
 	}
+	return stdout, status, nil
+}
 
-	return stdout.String(), status, nil
+// verify runs gpg --verify and turns the status into a Status.
+func (gpg *GPG) verify(ctx context.Context, stdin io.Reader, args ...string) (*Status, error) {
+	_, lines, stderr, err := gpg.run(ctx, stdin, append([]string{"--verify"}, args...)...)
+	status := &Status{}
+	if !status.applySignature(lines) {
+		if err != nil {
+			return nil, errors.Wrapf(err, "gpg verify failed: %q", stderr)
+		}
+		return nil, fmt.Errorf("signature not good nor bad. What? %q", stderr)
+	}
+	// Status 1 is bad signature, and status 2 is unknown key. Both are described by the status.
+	gpg.fillSigner(ctx, status)
+	return status, nil
 }
 
 func (gpg *GPG) Verify(ctx context.Context, data, sig string) (*Status, error) {
@@ -92,79 +393,58 @@ func (gpg *GPG) Verify(ctx context.Context, data, sig string) (*Status, error) {
 	if err := ioutil.WriteFile(sigFN, []byte(sig), 0600); err != nil {
 		return nil, err
 	}
+	return gpg.verify(ctx, nil, sigFN, dataFN)
+}
 
-	var stderr bytes.Buffer
-	cmd := exec.CommandContext(ctx, gpg.GPG, "--verify", "--no-tty", sigFN, dataFN)
+func (gpg *GPG) VerifyInline(ctx context.Context, data string) (*Status, error) {
+	return gpg.verify(ctx, strings.NewReader(data), "-")
+}
+
+// ExportKey exports the minimal binary public key for the given address.
+func (gpg *GPG) ExportKey(ctx context.Context, addr string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, gpg.GPG, "--no-tty", "--batch", "--export", "--export-options", "export-minimal", addr)
+	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
-	if err := cmd.Start(); err != nil {
-		return nil, errors.Wrapf(err, "failed to start gpg (%q)", gpg.GPG)
-	}
-	status := &Status{}
-	goodOrBad := false
-	if err := cmd.Wait(); err != nil {
-		e, ok := err.(*exec.ExitError)
-		if !ok {
-			return nil, errors.Wrapf(err, "gpg verify failed for odd reason. stderr: %q", stderr.String())
-		}
-		u, ok := e.Sys().(syscall.WaitStatus)
-		if !ok {
-			return nil, errors.Wrapf(e, "gpg verify failed, and not unix status. stderr: %q", stderr.String())
-		}
-		if u.ExitStatus() != 1 {
-			return nil, errors.Wrapf(e, "gpg verify failed, and not status 1 (was %d). stderr: %q", u.ExitStatus(), stderr.String())
-		}
-		// Continue since status 1, assume either good or bad signature now.
-	}
-	if m := badSignatureRE.FindStringSubmatch(stderr.String()); m != nil {
-		status.Signed = unprintableRE.ReplaceAllString(m[1], "")
-		goodOrBad = true
-	}
-	if m := goodSignatureRE.FindStringSubmatch(stderr.String()); m != nil {
-		status.Signed = unprintableRE.ReplaceAllString(m[1], "")
-		status.GoodSignature = true
-		goodOrBad = true
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "gpg export failed: %q", stderr.String())
 	}
-	if !goodOrBad {
-		return nil, fmt.Errorf("signature not good nor bad. What? %q", stderr.String())
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("no public key found for %q", addr)
 	}
-	return status, nil
+	return stdout.Bytes(), nil
 }
 
-func (gpg *GPG) VerifyInline(ctx context.Context, data string) (*Status, error) {
-	var stderr bytes.Buffer
-	cmd := exec.CommandContext(ctx, gpg.GPG, "--verify", "--no-tty", "-")
-	cmd.Stderr = &stderr
-	cmd.Stdin = strings.NewReader(data)
-	if err := cmd.Start(); err != nil {
-		return nil, errors.Wrapf(err, "failed to start gpg (%q)", gpg.GPG)
+// Encrypt encrypts data to the given recipients, returning ASCII armored ciphertext.
+// Recipients are either looked up in the keyring (recipients), or
+// given as binary keys (keys), for keys not in the keyring.
+// Keyring recipients must be valid per the keyring's trust model. gpg doesn't
+// validate keys given as files; the caller vouches for those.
+func (gpg *GPG) Encrypt(ctx context.Context, data string, recipients []string, keys [][]byte) (string, error) {
+	if len(recipients)+len(keys) == 0 {
+		return "", fmt.Errorf("no recipients to encrypt to")
 	}
-	status := &Status{}
-	goodOrBad := false
-	if err := cmd.Wait(); err != nil {
-		e, ok := err.(*exec.ExitError)
-		if !ok {
-			return nil, errors.Wrapf(err, "gpg verify failed for odd reason. stderr: %q", stderr.String())
-		}
-		u, ok := e.Sys().(syscall.WaitStatus)
-		if !ok {
-			return nil, errors.Wrapf(e, "gpg verify failed, and not unix status. stderr: %q", stderr.String())
+	args := []string{"--batch", "--armor", "--encrypt"}
+	for _, r := range recipients {
+		args = append(args, "--recipient", r)
+	}
+	if len(keys) > 0 {
+		dir, err := ioutil.TempDir("", "gpg-encrypt")
+		if err != nil {
+			return "", err
 		}
-		if u.ExitStatus() != 1 {
-			return nil, errors.Wrapf(e, "gpg verify failed, and not status 1 (was %d). stderr: %q", u.ExitStatus(), stderr.String())
+		defer os.RemoveAll(dir)
+		for n, k := range keys {
+			fn := path.Join(dir, fmt.Sprintf("key%d.gpg", n))
+			if err := ioutil.WriteFile(fn, k, 0600); err != nil {
+				return "", err
+			}
+			args = append(args, "--recipient-file", fn)
 		}
-		// Continue since status 1, assume either good or bad signature now.
-	}
-	if m := badSignatureRE.FindStringSubmatch(stderr.String()); m != nil {
-		status.Signed = unprintableRE.ReplaceAllString(m[1], "")
-		goodOrBad = true
 	}
-	if m := goodSignatureRE.FindStringSubmatch(stderr.String()); m != nil {
-		status.Signed = unprintableRE.ReplaceAllString(m[1], "")
-		status.GoodSignature = true
-		goodOrBad = true
-	}
-	if !goodOrBad {
-		return nil, fmt.Errorf("signature not good nor bad. What? %q", stderr.String())
+	stdout, _, stderr, err := gpg.run(ctx, strings.NewReader(data), args...)
+	if err != nil {
+		return "", errors.Wrapf(err, "gpg encrypt failed: %q", stderr)
 	}
-	return status, nil
+	return stdout, nil
 }
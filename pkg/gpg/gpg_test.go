@@ -10,11 +10,15 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 const (
 	testKeyPassphrase = "abc123"
 	gpg2              = "gpg2"
+
+	authorKeyID       = "39A49EEA460A0169"
+	authorFingerprint = "990786988A24F52F1C2E87F639A49EEA460A0169"
 )
 
 var (
@@ -104,6 +108,12 @@ func TestVerify(t *testing.T) {
 			want: &Status{
 				Signed:        "Thomas Habets <thomas@habets.se>",
 				GoodSignature: true,
+				Warnings:      []string{"key expired"},
+				SignerEmails:  []string{"thomas@habets.se"},
+				KeyID:         authorKeyID,
+				Fingerprint:   authorFingerprint,
+				SignatureTime: time.Unix(1589447079, 0),
+				KeyExpired:    true,
 			},
 		},
 		// TODO: sign with unknown key.
@@ -114,6 +124,8 @@ func TestVerify(t *testing.T) {
 			want: &Status{
 				Signed:        "Thomas Habets <thomas@habets.se>",
 				GoodSignature: false,
+				SignerEmails:  []string{"thomas@habets.se"},
+				KeyID:         authorKeyID,
 			},
 		},
 		{
@@ -165,6 +177,12 @@ func TestVerifyInline(t *testing.T) {
 			want: &Status{
 				Signed:        "Thomas Habets <thomas@habets.se>",
 				GoodSignature: true,
+				Warnings:      []string{"key expired"},
+				SignerEmails:  []string{"thomas@habets.se"},
+				KeyID:         authorKeyID,
+				Fingerprint:   authorFingerprint,
+				SignatureTime: time.Unix(1589447096, 0),
+				KeyExpired:    true,
 			},
 		},
 		{
@@ -266,3 +284,222 @@ func TestDecrypt(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckSender(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		status   Status
+		from     string
+		mismatch bool
+	}{
+		{
+			name:   "match",
+			status: Status{GoodSignature: true, SignerEmails: []string{"thomas@habets.se"}},
+			from:   "Thomas Habets <thomas@habets.se>",
+		},
+		{
+			name:   "match case insensitive",
+			status: Status{GoodSignature: true, SignerEmails: []string{"thomas@habets.se"}},
+			from:   "Thomas@Habets.se",
+		},
+		{
+			name:   "second uid",
+			status: Status{GoodSignature: true, SignerEmails: []string{"a@example.com", "thomas@habets.se"}},
+			from:   "<thomas@habets.se>",
+		},
+		{
+			name:     "mismatch",
+			status:   Status{GoodSignature: true, SignerEmails: []string{"thomas@habets.se"}},
+			from:     "Thomas Habets <thomas@example.com>",
+			mismatch: true,
+		},
+		{
+			name:   "bad signature is not a mismatch",
+			status: Status{SignerEmails: []string{"thomas@habets.se"}},
+			from:   "evil@example.com",
+		},
+	} {
+		test.status.CheckSender(test.from)
+		if got, want := test.status.IdentityMismatch, test.mismatch; got != want {
+			t.Errorf("%q: got %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestApplySignature(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		in    string
+		found bool
+		want  Status
+	}{
+		{
+			name: "good and fully trusted",
+			in: `[GNUPG:] NEWSIG
+[GNUPG:] GOODSIG 39A49EEA460A0169 Thomas Habets <thomas@habets.se>
+[GNUPG:] VALIDSIG 990786988A24F52F1C2E87F639A49EEA460A0169 2020-05-14 1589447079 0 4 0 1 10 00 990786988A24F52F1C2E87F639A49EEA460A0169
+[GNUPG:] TRUST_FULLY 0 classic
+`,
+			found: true,
+			want: Status{
+				Signed:        "Thomas Habets <thomas@habets.se>",
+				GoodSignature: true,
+				KeyID:         authorKeyID,
+				Fingerprint:   authorFingerprint,
+				SignatureTime: time.Unix(1589447079, 0),
+				Trust:         TrustFully,
+			},
+		},
+		{
+			name: "revoked key",
+			in: `[GNUPG:] NEWSIG
+[GNUPG:] REVKEYSIG 39A49EEA460A0169 Thomas Habets <thomas@habets.se>
+[GNUPG:] TRUST_NEVER
+`,
+			found: true,
+			want: Status{
+				Signed:        "Thomas Habets <thomas@habets.se>",
+				GoodSignature: true,
+				Warnings:      []string{"key revoked"},
+				KeyID:         authorKeyID,
+				KeyRevoked:    true,
+				Trust:         TrustNever,
+			},
+		},
+		{
+			name: "unknown key",
+			in: `[GNUPG:] NEWSIG
+[GNUPG:] ERRSIG 39A49EEA460A0169 1 10 00 1589447079 9 990786988A24F52F1C2E87F639A49EEA460A0169
+[GNUPG:] NO_PUBKEY 39A49EEA460A0169
+`,
+			found: true,
+			want: Status{
+				KeyID:         authorKeyID,
+				SignatureTime: time.Unix(1589447079, 0),
+				UnknownKey:    true,
+			},
+		},
+		{
+			name: "escaped uid",
+			in: `[GNUPG:] NEWSIG
+[GNUPG:] BADSIG 39A49EEA460A0169 Thomas%25 Habets
+`,
+			found: true,
+			want: Status{
+				Signed: "Thomas% Habets",
+				KeyID:  authorKeyID,
+			},
+		},
+		{
+			name: "no signature",
+			in:   "[GNUPG:] NODATA 4\n",
+		},
+	} {
+		var s Status
+		found := s.applySignature(parseStatusLines(strings.NewReader(test.in)))
+		if got, want := found, test.found; got != want {
+			t.Errorf("%q: found: got %v, want %v", test.name, got, want)
+		}
+		if got, want := s, test.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %+v, want %+v", test.name, got, want)
+		}
+	}
+}
+
+// importUntrustedKey generates a key elsewhere and imports it, without
+// validating it. Returns the public key.
+func importUntrustedKey(t *testing.T, addr string) []byte {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gpg-test-other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if out, err := exec.Command(gpg, "--homedir", dir, "--batch", "--passphrase", "", "--pinentry-mode", "loopback",
+		"--quick-gen-key", addr, "default", "default", "never").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to generate key for %q: %v: %s", addr, err, out)
+	}
+	key, err := exec.Command(gpg, "--homedir", dir, "--batch", "--export", addr).Output()
+	if err != nil {
+		t.Fatalf("Failed to export key for %q: %v", addr, err)
+	}
+	cmd := exec.Command(gpg, "--batch", "--import")
+	cmd.Stdin = bytes.NewReader(key)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to import key for %q: %v: %s", addr, err, out)
+	}
+	return key
+}
+
+func TestEncrypt(t *testing.T) {
+	ctx := context.Background()
+	g := New(gpg)
+	g.Passphrase = testKeyPassphrase
+
+	key, err := g.ExportKey(ctx, "test@example.com")
+	if err != nil {
+		t.Fatalf("Failed to export key: %v", err)
+	}
+	if _, err := g.ExportKey(ctx, "nobody@example.com"); err == nil {
+		t.Errorf("Exporting nonexisting key succeeded")
+	}
+	untrusted := importUntrustedKey(t, "untrusted@example.com")
+
+	for _, test := range []struct {
+		name       string
+		recipients []string
+		keys       [][]byte
+		fail       bool
+		noDecrypt  bool
+	}{
+		{
+			name:       "keyring",
+			recipients: []string{"test@example.com"},
+		},
+		{
+			name: "key file",
+			keys: [][]byte{key},
+		},
+		{
+			name:      "untrusted key file",
+			keys:      [][]byte{untrusted},
+			noDecrypt: true,
+		},
+		{
+			name:       "untrusted keyring",
+			recipients: []string{"untrusted@example.com"},
+			fail:       true,
+		},
+		{
+			name:       "untrusted keyring with key file",
+			recipients: []string{"untrusted@example.com"},
+			keys:       [][]byte{key},
+			fail:       true,
+		},
+		{
+			name: "no recipients",
+			fail: true,
+		},
+	} {
+		enc, err := g.Encrypt(ctx, "test message", test.recipients, test.keys)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%q: Encrypt succeeded, expected fail", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: Failed to encrypt: %v", test.name, err)
+		}
+		if test.noDecrypt {
+			continue
+		}
+		out, _, err := g.Decrypt(ctx, enc)
+		if err != nil {
+			t.Fatalf("%q: Failed to decrypt: %v", test.name, err)
+		}
+		if got, want := out, "test message"; got != want {
+			t.Errorf("%q: got %q, want %q", test.name, got, want)
+		}
+	}
+}
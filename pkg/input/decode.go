@@ -0,0 +1,258 @@
+package input
+
+import (
+	"strconv"
+	"strings"
+)
+
+var (
+	// Keys for CSI sequences ending in '~', by first parameter.
+	// 7 and 8 are Home and End on rxvt.
+	csiTildeKeys = map[int]string{
+		1:  Home,
+		2:  Insert,
+		3:  Delete,
+		4:  End,
+		5:  PgUp,
+		6:  PgDown,
+		7:  Home,
+		8:  End,
+		11: F1,
+		12: F2,
+		13: F3,
+		14: F4,
+		15: F5,
+		17: F6,
+		18: F7,
+		19: F8,
+		20: F9,
+		21: F10,
+		23: F11,
+		24: F12,
+	}
+
+	// Keys for CSI and SS3 sequences ending in a letter.
+	letterKeys = map[byte]string{
+		'A': Up,
+		'B': Down,
+		'C': Right,
+		'D': Left,
+		'H': Home,
+		'F': End,
+		'P': F1,
+		'Q': F2,
+		'R': F3,
+		'S': F4,
+	}
+
+	// Keypad in application mode (SS3).
+	keypadKeys = map[byte]string{
+		'M': Enter,
+		'X': "=",
+		'j': "*",
+		'k': "+",
+		'l': ",",
+		'm': "-",
+		'n': ".",
+		'o': "/",
+		'p': "0",
+		'q': "1",
+		'r': "2",
+		's': "3",
+		't': "4",
+		'u': "5",
+		'v': "6",
+		'w': "7",
+		'x': "8",
+		'y': "9",
+	}
+
+	// Linux console function keys, Esc [ [ A-E.
+	linuxKeys = map[byte]string{
+		'A': F1,
+		'B': F2,
+		'C': F3,
+		'D': F4,
+		'E': F5,
+	}
+
+	// rxvt arrows with modifiers, e.g. Esc [ a for Shift-Up, and Esc O a for Ctrl-Up.
+	rxvtArrows = map[byte]string{
+		'a': Up,
+		'b': Down,
+		'c': Right,
+		'd': Left,
+	}
+)
+
+// Modifiers, as in xterm's modifier parameter minus one.
+const (
+	modShift = 1
+	modMeta  = 2
+	modCtrl  = 4
+	modMeta2 = 8 // "Meta" key, as opposed to Alt. Treated as Meta.
+)
+
+// decodeKey turns a raw escape sequence into a key.
+// `ti` maps terminfo sequences to keys, and takes precedence.
+// Unknown sequences are returned as is.
+func decodeKey(seq string, ti map[string]string) string {
+	if k, ok := ti[seq]; ok {
+		return k
+	}
+	if !strings.HasPrefix(seq, Esc) || seq == Esc {
+		return seq
+	}
+	body := seq[1:]
+	switch {
+	case strings.HasPrefix(body, Esc):
+		// Meta on an escape sequence.
+		k := decodeKey(body, ti)
+		if _, known := keyNames[k]; k == body && !known {
+			// Unknown.
+			return seq
+		}
+		return withModifiers(k, modMeta)
+	case strings.HasPrefix(body, "["):
+		return decodeCSI(seq, body[1:])
+	case strings.HasPrefix(body, "O") && len(body) > 1:
+		return decodeSS3(seq, body[1:])
+	}
+	// Meta on a character.
+	return withModifiers(body, modMeta)
+}
+
+// decodeCSI decodes the part after Esc [.
+func decodeCSI(seq, s string) string {
+	if s == "" {
+		return seq
+	}
+	if strings.HasPrefix(s, "<") {
+		// Mouse.
+		return seq
+	}
+	if len(s) == 2 && s[0] == '[' {
+		if k, ok := linuxKeys[s[1]]; ok {
+			return k
+		}
+		return seq
+	}
+	final := s[len(s)-1]
+	params := s[:len(s)-1]
+	if params == "" {
+		if k, ok := rxvtArrows[final]; ok {
+			return withModifiers(k, modShift)
+		}
+		if final == 'Z' {
+			return ShiftTab
+		}
+	}
+	var ps []int
+	if params != "" {
+		for _, p := range strings.Split(params, ";") {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return seq
+			}
+			ps = append(ps, n)
+		}
+	}
+	param := func(n, def int) int {
+		if n < len(ps) {
+			return ps[n]
+		}
+		return def
+	}
+	mods := param(1, 1) - 1
+	if mods < 0 {
+		return seq
+	}
+	switch final {
+	case '~', '^', '$', '@':
+		k, ok := csiTildeKeys[param(0, 0)]
+		if !ok {
+			return seq
+		}
+		switch final {
+		case '^':
+			mods |= modCtrl
+		case '$':
+			mods |= modShift
+		case '@':
+			mods |= modCtrl | modShift
+		}
+		return withModifiers(k, mods)
+	case 'Z':
+		return withModifiers(Tab, mods|modShift)
+	}
+	if len(ps) > 2 || (len(ps) > 0 && ps[0] != 1) {
+		return seq
+	}
+	if k, ok := letterKeys[final]; ok {
+		return withModifiers(k, mods)
+	}
+	return seq
+}
+
+// decodeSS3 decodes the part after Esc O.
+func decodeSS3(seq, s string) string {
+	mods := 0
+	if len(s) == 2 && s[0] >= '1' && s[0] <= '9' {
+		// Some terminals send modifiers here, e.g. Esc O 5 A.
+		mods = int(s[0]-'0') - 1
+		s = s[1:]
+	}
+	if len(s) != 1 {
+		return seq
+	}
+	if k, ok := letterKeys[s[0]]; ok {
+		return withModifiers(k, mods)
+	}
+	if k, ok := rxvtArrows[s[0]]; ok {
+		return withModifiers(k, mods|modCtrl)
+	}
+	if k, ok := keypadKeys[s[0]]; ok {
+		return withModifiers(k, mods)
+	}
+	return seq
+}
+
+// splitModifiers splits a key into modifiers and the key without them.
+func splitModifiers(key string) (string, int) {
+	mods := 0
+	for {
+		switch {
+		case strings.HasPrefix(key, CtrlPrefix) && len(key) > len(CtrlPrefix):
+			mods |= modCtrl
+			key = key[len(CtrlPrefix):]
+		case strings.HasPrefix(key, MetaPrefix) && len(key) > len(MetaPrefix):
+			mods |= modMeta
+			key = key[len(MetaPrefix):]
+		case strings.HasPrefix(key, ShiftPrefix) && len(key) > len(ShiftPrefix):
+			mods |= modShift
+			key = key[len(ShiftPrefix):]
+		default:
+			return key, mods
+		}
+	}
+}
+
+// withModifiers adds modifiers to a key, keeping them in canonical order.
+func withModifiers(key string, mods int) string {
+	if mods&modMeta2 != 0 {
+		mods = mods&^modMeta2 | modMeta
+	}
+	key, old := splitModifiers(key)
+	mods |= old
+	ret := ""
+	if mods&modCtrl != 0 {
+		ret += CtrlPrefix
+	}
+	if mods&modMeta != 0 {
+		ret += MetaPrefix
+	}
+	if mods&modShift != 0 {
+		ret += ShiftPrefix
+	}
+	return ret + key
+}
@@ -0,0 +1,175 @@
+package input
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeKey(t *testing.T) {
+	ti := map[string]string{
+		"\x1B[4~": End, // Overrides the default.
+		"\x1B[K":  End,
+	}
+	for _, test := range []struct {
+		in, want string
+	}{
+		// Plain keys.
+		{"a", "a"},
+		{Esc, Esc},
+		{"\x1B[A", Up},
+		{"\x1BOA", Up},
+		{"\x1B[H", Home},
+		{"\x1BOF", End},
+		{"\x1B[2~", Insert},
+		{"\x1B[3~", Delete},
+		{"\x1B[7~", Home},
+		{"\x1B[11~", F1},
+		{"\x1BOP", F1},
+		{"\x1B[15~", F5},
+		{"\x1B[24~", F12},
+		{"\x1B[[A", F1},
+		{"\x1B[[E", F5},
+		{"\x1B[Z", ShiftTab},
+
+		// xterm modifiers.
+		{"\x1B[1;5A", CtrlUp},
+		{"\x1B[1;2B", ShiftDown},
+		{"\x1B[1;3C", MetaRight},
+		{"\x1B[1;9D", MetaLeft},
+		{"\x1B[1;6A", "Ctrl-Shift-" + Up},
+		{"\x1B[1;8A", "Ctrl-Meta-Shift-" + Up},
+		{"\x1B[5;5~", CtrlPgUp},
+		{"\x1B[3;5~", CtrlDelete},
+		{"\x1B[15;2~", "Shift-" + F5},
+		{"\x1B[1;2P", "Shift-" + F1},
+		{"\x1BO5A", CtrlUp},
+
+		// rxvt.
+		{"\x1B[a", ShiftUp},
+		{"\x1BOa", CtrlUp},
+		{"\x1B[5^", CtrlPgUp},
+		{"\x1B[6$", ShiftPgDown},
+		{"\x1B[3@", "Ctrl-Shift-" + Delete},
+
+		// Keypad in application mode.
+		{"\x1BOM", Enter},
+		{"\x1BOq", "1"},
+		{"\x1BOk", "+"},
+
+		// Meta.
+		{"\x1Bv", "Meta-v"},
+		{"\x1B" + CtrlN, "Meta-" + CtrlN},
+		{"\x1B\x1B", "Meta-" + Esc},
+		{"\x1B\x1B[A", MetaUp},
+
+		// Terminfo.
+		{"\x1B[4~", End},
+		{"\x1B[K", End},
+
+		// Unknown sequences and events decoded elsewhere are kept as is.
+		{"\x1B[99~", "\x1B[99~"},
+		{"\x1B[1;xA", "\x1B[1;xA"},
+		{"\x1B[2;5A", "\x1B[2;5A"},
+		{"\x1BOz", "\x1BOz"},
+		{"\x1B\x1B[99~", "\x1B\x1B[99~"},
+		{"\x1B[<0;1;1M", "\x1B[<0;1;1M"},
+		{pasteStart, pasteStart},
+	} {
+		if got := decodeKey(test.in, ti); got != test.want {
+			t.Errorf("decodeKey(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+// terminfoFile builds a compiled terminfo file with the given string capabilities.
+func terminfoFile(magic int, strs map[int]string) []byte {
+	const name = "test|test terminal\x00"
+	numSize := 2
+	if magic == terminfoMagic32 {
+		numSize = 4
+	}
+	strCount := 0
+	for idx := range strs {
+		if idx >= strCount {
+			strCount = idx + 1
+		}
+	}
+	var table []byte
+	offsets := make([]int16, strCount)
+	for n := range offsets {
+		s, ok := strs[n]
+		if !ok {
+			offsets[n] = -1
+			continue
+		}
+		offsets[n] = int16(len(table))
+		table = append(append(table, s...), 0)
+	}
+	var b []byte
+	put := func(n int16) {
+		var buf [2]byte
+		binary.LittleEndian.PutUint16(buf[:], uint16(n))
+		b = append(b, buf[:]...)
+	}
+	for _, n := range []int{magic, len(name), 1, 1, strCount, len(table)} {
+		put(int16(n))
+	}
+	b = append(b, name...)
+	b = append(b, 1) // One bool.
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	b = append(b, make([]byte, numSize)...) // One number.
+	for _, o := range offsets {
+		put(o)
+	}
+	return append(b, table...)
+}
+
+func TestParseTerminfo(t *testing.T) {
+	strs := map[int]string{
+		0:   "\x07",      // bel, not a key.
+		55:  "\x7F",      // kbs, doesn't start with Esc.
+		59:  "\x1B[3~",   // kdch1
+		76:  "\x1B[1~",   // khome
+		87:  "\x1BOA",    // kcuu1
+		148: "\x1B[Z",    // kcbt
+		164: "\x1B[4~",   // kend
+		216: "\x1B[23~",  // kf11
+		218: "\x1B[1;2P", // kf13, not decoded from terminfo.
+	}
+	want := map[string]string{
+		"\x1B[3~":  Delete,
+		"\x1B[1~":  Home,
+		"\x1BOA":   Up,
+		"\x1B[Z":   ShiftTab,
+		"\x1B[4~":  End,
+		"\x1B[23~": F11,
+	}
+	for _, magic := range []int{terminfoMagic, terminfoMagic32} {
+		got, err := parseTerminfo(terminfoFile(magic, strs))
+		if err != nil {
+			t.Fatalf("parseTerminfo(magic %o): %v", magic, err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("parseTerminfo(magic %o) = %q, want %q", magic, got, want)
+		}
+		for seq, key := range want {
+			if got[seq] != key {
+				t.Errorf("parseTerminfo(magic %o)[%q] = %q, want %q", magic, seq, got[seq], key)
+			}
+		}
+	}
+
+	good := terminfoFile(terminfoMagic, strs)
+	for _, bad := range [][]byte{
+		nil,
+		good[:5],
+		good[:len(good)-1],
+		append([]byte{0, 0}, good[2:]...),
+	} {
+		if _, err := parseTerminfo(bad); err == nil {
+			t.Errorf("parseTerminfo(%q) succeeded, want error", bad)
+		}
+	}
+}
@@ -22,8 +22,12 @@ const (
 	// Named keys.
 	EscChar = 27
 
+	CtrlB     = "\x02"
 	CtrlC     = "\x03"
+	CtrlF     = "\x06"
+	CtrlG     = "\x07"
 	CtrlH     = "\x08"
+	Tab       = "\x09"
 	Return    = "\x0a"
 	CtrlL     = "\x0c"
 	Enter     = "\x0d"
@@ -36,29 +40,64 @@ const (
 	Esc       = "\x1b"
 	Backspace = "\x7F"
 
-	// Multibyte chars.
-	multibyteOneMore  = "O["
-	multibyteStopChar = '~'
-	Up                = "\x1B[A"
-	Down              = "\x1B[B"
-	Right             = "\x1B[C"
-	Left              = "\x1B[D"
-	F1                = "\x1BOP"
-	F2                = "\x1BOQ"
-	F3                = "\x1BOR"
-	F4                = "\x1BOS"
-	Home              = "\x1B[1~"
-	End               = "\x1B[4~"
-	PgUp              = "\x1B[5~"
-	PgDown            = "\x1B[6~"
+	// Multibyte keys. Escape sequences are decoded into these, whatever the terminal sends.
+	Up     = "\x1B[A"
+	Down   = "\x1B[B"
+	Right  = "\x1B[C"
+	Left   = "\x1B[D"
+	F1     = "\x1BOP"
+	F2     = "\x1BOQ"
+	F3     = "\x1BOR"
+	F4     = "\x1BOS"
+	F5     = "\x1B[15~"
+	F6     = "\x1B[17~"
+	F7     = "\x1B[18~"
+	F8     = "\x1B[19~"
+	F9     = "\x1B[20~"
+	F10    = "\x1B[21~"
+	F11    = "\x1B[23~"
+	F12    = "\x1B[24~"
+	Home   = "\x1B[1~"
+	Insert = "\x1B[2~"
+	Delete = "\x1B[3~"
+	End    = "\x1B[4~"
+	PgUp   = "\x1B[5~"
+	PgDown = "\x1B[6~"
+
+	// Modifier prefixes, in the order they appear on a key. E.g. "Ctrl-Shift-\x1B[A".
+	// Meta on a single character is also "Meta-", e.g. "Meta-v".
+	CtrlPrefix  = "Ctrl-"
+	MetaPrefix  = "Meta-"
+	ShiftPrefix = "Shift-"
+
+	// Keys with modifiers.
+	ShiftTab    = ShiftPrefix + Tab
+	CtrlUp      = CtrlPrefix + Up
+	CtrlDown    = CtrlPrefix + Down
+	CtrlRight   = CtrlPrefix + Right
+	CtrlLeft    = CtrlPrefix + Left
+	CtrlHome    = CtrlPrefix + Home
+	CtrlEnd     = CtrlPrefix + End
+	CtrlPgUp    = CtrlPrefix + PgUp
+	CtrlPgDown  = CtrlPrefix + PgDown
+	CtrlDelete  = CtrlPrefix + Delete
+	ShiftUp     = ShiftPrefix + Up
+	ShiftDown   = ShiftPrefix + Down
+	ShiftRight  = ShiftPrefix + Right
+	ShiftLeft   = ShiftPrefix + Left
+	MetaUp      = MetaPrefix + Up
+	MetaDown    = MetaPrefix + Down
+	MetaRight   = MetaPrefix + Right
+	MetaLeft    = MetaPrefix + Left
+	ShiftPgUp   = ShiftPrefix + PgUp
+	ShiftPgDown = ShiftPrefix + PgDown
 )
 
 var (
-	repeatProtection = 5 * time.Millisecond
-
 	errTimeout = fmt.Errorf("timeout")
 
 	readKeyTimeout       = 50 * time.Millisecond
+	maxEscapeLen         = 32
 	readMultibyteTimeout = 10 * time.Millisecond
 )
 
@@ -68,29 +107,38 @@ type Input struct {
 	winch   chan os.Signal
 	keys    chan string // Open if running.
 
-	m           sync.RWMutex
-	pasteStatus []bool
+	terminfo map[string]string // Key sequences from terminfo.
+
+	m      sync.RWMutex
+	keymap *Keymap
+	mouse  bool
 }
 
-func (i *Input) PastePush(b bool) {
+// SetMouse turns mouse reporting on or off. Takes effect on next Start.
+func (i *Input) SetMouse(b bool) {
 	i.m.Lock()
 	defer i.m.Unlock()
-	i.pasteStatus = append(i.pasteStatus, b)
+	i.mouse = b
 }
 
-func (i *Input) PastePop() {
+func (i *Input) mouseEnabled() bool {
+	i.m.RLock()
+	defer i.m.RUnlock()
+	return i.mouse
+}
+
+// SetKeymap sets the keymap used by views and dialogs.
+func (i *Input) SetKeymap(k *Keymap) {
 	i.m.Lock()
 	defer i.m.Unlock()
-	i.pasteStatus = i.pasteStatus[:len(i.pasteStatus)-1]
+	i.keymap = k
 }
 
-func (i *Input) pasteProtection() bool {
+// Keymap returns the keymap set with SetKeymap, or nil if none.
+func (i *Input) Keymap() *Keymap {
 	i.m.RLock()
 	defer i.m.RUnlock()
-	if len(i.pasteStatus) == 0 {
-		return true
-	}
-	return i.pasteStatus[len(i.pasteStatus)-1]
+	return i.keymap
 }
 
 func (i *Input) Chan() <-chan string {
@@ -101,6 +149,17 @@ func (i *Input) Winch() <-chan os.Signal {
 	return i.winch
 }
 
+// KeyOrResize waits for a key, or for the terminal to be resized.
+// Returns true, and no key, if the terminal was resized.
+func (i *Input) KeyOrResize() (string, bool) {
+	select {
+	case key := <-i.keys:
+		return key, false
+	case <-i.winch:
+		return "", true
+	}
+}
+
 // Stop input loop, turn off raw mode.
 func (i *Input) Stop() {
 	log.Infof("Stopping keyboard input")
@@ -201,8 +260,9 @@ func maxTimeoutNow(now time.Time, deadline time.Time, timeout time.Duration) tim
 	return deadline.Sub(now)
 }
 
-// readKey reads a whole key including multibyte keys.
-func readKey(fd int) (string, error) {
+// readKey reads a whole key including multibyte keys, and decodes escape sequences.
+// `ti` maps sequences from terminfo to keys.
+func readKey(fd int, ti map[string]string) (string, error) {
 	deadline := time.Now().Add(readKeyTimeout)
 
 	// Read a byte.
@@ -213,97 +273,113 @@ func readKey(fd int) (string, error) {
 	if err != nil {
 		return "", errors.Wrapf(err, "reading key byte")
 	}
-
-	// Construct full key.
-	key := fmt.Sprintf("%c", b)
 	if b != EscChar {
-		// TODO: For these multibytes, should they be checked
-		// with utf8.DecodeRune, utf8.FullRune, or utf8.Valid?
-		if (b & 0xe0) == 0xc0 {
-			// Two-byte UTF-8.
-			// Example: ö
-			b2, err := readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
-			if err != nil {
-				return "", err
-			}
-			return string([]byte{b, b2}), nil
+		return readUTF8(fd, b, deadline)
+	}
+	seq, err := readEscape(fd, deadline)
+	if err != nil {
+		return "", err
+	}
+	return decodeKey(seq, ti), nil
+}
+
+// readUTF8 reads the rest of a UTF-8 character, given the first byte.
+func readUTF8(fd int, b byte, deadline time.Time) (string, error) {
+	n := 0
+	switch {
+	case (b & 0xe0) == 0xc0:
+		// Two-byte UTF-8.
+		// Example: ö
+		n = 1
+	case (b & 0xf0) == 0xe0:
+		// Three-byte UTF-8.
+		// Example: ☃
+		n = 2
+	case (b & 0xf8) == 0xf0:
+		// Four-byte UTF-8.
+		// Example: 𐍈
+		n = 3
+	}
+	ret := []byte{b}
+	for ; n > 0; n-- {
+		b, err := readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
+		if err != nil {
+			return "", err
 		}
-		if (b & 0xf0) == 0xe0 {
-			// Three-byte UTF-8.
-			// Example: ☃
-			b2, err := readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
-			if err != nil {
+		ret = append(ret, b)
+	}
+	return string(ret), nil
+}
+
+// readEscape reads an escape sequence, after the initial Esc.
+// Returns the whole raw sequence, including the Esc.
+func readEscape(fd int, deadline time.Time) (string, error) {
+	next := func() (byte, error) {
+		return readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
+	}
+	b, err := next()
+	if err == errTimeout {
+		// Plain esc.
+		return Esc, nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "reading second byte in escape sequence")
+	}
+	seq := Esc + string([]byte{b})
+	switch b {
+	case '[':
+		// CSI: parameters and intermediates, then a final byte.
+		for len(seq) < maxEscapeLen {
+			b, err := next()
+			if err == errTimeout {
+				log.Errorf("Got incomplete escape sequence (%q)", seq)
 				return "", err
 			}
-			b3, err := readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
 			if err != nil {
-				return "", err
+				return "", errors.Wrapf(err, "reading escape sequence")
+			}
+			seq += string([]byte{b})
+			if b == '[' && len(seq) == 3 {
+				// Linux console function keys, e.g. Esc [ [ A.
+				continue
+			}
+			if (b >= 0x40 && b <= 0x7e) || b == '$' {
+				// '$' ends rxvt shifted keys, e.g. Esc [ 3 $.
+				return seq, nil
 			}
-			return string([]byte{b, b2, b3}), nil
 		}
-		if (b & 0xf8) == 0xf0 {
-			// Four-byte UTF-8.
-			// Example: 𐍈
-			b2, err := readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
-			if err != nil {
+		return "", fmt.Errorf("escape sequence too long (%q)", seq)
+	case 'O':
+		// SS3: one byte, possibly after a modifier.
+		for len(seq) < 4 {
+			b, err := next()
+			if err == errTimeout {
+				log.Errorf("Got incomplete escape sequence (%q)", seq)
 				return "", err
 			}
-			b3, err := readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
 			if err != nil {
-				return "", err
+				return "", errors.Wrapf(err, "reading escape sequence")
 			}
-			b4, err := readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
-			if err != nil {
-				return "", err
+			seq += string([]byte{b})
+			if b < '0' || b > '9' {
+				return seq, nil
 			}
-			return string([]byte{b, b2, b3, b4}), nil
-		}
-		return key, nil
-	}
-
-	// More bytes to read. Carry on.
-	b, err = readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
-	if err == errTimeout {
-		// Plain esc.
-		return key, nil
-	}
-	if err != nil {
-		return "", errors.Wrapf(err, "reading second byte in multibyte")
-	}
-
-	if strings.Contains(multibyteOneMore, fmt.Sprintf("%c", b)) {
-		// This is how arrow keys show up.
-		b2, err := readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
-		if err == errTimeout {
-			log.Errorf("Got unknown multibyte sequence (Esc,<something>,<nothing>)")
-			return "", err
 		}
+		return seq, nil
+	case EscChar:
+		// Meta on an escape sequence, e.g. Esc Esc [ A.
+		rest, err := readEscape(fd, deadline)
 		if err != nil {
-			return "", errors.Wrapf(err, "reading third byte in multibyte")
-		}
-		if strings.Contains("0123456789", fmt.Sprintf("%c", b2)) {
-			s := fmt.Sprintf("%c%c%c", EscChar, b, b2)
-			for {
-				b, err := readByte(fd, maxTimeout(deadline, readMultibyteTimeout))
-				if err == errTimeout {
-					log.Errorf("Got unknown multibyte sequence (%q)", s)
-					return "", err
-				}
-				s += fmt.Sprintf("%c", b)
-
-				if b == multibyteStopChar {
-					break
-				}
-			}
-			return s, nil
+			return "", err
 		}
-		return fmt.Sprintf("%c%c%c", EscChar, b, b2), nil
+		return Esc + rest, nil
 	}
-	if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') {
-		return fmt.Sprintf("Meta-%c", b), nil
+	// Meta on a character.
+	s, err := readUTF8(fd, b, deadline)
+	if err != nil {
+		return "", err
 	}
-	log.Errorf("Discarding key %v because it came right after escape", b)
-	return key, nil
+	return Esc + s, nil
 }
 
 // Start turns on raw mode and the key-receive loop.
@@ -313,6 +389,11 @@ func (i *Input) Start() error {
 	if err != nil {
 		return err
 	}
+	fmt.Print(pasteOn)
+	mouse := i.mouseEnabled()
+	if mouse {
+		fmt.Print(mouseOn)
+	}
 	i.running = make(chan struct{})
 	i.stop = make(chan struct{})
 	i.keys = make(chan string)
@@ -320,8 +401,12 @@ func (i *Input) Start() error {
 		defer close(i.running)
 		defer close(i.keys)
 		defer terminal.Restore(fd, oldState)
-		last := time.Now()
-		lastEnter := time.Now()
+		defer fmt.Print(pasteOff)
+		if mouse {
+			defer fmt.Print(mouseOff)
+		}
+		var lastClick MouseEvent
+		var lastClickTime time.Time
 		for {
 			select {
 			case <-i.stop:
@@ -331,7 +416,7 @@ func (i *Input) Start() error {
 				// go on
 			}
 
-			key, err := readKey(fd)
+			key, err := readKey(fd, i.terminfo)
 			if errors.Cause(err) == errTimeout {
 				continue
 			}
@@ -347,23 +432,26 @@ func (i *Input) Start() error {
 
 			// log.Infof("read done")
 			keyTime := time.Now()
-			if i.pasteProtection() && keyTime.Sub(last) < repeatProtection {
-				log.Warningf("Paste protection blocked keypress %q registering. %v < %v", key, keyTime.Sub(last), repeatProtection)
-				last = keyTime
+
+			if key == pasteStart {
+				i.keys <- pasteStart + readPaste(fd)
 				continue
 			}
-			if keyTime.Sub(lastEnter) < repeatProtection {
-				log.Warningf("Post-enter paste protection blocked keypress %q registering. %v < %v", key, keyTime.Sub(lastEnter), repeatProtection)
-				last = keyTime
+			if strings.HasPrefix(key, mouseSGRPrefix) {
+				e, ok := decodeSGRMouse(key)
+				if !ok {
+					continue
+				}
+				if e.Button == MouseLeft {
+					if lastClick.Button == MouseLeft && !lastClick.Double && e.X == lastClick.X && e.Y == lastClick.Y && keyTime.Sub(lastClickTime) < doubleClickTime {
+						e.Double = true
+					}
+					lastClick, lastClickTime = e, keyTime
+				}
+				i.keys <- e.String()
 				continue
 			}
-
 			i.keys <- key
-			if key == Enter || key == Return {
-				lastEnter = keyTime
-			}
-
-			last = keyTime
 		}
 	}()
 	return nil
@@ -373,6 +461,11 @@ func New() *Input {
 	i := &Input{
 		winch: make(chan os.Signal, 1),
 	}
+	ti, err := loadTerminfo(os.Getenv("TERM"))
+	if err != nil {
+		log.Infof("No terminfo key sequences, using built-in ones only: %v", err)
+	}
+	i.terminfo = ti
 	signal.Notify(i.winch, syscall.SIGWINCH)
 	return i
 }
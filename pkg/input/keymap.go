@@ -0,0 +1,265 @@
+package input
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Names of keys that aren't printed as themselves.
+var keyNames = map[string]string{
+	" ":       "Space",
+	Tab:       "Tab",
+	Return:    "Return",
+	Enter:     "Enter",
+	Esc:       "Esc",
+	Backspace: "Backspace",
+	Up:        "Up",
+	Down:      "Down",
+	Right:     "Right",
+	Left:      "Left",
+	F1:        "F1",
+	F2:        "F2",
+	F3:        "F3",
+	F4:        "F4",
+	F5:        "F5",
+	F6:        "F6",
+	F7:        "F7",
+	F8:        "F8",
+	F9:        "F9",
+	F10:       "F10",
+	F11:       "F11",
+	F12:       "F12",
+	Home:      "Home",
+	End:       "End",
+	PgUp:      "PgUp",
+	PgDown:    "PgDown",
+	Insert:    "Insert",
+	Delete:    "Delete",
+}
+
+// Short names of modifiers, as used in key names.
+var modifierNames = []struct {
+	mod  int
+	name string
+}{
+	{modCtrl, "C-"},
+	{modMeta, "M-"},
+	{modShift, "S-"},
+}
+
+// KeyName returns the name of a key, as used in keymap files and help texts.
+// E.g. "a", "C-n", "M-v", "Enter", "Up" or "C-S-Up".
+func KeyName(key string) string {
+	base, mods := splitModifiers(key)
+	prefix := ""
+	for _, m := range modifierNames {
+		if mods&m.mod != 0 {
+			prefix += m.name
+		}
+	}
+	if n, ok := keyNames[base]; ok {
+		return prefix + n
+	}
+	if len(base) == 1 && base[0] < 32 {
+		return fmt.Sprintf("%sC-%c", prefix, base[0]+'a'-1)
+	}
+	return prefix + base
+}
+
+// ParseKey turns a key name from KeyName back into the key.
+func ParseKey(name string) (string, error) {
+	for k, n := range keyNames {
+		if strings.EqualFold(n, name) {
+			return k, nil
+		}
+	}
+	if len([]rune(name)) == 1 {
+		return name, nil
+	}
+	for _, m := range modifierNames {
+		if !strings.HasPrefix(name, m.name) || len(name) == len(m.name) {
+			continue
+		}
+		rest := name[len(m.name):]
+		if len(rest) == 1 && rest[0] <= ' ' {
+			return "", fmt.Errorf("invalid key %q", name)
+		}
+		if m.mod == modCtrl && len(rest) == 1 {
+			// Control character.
+			c := rest[0]
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c < 'a' || c > 'z' {
+				return "", fmt.Errorf("invalid control key %q", name)
+			}
+			return string([]byte{c - 'a' + 1}), nil
+		}
+		k, err := ParseKey(rest)
+		if err != nil {
+			return "", err
+		}
+		if base, _ := splitModifiers(k); m.mod != modMeta && len([]rune(base)) == 1 && base > " " {
+			// Printable characters only take Meta. Shifted ones are written as themselves.
+			return "", fmt.Errorf("invalid key %q", name)
+		}
+		return withModifiers(k, m.mod), nil
+	}
+	return "", fmt.Errorf("unknown key %q", name)
+}
+
+// Binding is a named action, with a description and the keys bound to it by default.
+type Binding struct {
+	Action string
+	Help   string
+	Keys   []string
+}
+
+// Keymap maps keys to named actions, separately for each view.
+type Keymap struct {
+	views map[string]map[string]string
+}
+
+// NewKeymap creates an empty keymap.
+func NewKeymap() *Keymap {
+	return &Keymap{
+		views: make(map[string]map[string]string),
+	}
+}
+
+// BindAll binds the default keys of all the bindings.
+func (k *Keymap) BindAll(view string, bs []Binding) {
+	for _, b := range bs {
+		for _, key := range b.Keys {
+			k.Bind(view, key, b.Action)
+		}
+	}
+}
+
+// Bind binds a key to an action, replacing any previous binding of that key.
+func (k *Keymap) Bind(view, key, action string) {
+	if k.views[view] == nil {
+		k.views[view] = make(map[string]string)
+	}
+	k.views[view][key] = action
+}
+
+// Unbind removes the binding of a key.
+func (k *Keymap) Unbind(view, key string) {
+	delete(k.views[view], key)
+}
+
+// Action returns the action bound to the key, or the empty string if none.
+func (k *Keymap) Action(view, key string) string {
+	if k == nil {
+		return ""
+	}
+	return k.views[view][key]
+}
+
+// Keys returns the keys bound to the action. Single character keys are first.
+func (k *Keymap) Keys(view, action string) []string {
+	if k == nil {
+		return nil
+	}
+	var ret []string
+	for key, a := range k.views[view] {
+		if a == action {
+			ret = append(ret, key)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		ni, nj := KeyName(ret[i]), KeyName(ret[j])
+		if len(ni) != len(nj) {
+			return len(ni) < len(nj)
+		}
+		return ni < nj
+	})
+	return ret
+}
+
+// Load applies bindings from a keymap file. Each line is one of:
+//
+//	bind <view> <key> <action>
+//	unbind <view> <key>
+//
+// Empty lines and lines starting with # are ignored.
+// `actions` are the valid actions for each view.
+func (k *Keymap) Load(r io.Reader, actions map[string][]Binding) error {
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fs := strings.Fields(l)
+		if err := k.loadLine(fs, actions); err != nil {
+			return fmt.Errorf("line %d: %v", lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (k *Keymap) loadLine(fs []string, actions map[string][]Binding) error {
+	switch {
+	case fs[0] == "bind" && len(fs) == 4:
+	case fs[0] == "unbind" && len(fs) == 3:
+	default:
+		return fmt.Errorf("expected 'bind <view> <key> <action>' or 'unbind <view> <key>', got %q", strings.Join(fs, " "))
+	}
+	view := fs[1]
+	bs, ok := actions[view]
+	if !ok {
+		var views []string
+		for v := range actions {
+			views = append(views, v)
+		}
+		sort.Strings(views)
+		return fmt.Errorf("unknown view %q, valid views are %s", view, strings.Join(views, ", "))
+	}
+	key, err := ParseKey(fs[2])
+	if err != nil {
+		return err
+	}
+	if fs[0] == "unbind" {
+		k.Unbind(view, key)
+		return nil
+	}
+	for _, b := range bs {
+		if b.Action == fs[3] {
+			k.Bind(view, key, fs[3])
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown action %q in view %q", fs[3], view)
+}
+
+// Help returns a help text for the bindings, in order, using the keys currently bound.
+func (k *Keymap) Help(view string, bs []Binding) string {
+	var keys []string
+	widest := 0
+	for _, b := range bs {
+		var names []string
+		for _, key := range k.Keys(view, b.Action) {
+			names = append(names, KeyName(key))
+		}
+		s := strings.Join(names, ", ")
+		if s == "" {
+			s = "(unbound)"
+		}
+		if len(s) > widest {
+			widest = len(s)
+		}
+		keys = append(keys, s)
+	}
+	var ret []string
+	for n, b := range bs {
+		ret = append(ret, fmt.Sprintf("%-*s — %s", widest, keys[n], b.Help))
+	}
+	return strings.Join(ret, "\n")
+}
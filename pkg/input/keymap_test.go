@@ -0,0 +1,92 @@
+package input
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyNameRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		key  string
+		name string
+	}{
+		{"a", "a"},
+		{" ", "Space"},
+		{Enter, "Enter"},
+		{CtrlN, "C-n"},
+		{CtrlG, "C-g"},
+		{"Meta-v", "M-v"},
+		{"Meta-<", "M-<"},
+		{PgDown, "PgDown"},
+		{"\\", "\\"},
+		{F12, "F12"},
+		{Delete, "Delete"},
+		{CtrlUp, "C-Up"},
+		{ShiftTab, "S-Tab"},
+		{"Ctrl-Shift-" + Right, "C-S-Right"},
+		{"Meta-" + CtrlN, "M-C-n"},
+		{"Meta-" + Backspace, "M-Backspace"},
+	} {
+		if got, want := KeyName(test.key), test.name; got != want {
+			t.Errorf("KeyName(%q) = %q, want %q", test.key, got, want)
+		}
+		got, err := ParseKey(test.name)
+		if err != nil {
+			t.Errorf("ParseKey(%q): %v", test.name, err)
+			continue
+		}
+		if got != test.key {
+			t.Errorf("ParseKey(%q) = %q, want %q", test.name, got, test.key)
+		}
+	}
+	for _, bad := range []string{"", "C-1", "M- ", "Foo", "C-M-x", "S-a", "C-", "C-Foo"} {
+		if k, err := ParseKey(bad); err == nil {
+			t.Errorf("ParseKey(%q) = %q, want error", bad, k)
+		}
+	}
+}
+
+func TestKeymapLoad(t *testing.T) {
+	bs := map[string][]Binding{
+		"list": {
+			{Action: "next", Help: "Next", Keys: []string{"n", Down}},
+			{Action: "prev", Help: "Previous", Keys: []string{"p", Up}},
+		},
+	}
+	k := NewKeymap()
+	k.BindAll("list", bs["list"])
+	if err := k.Load(strings.NewReader(`
+# Comment.
+bind list j next
+bind list C-p prev
+unbind list n
+`), bs); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"j":   "next",
+		Down:  "next",
+		"n":   "",
+		CtrlP: "prev",
+		"p":   "prev",
+	} {
+		if got := k.Action("list", key); got != want {
+			t.Errorf("Action(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if got, want := k.Help("list", bs["list"]), "j, Down    — Next\np, Up, C-p — Previous"; got != want {
+		t.Errorf("Help =\n%s\nwant\n%s", got, want)
+	}
+
+	for _, bad := range []string{
+		"bind list j",
+		"bind foo j next",
+		"bind list j nonexistent",
+		"bind list Foo next",
+		"rebind list j next",
+	} {
+		if err := NewKeymap().Load(strings.NewReader(bad), bs); err == nil {
+			t.Errorf("Load(%q) succeeded, want error", bad)
+		}
+	}
+}
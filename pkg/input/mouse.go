@@ -0,0 +1,123 @@
+package input
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mouse buttons.
+const (
+	MouseLeft      = "Left"
+	MouseMiddle    = "Middle"
+	MouseRight     = "Right"
+	MouseWheelUp   = "WheelUp"
+	MouseWheelDown = "WheelDown"
+
+	mousePrefix    = "Mouse-"
+	mouseSGRPrefix = "\x1B[<"
+
+	// Turn on button press reporting, in SGR format.
+	mouseOn  = "\x1B[?1000h\x1B[?1006h"
+	mouseOff = "\x1B[?1006l\x1B[?1000l"
+)
+
+var (
+	doubleClickTime = 400 * time.Millisecond
+)
+
+// MouseEvent is a mouse button press, or a wheel movement.
+// They're sent on the key channel as strings, and turned back into events with ParseMouse.
+type MouseEvent struct {
+	Button string
+	X, Y   int  // Screen position, starting at 0.
+	Double bool // Second click on the same spot within doubleClickTime.
+}
+
+// String returns the event as sent on the key channel, e.g. "Mouse-Left-10-2".
+func (e MouseEvent) String() string {
+	d := ""
+	if e.Double {
+		d = "Double"
+	}
+	return fmt.Sprintf("%s%s%s-%d-%d", mousePrefix, d, e.Button, e.X, e.Y)
+}
+
+// ParseMouse turns a key from the key channel back into a mouse event.
+// Returns false if the key is not a mouse event.
+func ParseMouse(key string) (MouseEvent, bool) {
+	if !strings.HasPrefix(key, mousePrefix) {
+		return MouseEvent{}, false
+	}
+	fs := strings.Split(strings.TrimPrefix(key, mousePrefix), "-")
+	if len(fs) != 3 {
+		return MouseEvent{}, false
+	}
+	var e MouseEvent
+	var err error
+	if e.X, err = strconv.Atoi(fs[1]); err != nil {
+		return MouseEvent{}, false
+	}
+	if e.Y, err = strconv.Atoi(fs[2]); err != nil {
+		return MouseEvent{}, false
+	}
+	e.Button = fs[0]
+	if strings.HasPrefix(e.Button, "Double") {
+		e.Double = true
+		e.Button = strings.TrimPrefix(e.Button, "Double")
+	}
+	return e, true
+}
+
+// IsMouse returns true if the key is a mouse event.
+func IsMouse(key string) bool {
+	_, ok := ParseMouse(key)
+	return ok
+}
+
+// decodeSGRMouse decodes an xterm SGR mouse report, e.g. "\x1B[<0;10;3M".
+// Returns false for releases, motion, and unknown buttons.
+func decodeSGRMouse(seq string) (MouseEvent, bool) {
+	if !strings.HasPrefix(seq, mouseSGRPrefix) || len(seq) < len(mouseSGRPrefix)+1 {
+		return MouseEvent{}, false
+	}
+	if seq[len(seq)-1] != 'M' {
+		// Release.
+		return MouseEvent{}, false
+	}
+	fs := strings.Split(seq[len(mouseSGRPrefix):len(seq)-1], ";")
+	if len(fs) != 3 {
+		return MouseEvent{}, false
+	}
+	var n [3]int
+	for i, f := range fs {
+		var err error
+		if n[i], err = strconv.Atoi(f); err != nil {
+			return MouseEvent{}, false
+		}
+	}
+	b := n[0]
+	if b&32 != 0 {
+		// Motion.
+		return MouseEvent{}, false
+	}
+	// Ignore shift, meta, and control.
+	b &^= 4 | 8 | 16
+	e := MouseEvent{X: n[1] - 1, Y: n[2] - 1}
+	switch b {
+	case 0:
+		e.Button = MouseLeft
+	case 1:
+		e.Button = MouseMiddle
+	case 2:
+		e.Button = MouseRight
+	case 64:
+		e.Button = MouseWheelUp
+	case 65:
+		e.Button = MouseWheelDown
+	default:
+		return MouseEvent{}, false
+	}
+	return e, true
+}
@@ -0,0 +1,48 @@
+package input
+
+import (
+	"testing"
+)
+
+func TestDecodeSGRMouse(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want MouseEvent
+		ok   bool
+	}{
+		{"\x1B[<0;1;1M", MouseEvent{Button: MouseLeft, X: 0, Y: 0}, true},
+		{"\x1B[<0;10;3M", MouseEvent{Button: MouseLeft, X: 9, Y: 2}, true},
+		{"\x1B[<2;5;5M", MouseEvent{Button: MouseRight, X: 4, Y: 4}, true},
+		{"\x1B[<16;5;5M", MouseEvent{Button: MouseLeft, X: 4, Y: 4}, true}, // Control-click.
+		{"\x1B[<64;5;5M", MouseEvent{Button: MouseWheelUp, X: 4, Y: 4}, true},
+		{"\x1B[<65;5;5M", MouseEvent{Button: MouseWheelDown, X: 4, Y: 4}, true},
+		{"\x1B[<0;10;3m", MouseEvent{}, false},  // Release.
+		{"\x1B[<32;10;3M", MouseEvent{}, false}, // Drag.
+		{"\x1B[<0;10M", MouseEvent{}, false},
+		{"\x1B[<a;b;cM", MouseEvent{}, false},
+		{"\x1B[A", MouseEvent{}, false},
+	} {
+		got, ok := decodeSGRMouse(test.in)
+		if ok != test.ok || got != test.want {
+			t.Errorf("decodeSGRMouse(%q) = %+v, %t, want %+v, %t", test.in, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseMouse(t *testing.T) {
+	for _, e := range []MouseEvent{
+		{Button: MouseLeft, X: 1, Y: 2},
+		{Button: MouseLeft, X: 10, Y: 20, Double: true},
+		{Button: MouseWheelDown},
+	} {
+		got, ok := ParseMouse(e.String())
+		if !ok || got != e {
+			t.Errorf("ParseMouse(%q) = %+v, %t, want %+v", e.String(), got, ok, e)
+		}
+	}
+	for _, key := range []string{"a", "M", "Meta-x", "Mouse-", "Mouse-Left-1", "Mouse-Left-x-1", Up} {
+		if IsMouse(key) {
+			t.Errorf("IsMouse(%q) = true, want false", key)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package input
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Bracketed paste. The terminal sends pasted text between these.
+	pasteStart = "\x1B[200~"
+	pasteEnd   = "\x1B[201~"
+
+	pasteOn  = "\x1B[?2004h"
+	pasteOff = "\x1B[?2004l"
+
+	// Longest paste accepted. The rest is discarded.
+	maxPaste = 1 << 20
+)
+
+var (
+	// How long to wait for the rest of a paste.
+	readPasteTimeout = time.Second
+)
+
+// PasteText returns the pasted text if the key is a paste event.
+// Pasted text is sent on the key channel as one event, instead of as keypresses.
+func PasteText(key string) (string, bool) {
+	if !strings.HasPrefix(key, pasteStart) {
+		return "", false
+	}
+	return strings.TrimPrefix(key, pasteStart), true
+}
+
+// IsPaste returns true if the key is a paste event.
+func IsPaste(key string) bool {
+	return strings.HasPrefix(key, pasteStart)
+}
+
+// readPaste reads pasted text up until the end marker.
+func readPaste(fd int) string {
+	var b strings.Builder
+	var tail []byte // Last bytes read, to find the end marker even if the paste is truncated.
+	for {
+		c, err := readByte(fd, readPasteTimeout)
+		if err != nil {
+			log.Errorf("Paste ended without end marker: %v", err)
+			return b.String()
+		}
+		if b.Len() < maxPaste+len(pasteEnd) {
+			b.WriteByte(c)
+		}
+		tail = append(tail, c)
+		if len(tail) > len(pasteEnd) {
+			tail = tail[1:]
+		}
+		if string(tail) != pasteEnd {
+			continue
+		}
+		s := strings.TrimSuffix(b.String(), pasteEnd)
+		if len(s) > maxPaste {
+			log.Warningf("Paste of more than %d bytes truncated", maxPaste)
+			s = s[:maxPaste]
+		}
+		return s
+	}
+}
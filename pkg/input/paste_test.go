@@ -0,0 +1,26 @@
+package input
+
+import (
+	"testing"
+)
+
+func TestPasteText(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{pasteStart + "hello\nworld", "hello\nworld", true},
+		{pasteStart, "", true},
+		{"q", "", false},
+		{"\x1B[2~", "", false},
+	} {
+		got, ok := PasteText(test.in)
+		if got != test.want || ok != test.ok {
+			t.Errorf("PasteText(%q) = %q, %t, want %q, %t", test.in, got, ok, test.want, test.ok)
+		}
+		if IsPaste(test.in) != test.ok {
+			t.Errorf("IsPaste(%q) = %t, want %t", test.in, !test.ok, test.ok)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package input
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// Magic numbers of compiled terminfo files, with 16 and 32 bit numbers.
+	terminfoMagic   = 0432
+	terminfoMagic32 = 01036
+)
+
+var (
+	// Key capabilities, by their index among string capabilities in compiled terminfo files.
+	terminfoKeyCaps = map[int]string{
+		59:  Delete,   // kdch1
+		61:  Down,     // kcud1
+		66:  F1,       // kf1
+		67:  F10,      // kf10
+		68:  F2,       // kf2
+		69:  F3,       // kf3
+		70:  F4,       // kf4
+		71:  F5,       // kf5
+		72:  F6,       // kf6
+		73:  F7,       // kf7
+		74:  F8,       // kf8
+		75:  F9,       // kf9
+		76:  Home,     // khome
+		77:  Insert,   // kich1
+		79:  Left,     // kcub1
+		81:  PgDown,   // knp
+		82:  PgUp,     // kpp
+		83:  Right,    // kcuf1
+		87:  Up,       // kcuu1
+		148: ShiftTab, // kcbt
+		164: End,      // kend
+		165: Enter,    // kent
+		216: F11,      // kf11
+		217: F12,      // kf12
+	}
+)
+
+// terminfoDirs returns the directories to look for terminfo files in, in order.
+func terminfoDirs() []string {
+	var ret []string
+	if d := os.Getenv("TERMINFO"); d != "" {
+		ret = append(ret, d)
+	}
+	if h := os.Getenv("HOME"); h != "" {
+		ret = append(ret, path.Join(h, ".terminfo"))
+	}
+	for _, d := range strings.Split(os.Getenv("TERMINFO_DIRS"), ":") {
+		if d != "" {
+			ret = append(ret, d)
+		}
+	}
+	return append(ret, "/etc/terminfo", "/lib/terminfo", "/usr/share/terminfo", "/usr/lib/terminfo")
+}
+
+// loadTerminfo loads the key sequences for a terminal from its compiled terminfo file.
+// Returns a map from escape sequence to key.
+func loadTerminfo(term string) (map[string]string, error) {
+	if term == "" || strings.Contains(term, "/") || strings.Contains(term, "..") {
+		return nil, fmt.Errorf("bad TERM %q", term)
+	}
+	for _, d := range terminfoDirs() {
+		// Linux uses the first letter, macOS its hex value.
+		for _, sub := range []string{term[:1], fmt.Sprintf("%x", term[0])} {
+			b, err := ioutil.ReadFile(path.Join(d, sub, term))
+			if err != nil {
+				continue
+			}
+			ret, err := parseTerminfo(b)
+			if err != nil {
+				return nil, fmt.Errorf("terminfo for %q in %q: %v", term, d, err)
+			}
+			return ret, nil
+		}
+	}
+	return nil, fmt.Errorf("no terminfo found for %q", term)
+}
+
+// parseTerminfo parses a compiled terminfo file, returning the key sequences.
+// Only sequences starting with Esc are returned, since the others are keys as is.
+func parseTerminfo(b []byte) (map[string]string, error) {
+	var hdr [6]int16
+	if len(b) < len(hdr)*2 {
+		return nil, fmt.Errorf("too short")
+	}
+	for n := range hdr {
+		hdr[n] = int16(binary.LittleEndian.Uint16(b[n*2:]))
+	}
+	numSize := 2
+	switch hdr[0] {
+	case terminfoMagic:
+	case terminfoMagic32:
+		numSize = 4
+	default:
+		return nil, fmt.Errorf("bad magic number %o", hdr[0])
+	}
+	nameSize, boolCount, numCount, strCount, tableSize := int(hdr[1]), int(hdr[2]), int(hdr[3]), int(hdr[4]), int(hdr[5])
+	if nameSize < 0 || boolCount < 0 || numCount < 0 || strCount < 0 || tableSize < 0 {
+		return nil, fmt.Errorf("bad header")
+	}
+	pos := len(hdr)*2 + nameSize + boolCount
+	if pos%2 == 1 {
+		// Numbers are aligned.
+		pos++
+	}
+	pos += numCount * numSize
+	table := pos + strCount*2
+	if table+tableSize > len(b) {
+		return nil, fmt.Errorf("truncated")
+	}
+	ret := make(map[string]string)
+	for idx, key := range terminfoKeyCaps {
+		if idx >= strCount {
+			continue
+		}
+		ofs := int(int16(binary.LittleEndian.Uint16(b[pos+idx*2:])))
+		if ofs < 0 || ofs >= tableSize {
+			// Absent or cancelled.
+			continue
+		}
+		s := b[table+ofs : table+tableSize]
+		if end := strings.IndexByte(string(s), 0); end >= 0 {
+			s = s[:end]
+		}
+		if len(s) > 1 && s[0] == EscChar {
+			ret[string(s)] = key
+		}
+	}
+	return ret, nil
+}